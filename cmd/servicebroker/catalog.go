@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/aws-servicebroker/pkg/broker"
+)
+
+const catalogUsage = `Usage:
+  servicebroker catalog render [options] <template directory>
+  servicebroker catalog diff [options] <old template directory> <new template directory>`
+
+// catalog renders the OSB catalog for a directory of templates, or compares the catalogs of two directories,
+// without contacting AWS. It returns the process exit code
+func catalog(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("catalog", flag.ContinueOnError)
+	fs.SetOutput(out)
+	accountID := fs.String("accountId", "", "AWS account ID the broker runs in, used to generate service and plan IDs.")
+	brokerID := fs.String("brokerId", options.BrokerID, "ID of the broker, used to generate service and plan IDs.")
+	templateFilter := fs.String("templateFilter", options.TemplateFilter, "only process templates with the defined suffix.")
+	prescribeOverrides := fs.Bool("prescribeOverrides", options.PrescribeOverrides, "remove globally overridden parameters (set with PARAM_OVERRIDE_ environment variables) from plan schemas.")
+	format := fs.String("format", "json", "output format for render, json or yaml.")
+	fs.Usage = func() {
+		fmt.Fprintln(out, catalogUsage)
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || (args[0] != "render" && args[0] != "diff") {
+		fs.Usage()
+		return 2
+	}
+	command := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	o := broker.RenderOptions{
+		AccountID:          *accountID,
+		BrokerID:           *brokerID,
+		TemplateFilter:     *templateFilter,
+		PrescribeOverrides: *prescribeOverrides,
+	}
+
+	if command == "render" {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		c, err := broker.RenderCatalog(fs.Arg(0), o)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		b, err := broker.MarshalCatalog(c, *format)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		fmt.Fprintln(out, string(b))
+		return 0
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	oldCatalog, err := broker.RenderCatalog(fs.Arg(0), o)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	newCatalog, err := broker.RenderCatalog(fs.Arg(1), o)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	changes, err := broker.DiffCatalogs(oldCatalog, newCatalog)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Fprintln(out, "No catalog changes")
+		return 0
+	}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", fs.Arg(0), fs.Arg(1))
+	for _, c := range changes {
+		fmt.Fprintln(out, c)
+	}
+	return 0
+}
@@ -32,6 +32,7 @@ var options struct {
 	EnableBasicAuth   bool
 	BasicAuthUser     string
 	BasicAuthPassword string
+	AdminToken        string
 }
 
 func init() {
@@ -44,11 +45,18 @@ func init() {
 	flag.BoolVar(&options.EnableBasicAuth, "enableBasicAuth", false, "Enable HTTP Basic Authentication")
 	flag.StringVar(&options.BasicAuthUser, "basicAuthUser", "", "HTTP Basic Authentication user")
 	flag.StringVar(&options.BasicAuthPassword, "basicAuthPass", "", "HTTP Basic Authentication password")
+	flag.StringVar(&options.AdminToken, "adminToken", "", "Bearer token required to use the admin API under /admin/, the admin API is disabled if not set")
 	broker.AddFlags(&options.Options)
 	flag.Parse()
 }
 
 func main() {
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validate(flag.Args()[1:], os.Stdout))
+	case "catalog":
+		os.Exit(catalog(flag.Args()[1:], os.Stdout))
+	}
 	if err := run(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
 		glog.Fatalln(err)
 	}
@@ -88,6 +96,7 @@ func runWithContext(ctx context.Context) error {
 		NewDdb:    broker.AwsDdbClientGetter,
 		NewIam:    broker.AwsIamClientGetter,
 		NewLambda: broker.AwsLambdaClientGetter,
+		NewSqs:    broker.AwsSqsClientGetter,
 	}
 
 	// Prom. metrics
@@ -106,6 +115,7 @@ func runWithContext(ctx context.Context) error {
 	if err != nil {
 		glog.Fatalln(err)
 	}
+	defer awsBroker.Close()
 
 	api, err := rest.NewAPISurface(awsBroker, osbMetrics)
 	if err != nil {
@@ -119,6 +129,13 @@ func runWithContext(ctx context.Context) error {
 	}
 	auth := server.BasicAuth{User: options.BasicAuthUser, Pass: options.BasicAuthPassword}
 	s := server.New(api, reg, options.EnableBasicAuth, auth.Secret)
+	s.Router.Use(broker.OSBExtensions)
+	if options.AdminToken == "" {
+		options.AdminToken = os.Getenv("ADMIN_TOKEN")
+	}
+	if options.AdminToken != "" {
+		s.Router.PathPrefix("/admin/").Handler(awsBroker.AdminHandler(options.AdminToken))
+	}
 
 	glog.Infof("Starting broker!")
 
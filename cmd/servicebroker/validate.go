@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/aws-servicebroker/pkg/broker"
+)
+
+// validate lints a directory of templates without contacting AWS, returning the process exit code
+func validate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	templateFilter := fs.String("templateFilter", options.TemplateFilter, "only validate templates with the defined suffix.")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: servicebroker validate [-templateFilter=-main.yaml] <template directory>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	errs, err := broker.ValidateTemplates(fs.Arg(0), *templateFilter)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	for _, e := range errs {
+		fmt.Fprintln(out, e)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(out, "%d problem(s) found\n", len(errs))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// AdminHandler returns the handler for the broker administration API, which is served under /admin/. Requests must
+// present token as a bearer token, if token is empty every request is refused
+func (b *AwsBroker) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/catalog/reload", b.adminReloadCatalog)
+	mux.HandleFunc("/admin/instances/", b.adminInstance)
+	mux.HandleFunc("/admin/upgrades", b.adminUpgradeCampaign)
+	mux.HandleFunc("/admin/upgrades/resume", b.adminUpgradeCampaignAction(b.ResumeUpgradeCampaign))
+	mux.HandleFunc("/admin/upgrades/cancel", b.adminUpgradeCampaignAction(b.CancelUpgradeCampaign))
+	return requireAdminToken(token, mux)
+}
+
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writeAdminResponse(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminReloadCatalog refreshes the catalog immediately, waiting for the refresh to complete. Passing one or more
+// template query parameters only reloads those templates
+func (b *AwsBroker) adminReloadCatalog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "MethodNotAllowed"})
+		return
+	}
+	req := CatalogRefreshRequest{
+		Trigger: refreshTriggerAdmin,
+		Updated: r.URL.Query()["template"],
+		Done:    make(chan error, 1),
+	}
+	glog.Infof("Catalog reload requested by admin API, templates: %v", req.Updated)
+	select {
+	case b.refresh <- req:
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case err := <-req.Done:
+		if err != nil {
+			writeAdminResponse(w, http.StatusInternalServerError, map[string]string{"error": "ReloadFailed", "description": err.Error()})
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	case <-r.Context().Done():
+	}
+}
+
+// adminInstance handles POST /admin/instances/<id>/<action> requests acting on a service instance
+func (b *AwsBroker) adminInstance(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/instances/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": "NotFound"})
+		return
+	}
+	var action func(w http.ResponseWriter, r *http.Request, id string)
+	switch parts[1] {
+	case "upgrade":
+		action = b.adminUpgradeInstance
+	case "continue-rollback":
+		action = b.adminContinueUpdateRollback
+	case "preview-update":
+		action = b.adminPreviewUpdate
+	default:
+		writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": "NotFound"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "MethodNotAllowed"})
+		return
+	}
+	action(w, r, parts[0])
+}
+
+// adminUpgradeInstance handles POST /admin/instances/<id>/upgrade, updating the instance's stack to the latest
+// template for its service
+func (b *AwsBroker) adminUpgradeInstance(w http.ResponseWriter, r *http.Request, id string) {
+	upgraded, err := b.UpgradeInstance(id)
+	if err != nil {
+		writeAdminError(w, "UpgradeFailed", err)
+		return
+	}
+	if !upgraded {
+		writeAdminResponse(w, http.StatusOK, map[string]string{"status": "up-to-date"})
+		return
+	}
+	writeAdminResponse(w, http.StatusAccepted, map[string]string{"status": "upgrading"})
+}
+
+// continueUpdateRollbackRequest is the optional body of a request to continue rolling back an instance's stack
+type continueUpdateRollbackRequest struct {
+	ResourcesToSkip []string `json:"resources_to_skip"`
+}
+
+// adminContinueUpdateRollback handles POST /admin/instances/<id>/continue-rollback, continuing to roll back the
+// instance's stack after rolling back an update failed
+func (b *AwsBroker) adminContinueUpdateRollback(w http.ResponseWriter, r *http.Request, id string) {
+	var req continueUpdateRollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": "BadRequest", "description": err.Error()})
+		return
+	}
+	if err := b.ContinueUpdateRollback(id, req.ResourcesToSkip); err != nil {
+		writeAdminError(w, "ContinueRollbackFailed", err)
+		return
+	}
+	writeAdminResponse(w, http.StatusAccepted, map[string]string{"status": "rolling-back"})
+}
+
+// previewUpdateRequest is the body of a request to preview an update of an instance
+type previewUpdateRequest struct {
+	PlanID     *string                `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// adminPreviewUpdate handles POST /admin/instances/<id>/preview-update, returning the changes updating the instance
+// would make to the resources of its stack
+func (b *AwsBroker) adminPreviewUpdate(w http.ResponseWriter, r *http.Request, id string) {
+	var req previewUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": "BadRequest", "description": err.Error()})
+		return
+	}
+	preview, err := b.PreviewUpdate(id, req.PlanID, req.Parameters)
+	if err != nil {
+		writeAdminError(w, "PreviewFailed", err)
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, preview)
+}
+
+// upgradeCampaignRequest is the body of a request to start an upgrade campaign
+type upgradeCampaignRequest struct {
+	ServiceID  string `json:"service_id"`
+	PlanID     string `json:"plan_id"`
+	CanarySize int    `json:"canary_size"`
+	BatchSize  int    `json:"batch_size"`
+}
+
+// adminUpgradeCampaign handles GET /admin/upgrades, returning the latest upgrade campaign, and POST /admin/upgrades,
+// starting a new campaign
+func (b *AwsBroker) adminUpgradeCampaign(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		campaign, err := b.GetUpgradeCampaign()
+		if err != nil {
+			writeAdminError(w, "UpgradeCampaignFailed", err)
+		} else if campaign == nil {
+			writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": "NotFound"})
+		} else {
+			writeAdminResponse(w, http.StatusOK, campaign)
+		}
+	case http.MethodPost:
+		req := upgradeCampaignRequest{BatchSize: 1}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": "BadRequest", "description": err.Error()})
+			return
+		}
+		campaign, err := b.StartUpgradeCampaign(req.ServiceID, req.PlanID, req.CanarySize, req.BatchSize)
+		if err != nil {
+			writeAdminError(w, "UpgradeCampaignFailed", err)
+			return
+		}
+		writeAdminResponse(w, http.StatusAccepted, campaign)
+	default:
+		writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "MethodNotAllowed"})
+	}
+}
+
+// adminUpgradeCampaignAction handles POST requests that resume or cancel the current upgrade campaign
+func (b *AwsBroker) adminUpgradeCampaignAction(action func() (*UpgradeCampaign, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "MethodNotAllowed"})
+			return
+		}
+		campaign, err := action()
+		if err != nil {
+			writeAdminError(w, "UpgradeCampaignFailed", err)
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, campaign)
+	}
+}
+
+// writeAdminError writes an error response, using the status code of OSB errors
+func writeAdminError(w http.ResponseWriter, code string, err error) {
+	status := http.StatusInternalServerError
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); ok {
+		status = httpErr.StatusCode
+		err = errors.New(aws.StringValue(httpErr.Description))
+	}
+	writeAdminResponse(w, status, map[string]string{"error": code, "description": err.Error()})
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		glog.Errorln(err)
+	}
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminReloadCatalog(t *testing.T) {
+	b := &AwsBroker{refresh: make(chan CatalogRefreshRequest)}
+	handler := b.AdminHandler("secret")
+	var result error
+	go func() {
+		for req := range b.refresh {
+			assert.Equal(t, refreshTriggerAdmin, req.Trigger)
+			req.Done <- result
+		}
+	}()
+	defer close(b.refresh)
+
+	serve := func(method, url, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "/admin/catalog/reload", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "/admin/catalog/reload", "wrong").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("GET", "/admin/catalog/reload", "secret").Code)
+
+	w := serve("POST", "/admin/catalog/reload?template=sqs", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "reloaded"}`, w.Body.String())
+
+	result = errors.New("refresh failed")
+	w = serve("POST", "/admin/catalog/reload", "secret")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error": "ReloadFailed", "description": "refresh failed"}`, w.Body.String())
+
+	// the admin API is disabled without a token
+	w = httptest.NewRecorder()
+	(&AwsBroker{}).AdminHandler("").ServeHTTP(w, httptest.NewRequest("POST", "/admin/catalog/reload", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAdminUpgradeInstance(t *testing.T) {
+	b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+	b.db.DataStorePort = mockDataStoreProvision{}
+	handler := b.AdminHandler("secret")
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, serve("POST", "/admin/instances/exists-outdated").Code)
+	assert.Equal(t, http.StatusNotFound, serve("POST", "/admin/instances/a/b/upgrade").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("GET", "/admin/instances/exists-outdated/upgrade").Code)
+
+	w := serve("POST", "/admin/instances/exists-outdated/upgrade")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.JSONEq(t, `{"status": "upgrading"}`, w.Body.String())
+
+	w = serve("POST", "/admin/instances/exists-latest/upgrade")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "up-to-date"}`, w.Body.String())
+
+	w = serve("POST", "/admin/instances/foo/upgrade")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "UpgradeFailed", "description": "The service instance \"foo\" was not found."}`, w.Body.String())
+}
+
+func TestAdminPreviewUpdate(t *testing.T) {
+	b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+	b.db.DataStorePort = mockDataStoreProvision{}
+	handler := b.AdminHandler("secret")
+
+	serve := func(url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// the preview is the response body, not an error
+	w := serve("/admin/instances/exists-latest/preview-update", `{"parameters": {"req_param": "a-value"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"add": [], "modify": [], "replace": [], "remove": []}`, w.Body.String())
+
+	w = serve("/admin/instances/exists-latest/preview-update", "{")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve("/admin/instances/foo/preview-update", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "PreviewFailed", "description": "The service instance \"foo\" was not found."}`, w.Body.String())
+}
+
+func TestAdminUpgradeCampaign(t *testing.T) {
+	db := newMockDataStoreCampaign(serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1", Params: map[string]string{"req_param": "a-value"}})
+	b := newCampaignTestBroker(db, mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}})
+	handler := b.AdminHandler("secret")
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/admin/upgrades", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("PUT", "/admin/upgrades", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve("GET", "/admin/upgrades/resume", "").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("POST", "/admin/upgrades", "not json").Code)
+
+	w := serve("POST", "/admin/upgrades", `{"service_id": "foo"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "UpgradeCampaignFailed", "description": "The service \"foo\" was not found."}`, w.Body.String())
+
+	w = serve("POST", "/admin/upgrades", `{"service_id": "test-service-id", "canary_size": 1}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var campaign UpgradeCampaign
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &campaign))
+	assert.Len(t, campaign.Instances, 1)
+	assert.Equal(t, "i1", campaign.Instances[0].ID)
+	assert.Equal(t, campaignInstanceUpgrading, campaign.Instances[0].Status)
+	assert.NotEmpty(t, campaign.Instances[0].Operation)
+
+	w = serve("GET", "/admin/upgrades", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"running"`)
+
+	assert.Equal(t, http.StatusConflict, serve("POST", "/admin/upgrades/resume", "").Code)
+	w = serve("POST", "/admin/upgrades/cancel", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"cancelled"`)
+}
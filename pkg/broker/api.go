@@ -3,6 +3,7 @@ package broker
 import (
 	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -32,6 +33,8 @@ func (b *AwsBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespons
 			} else {
 				glog.Errorln(err)
 			}
+		} else if isDeprecated(sd.(osb.Service).Metadata) {
+			glog.Infof("Skipping retired ServiceClass %q", sd.(osb.Service).Name)
 		} else {
 			services = append(services, sd.(osb.Service))
 			glog.Infof("ServiceClass: %q %q", sd.(osb.Service).Name, sd.(osb.Service).ID)
@@ -40,7 +43,7 @@ func (b *AwsBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespons
 			}
 		}
 	}
-	osbResponse := &osb.CatalogResponse{Services: prescribeOverrides(*b, services)}
+	osbResponse := &osb.CatalogResponse{Services: prescribeOverrides(b, withoutInternalMetadata(services))}
 
 	//glog.Infof("catalog response: %#+v", osbResponse)
 
@@ -58,7 +61,7 @@ func (b *AwsBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespons
 func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestContext) (*broker.ProvisionResponse, error) {
 	glog.V(10).Infof("request=%+v", *request)
 
-	if !request.AcceptsIncomplete {
+	if !request.AcceptsIncomplete && !b.allowsSynchronous(request.ServiceID, request.PlanID) {
 		return nil, newAsyncError()
 	}
 
@@ -74,6 +77,9 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 	} else if service == nil {
 		desc := fmt.Sprintf("The service %s was not found.", request.ServiceID)
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	} else if isDeprecated(service.Metadata) {
+		desc := fmt.Sprintf("The service %s has been retired and can no longer be provisioned.", request.ServiceID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
 	// Get the plan
@@ -83,6 +89,9 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		desc := fmt.Sprintf("The service plan %s was not found.", request.PlanID)
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
+	if err := checkMaintenanceInfo(plan, getRequestExtensions(c).MaintenanceInfo); err != nil {
+		return nil, err
+	}
 
 	// Get the parameters and verify that all required parameters are set
 	params := getPlanDefaults(plan)
@@ -97,71 +106,105 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		params[k] = paramValue(v)
 	}
 	glog.V(10).Infof("params=%v", params)
-	for k, v := range request.Parameters {
+	var paramErrs []string
+	for _, k := range sortedKeys(request.Parameters) {
 		if !stringInSlice(k, availableParams) {
-			desc := fmt.Sprintf("The parameter %s is not available.", k)
-			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+			paramErrs = append(paramErrs, fmt.Sprintf("The parameter %s is not available.", k))
+			continue
 		}
-		params[k] = paramValue(v)
+		params[k] = paramValue(request.Parameters[k])
 	}
-	for _, p := range getRequiredParams(plan) {
-		if _, ok := params[p]; !ok {
-			desc := fmt.Sprintf("The parameter %s is required.", p)
-			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
-		}
+	paramErrs = append(paramErrs, validateParameters(plan.Schemas.ServiceInstance.Create.Parameters, request.Parameters)...)
+	paramErrs = append(paramErrs, checkRequiredParams(plan, params)...)
+	if len(paramErrs) > 0 {
+		return nil, newParametersError(paramErrs)
 	}
 	glog.V(10).Infof("params=%v", params)
 
 	instance := &serviceinstance.ServiceInstance{
-		ID:        request.InstanceID,
-		ServiceID: request.ServiceID,
-		Params:    params,
-		PlanID:    request.PlanID,
+		ID:              request.InstanceID,
+		ServiceID:       request.ServiceID,
+		Params:          params,
+		PlanID:          request.PlanID,
+		ProvisionParams: params,
+		ProvisionPlanID: request.PlanID,
+		Context:         request.Context,
+		RoleARN:         b.getStackRoleARN(plan, service.Name, namespace, cluster),
 	}
 
 	// Verify that the instance doesn't already exist
 	i, err := b.db.DataStorePort.GetServiceInstance(instance.ID)
+	if err == nil && i != nil && b.orphanMitigation && isOrphaned(i) {
+		// The instance failed to provision, it can be provisioned again once it has been cleaned up
+		i, err = b.cleanUpOrphan(i)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if err != nil {
 		desc := fmt.Sprintf("Failed to get the service instance %s: %v", instance.ID, err)
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 	} else if i != nil {
-		// TODO: This logic could use some love. The docs state that 200 OK MUST be
-		// returned if the service instance already exists, is fully provisioned,
-		// and the requested parameters are identical to the existing service
-		// instance. Right now, this doesn't check whether the instance is fully
-		// provisioned, and the reflect.DeepEqual check in Match will return false
-		// if the parameter order is different.
-		if i.Match(instance) {
-			glog.Infof("Service instance %s already exists.", instance.ID)
-			response := broker.ProvisionResponse{}
-			response.Exists = true
-			return &response, nil
+		if !provisionMatches(i, instance, request.Parameters) {
+			glog.V(10).Infof("i=%+v instance=%+v", *i, *instance)
+			desc := fmt.Sprintf("Service instance %s already exists but with different attributes.", instance.ID)
+			return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
 		}
-		glog.V(10).Infof("i=%+v instance=%+v", *i, *instance)
-		desc := fmt.Sprintf("Service instance %s already exists but with different attributes.", instance.ID)
-		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+		response, err := b.existingProvisionResponse(i)
+		if err != nil || !response.Async || request.AcceptsIncomplete {
+			return response, err
+		}
+
+		// Wait for the stack that's already being created
+		op, _ := findOperation(i, "")
+		if op == nil {
+			op = &serviceinstance.Operation{Type: serviceinstance.OperationProvision}
+		}
+		if err := b.waitForOperation(requestContext(c), i, op); err != nil {
+			return nil, err
+		}
+		return &broker.ProvisionResponse{Exists: true}, nil
 	}
 
-	tags, err := buildTags(b.brokerid, request.InstanceID, cluster, namespace, params)
+	tags, err := buildTags(b.brokerid, request.InstanceID, request.Context, b.tagTemplates, params)
 	if err != nil {
 		desc := fmt.Sprintf("failed to parse tags: %v", err)
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
-	urlP := b.generateS3HTTPUrl(service.Name)
+	urlP, bodyP, version, err := b.getTemplateLocation(service.Name)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the template for service %s: %v", service.Name, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	instance.TemplateVersion = version
 	stackName := getStackName(service.Name, instance.ID)
-	capabilities := []string{cloudformation.CapabilityCapabilityNamedIam}
+	capabilities := getCapabilities(service)
 	cfnParams := toCFNParams(params)
 
-	// Create the CFN stack
-	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
-	resp, err := cfnSvc.Client.CreateStack(&cloudformation.CreateStackInput{
+	input := &cloudformation.CreateStackInput{
 		Capabilities: aws.StringSlice(capabilities),
 		Parameters:   cfnParams,
+		RoleARN:      stackRoleARN(instance),
 		StackName:    aws.String(stackName),
 		Tags:         tags,
+		TemplateBody: bodyP,
 		TemplateURL:  urlP,
-	})
+	}
+	setCreateStackOptions(input, getStackOptions(plan))
+
+	// Create the CFN stack
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
+	var stackID string
+	if usesTransform(service) {
+		// CloudFormation only processes transforms in change sets
+		stackID, err = createStackWithChangeSet(cfnSvc, input)
+	} else {
+		var resp *cloudformation.CreateStackOutput
+		if resp, err = cfnSvc.Client.CreateStack(input); err == nil {
+			stackID = aws.StringValue(resp.StackId)
+		}
+	}
 	if err != nil {
 		var url string
 		if urlP != nil {
@@ -176,11 +219,12 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 	}
 
-	instance.StackID = aws.StringValue(resp.StackId)
+	instance.StackID = stackID
+	op := startOperation(instance, serviceinstance.OperationProvision, "", request.Parameters)
 	err = b.db.DataStorePort.PutServiceInstance(*instance)
 	if err != nil {
 		// Try to delete the stack
-		if _, err := cfnSvc.Client.DeleteStack(&cloudformation.DeleteStackInput{StackName: aws.String(instance.StackID)}); err != nil {
+		if err := deleteStackInput(cfnSvc, &cloudformation.DeleteStackInput{RoleARN: stackRoleARN(instance), StackName: aws.String(instance.StackID)}); err != nil {
 			glog.Errorf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
 		}
 
@@ -195,8 +239,53 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 			"plan":    plan.Name,
 		}).Inc()
 
+	if !request.AcceptsIncomplete {
+		if err := b.waitForOperation(requestContext(c), instance, op); err != nil {
+			return nil, err
+		}
+		return &broker.ProvisionResponse{}, nil
+	}
+
 	response := broker.ProvisionResponse{}
 	response.Async = true
+	response.OperationKey = toOperationKey(op)
+	return &response, nil
+}
+
+// existingProvisionResponse responds to a provision request that is identical to the one that created instance. The
+// response is 200 OK if the instance has been provisioned, or 202 Accepted with the provision operation if its stack
+// is still being created
+func (b *AwsBroker) existingProvisionResponse(instance *serviceinstance.ServiceInstance) (*broker.ProvisionResponse, error) {
+	response := broker.ProvisionResponse{}
+	op, _ := findOperation(instance, "")
+	if op != nil && op.Type == serviceinstance.OperationUpdate {
+		// the instance can only have been updated once it was provisioned
+		glog.Infof("Service instance %s already exists.", instance.ID)
+		response.Exists = true
+		return &response, nil
+	} else if op != nil && op.Type == serviceinstance.OperationDeprovision {
+		desc := fmt.Sprintf("Service instance %s already exists and is being deprovisioned.", instance.ID)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
+
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	status, err := getStackStatus(cfnSvc, instance.StackID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	switch operationState(serviceinstance.OperationProvision, status) {
+	case osb.StateSucceeded:
+		glog.Infof("Service instance %s already exists.", instance.ID)
+		response.Exists = true
+	case osb.StateInProgress:
+		glog.Infof("Service instance %s is already being provisioned.", instance.ID)
+		response.Async = true
+		response.OperationKey = toOperationKey(op)
+	default:
+		desc := fmt.Sprintf("Service instance %s already exists but failed to provision, its CloudFormation stack status is %s.", instance.ID, status)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
 	return &response, nil
 }
 
@@ -205,7 +294,7 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 func (b *AwsBroker) Deprovision(request *osb.DeprovisionRequest, c *broker.RequestContext) (*broker.DeprovisionResponse, error) {
 	glog.V(10).Infof("request=%+v", *request)
 
-	if !request.AcceptsIncomplete {
+	if !request.AcceptsIncomplete && !b.allowsSynchronous(request.ServiceID, request.PlanID) {
 		return nil, newAsyncError()
 	}
 
@@ -219,11 +308,34 @@ func (b *AwsBroker) Deprovision(request *osb.DeprovisionRequest, c *broker.Reque
 		return nil, newHTTPStatusCodeError(http.StatusGone, "", desc)
 	}
 
+	// Get the service and plan, which may have been removed from the catalog. The instance's retention policy depends
+	// on them, so it can't be deprovisioned if they can't be read
+	service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %s: %v", instance.ServiceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	var plan *osb.Plan
+	if service != nil {
+		plan = getPlan(service, instance.PlanID)
+	}
+
 	// Delete the CFN stack
 	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
-	if _, err := cfnSvc.Client.DeleteStack(&cloudformation.DeleteStackInput{StackName: aws.String(instance.StackID)}); err != nil {
-		desc := fmt.Sprintf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
-		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	stackStatus, err := getStackStatus(cfnSvc, instance.StackID)
+	if err != nil {
+		glog.Errorf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+	}
+	op, err := b.deleteInstanceStack(cfnSvc, instance, service, plan, stackStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the operation, the stack is being deleted regardless so only log failures
+	operationKey := toOperationKey(op)
+	if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+		glog.Errorf("Failed to record the deprovision operation for service instance %s: %v", instance.ID, err)
+		operationKey = nil
 	}
 
 	labels := prom.Labels{
@@ -232,23 +344,27 @@ func (b *AwsBroker) Deprovision(request *osb.DeprovisionRequest, c *broker.Reque
 		"plan":    "", // Prometheus will omit blank labels.
 	}
 
-	// Try to get the service name
-	service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID)
-
-	if err == nil && service != nil {
-		// We basically don't care if we can't find it
+	if service != nil {
 		labels["service"] = service.Name
+	}
+	if plan != nil {
+		labels["plan"] = plan.Name
+	}
+	b.metrics.Actions.With(labels).Inc()
 
-		// Try to get the plan name
-		plan := getPlan(service, instance.PlanID)
-		if plan != nil {
-			labels["plan"] = plan.Name
+	if !request.AcceptsIncomplete {
+		if err := b.waitForOperation(requestContext(c), instance, op); err != nil {
+			return nil, err
+		}
+		if err := b.db.DataStorePort.DeleteServiceInstance(instance.ID); err != nil {
+			glog.Errorf("Failed to delete the service instance %s: %v", instance.ID, err)
 		}
+		return &broker.DeprovisionResponse{}, nil
 	}
-	b.metrics.Actions.With(labels).Inc()
 
 	response := broker.DeprovisionResponse{}
 	response.Async = true
+	response.OperationKey = operationKey
 	return &response, nil
 }
 
@@ -270,39 +386,80 @@ func (b *AwsBroker) LastOperation(request *osb.LastOperationRequest, c *broker.R
 		return nil, newHTTPStatusCodeError(http.StatusGone, "", desc)
 	}
 
-	// Get the CFN stack status
-	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
-	resp, err := cfnSvc.Client.DescribeStacks(&cloudformation.DescribeStacksInput{
-		StackName: aws.String(instance.StackID),
-	})
-	if err != nil {
-		desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
-		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	// Find the operation the platform is asking about, instances created before operations were recorded have none
+	key := getOperationKey(request, c)
+	op, next := findOperation(instance, key)
+	if key != "" && op == nil {
+		return nil, newOperationNotFoundError(instance.ID, key)
 	}
-	status := aws.StringValue(resp.Stacks[0].StackStatus)
-	reason := aws.StringValue(resp.Stacks[0].StackStatusReason)
-	glog.V(10).Infof("stack=%s status=%s reason=%s", instance.StackID, status, reason)
 
 	response := broker.LastOperationResponse{}
-	if status == cloudformation.StackStatusCreateComplete ||
-		status == cloudformation.StackStatusDeleteComplete ||
-		status == cloudformation.StackStatusUpdateComplete {
-		response.State = osb.StateSucceeded
+	if op != nil && op.State != "" {
+		response.State = osb.LastOperationState(op.State)
+		if op.Description != "" {
+			response.Description = aws.String(op.Description)
+		}
+	} else if next != nil {
+		// A later operation has started, so this one had finished by then
+		response.State = operationState(op.Type, next.StackStatus)
+		if response.State == osb.StateFailed {
+			desc := fmt.Sprintf("The CloudFormation stack %s finished with status %s.", instance.StackID, next.StackStatus)
+			response.Description = &desc
+		}
+	} else {
+		var opType string
+		if op != nil {
+			opType = op.Type
+		}
+
+		// Get the CFN stack status
+		cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+		resp, err := cfnSvc.Client.DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(instance.StackID),
+		})
+		if err != nil {
+			desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		status := aws.StringValue(resp.Stacks[0].StackStatus)
+		reason := aws.StringValue(resp.Stacks[0].StackStatusReason)
+		glog.V(10).Infof("stack=%s status=%s reason=%s", instance.StackID, status, reason)
+
+		response.State = operationState(opType, status)
+		if desc := b.continueDeprovision(cfnSvc, instance, op, status); desc != "" {
+			response.State = osb.StateInProgress
+			response.Description = aws.String(desc)
+		}
+		if status == cloudformation.StackStatusUpdateRollbackFailed && op != nil && op.Type == serviceinstance.OperationUpdate && !op.RollbackContinued {
+			// The stack can't be changed until the rollback is continued, which is tried once
+			if err := b.continueUpdateRollback(cfnSvc, instance, op, nil); err != nil {
+				glog.Errorf("Failed to continue rolling back the CloudFormation stack %s: %v", instance.StackID, err)
+			} else {
+				response.State = osb.StateInProgress
+				response.Description = aws.String("Rolling back the update failed, the rollback is being continued.")
+			}
+		}
 		if status == cloudformation.StackStatusDeleteComplete {
 			// If the resources were successfully deleted, try to delete the instance
 			if err := b.db.DataStorePort.DeleteServiceInstance(instance.ID); err != nil {
 				glog.Errorf("Failed to delete the service instance %s: %v", instance.ID, err)
 			}
 		}
-	} else if strings.HasSuffix(status, "_IN_PROGRESS") && !strings.Contains(status, "ROLLBACK") {
-		response.State = osb.StateInProgress
-	} else {
-		glog.Errorf("CloudFormation stack %s failed with status %s: %s", instance.StackID, status, reason)
-		response.State = osb.StateFailed
-		response.Description = getCfnError(instance.StackID, cfnSvc)
-		if *response.Description == "" {
-			response.Description = &reason
+		if response.State == osb.StateFailed {
+			glog.Errorf("CloudFormation stack %s failed with status %s: %s", instance.StackID, status, reason)
+			response.Description = getCfnError(instance.StackID, cfnSvc)
+			if *response.Description == "" {
+				response.Description = &reason
+			}
+			if b.orphanMitigation && op != nil && op.Type == serviceinstance.OperationProvision {
+				b.recordOrphan(instance, op, *response.Description)
+			}
+			if status == cloudformation.StackStatusUpdateRollbackComplete && op != nil && op.Type == serviceinstance.OperationUpdate {
+				b.restorePreviousValues(instance, op, *response.Description)
+			}
 		}
+	}
+	if response.State == osb.StateFailed && response.Description != nil {
 		// workaround for https://github.com/kubernetes-incubator/service-catalog/issues/2505
 		originatingIdentity := strings.Split(c.Request.Header.Get("X-Broker-Api-Originating-Identity"), " ")[0]
 		if originatingIdentity == "kubernetes" {
@@ -367,6 +524,20 @@ func (b *AwsBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*b
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
+	// Verify the binding params against the plan's binding schema, templates that declare their scopes have one
+	if schema := getBindingSchema(getPlan(service, request.PlanID)); schema != nil {
+		params := make(map[string]interface{})
+		if binding.RoleName != "" {
+			params[bindParamRoleName] = binding.RoleName
+		}
+		if binding.Scope != "" {
+			params[bindParamScope] = binding.Scope
+		}
+		if errs := validateParameters(schema, params); len(errs) > 0 {
+			return nil, newParametersError(errs)
+		}
+	}
+
 	// Get the instance
 	instance, err := b.db.DataStorePort.GetServiceInstance(binding.InstanceID)
 	if err != nil {
@@ -559,10 +730,6 @@ func (b *AwsBroker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext)
 func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*broker.UpdateInstanceResponse, error) {
 	glog.V(10).Infof("request=%+v", *request)
 
-	if !request.AcceptsIncomplete {
-		return nil, newAsyncError()
-	}
-
 	// Get the service instance
 	instance, err := b.db.DataStorePort.GetServiceInstance(request.InstanceID)
 	if err != nil {
@@ -572,14 +739,75 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 		desc := fmt.Sprintf("The service instance %q was not found.", request.InstanceID)
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
+	b.reconcileUpdate(instance)
 
-	// Verify that we're not changing the plan (this should never happen since
-	// we're setting `plan_updateable: false`, but better safe than sorry)
-	if request.PlanID != nil && *request.PlanID != instance.PlanID {
-		desc := fmt.Sprintf("The service plan cannot be changed from %q to %q.", instance.PlanID, *request.PlanID)
-		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	// A dry run doesn't start an operation, so it doesn't need to be asynchronous
+	dryRun := isDryRun(request.Parameters)
+	if !dryRun && !request.AcceptsIncomplete && !b.allowsSynchronous(request.ServiceID, instance.PlanID) {
+		return nil, newAsyncError()
+	}
+
+	update, err := b.getInstanceUpdate(instance, request, c)
+	if err != nil {
+		return nil, err
+	}
+	if update != nil {
+		instance.Context = update.context
+	}
+	if dryRun {
+		preview := getUpdatePreview(nil, nil)
+		if update != nil {
+			if preview, err = b.previewInstanceUpdate(instance, update); err != nil {
+				return nil, err
+			}
+		}
+		return nil, newDryRunError(preview)
 	}
+	if update == nil {
+		// Nothing to do, so return success (if we try a CFN update, it'll fail)
+		return &broker.UpdateInstanceResponse{}, nil
+	}
+	service, plan := update.service, update.plan
+
+	op, err := b.updateInstanceStack(instance, service, plan, update.params, update.requested, update.upgrade)
+	if err != nil {
+		return nil, err
+	}
+
+	b.metrics.Actions.With(
+		prom.Labels{
+			"action":  "update",
+			"service": service.Name,
+			"plan":    plan.Name,
+		}).Inc()
+
+	if !request.AcceptsIncomplete {
+		latest, _ := findOperation(instance, "")
+		if err := b.waitForOperation(requestContext(c), instance, latest); err != nil {
+			return nil, err
+		}
+		return &broker.UpdateInstanceResponse{}, nil
+	}
+
+	response := broker.UpdateInstanceResponse{}
+	response.Async = true
+	response.OperationKey = op
+	return &response, nil
+}
 
+// instanceUpdate describes how an update request changes a service instance
+type instanceUpdate struct {
+	service   *osb.Service
+	plan      *osb.Plan
+	params    map[string]string
+	context   map[string]interface{}
+	requested map[string]interface{}
+	upgrade   bool
+}
+
+// getInstanceUpdate validates an update request and returns the changes it makes to the instance, or nil if it
+// doesn't change the instance
+func (b *AwsBroker) getInstanceUpdate(instance *serviceinstance.ServiceInstance, request *osb.UpdateInstanceRequest, c *broker.RequestContext) (*instanceUpdate, error) {
 	// Get the service
 	service, err := b.db.DataStorePort.GetServiceDefinition(request.ServiceID)
 	if err != nil {
@@ -597,67 +825,82 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
-	// Get the parameters
-	params := getPlanDefaults(plan)
-	paramsUpdated := false
-	updatableParams := getUpdatableParams(plan)
+	// Get the parameters. The stack keeps the template it was provisioned with, so the defaults of parameters added to
+	// newer templates don't apply
+	params := make(map[string]string)
 	for k, v := range instance.Params {
 		params[k] = v
 	}
-	for k, v := range request.Parameters {
-		newValue := paramValue(v)
+	paramsUpdated := false
+	upgrade := false
+
+	// Verify that the plan can be changed to the new plan, and recompute the parameters the new plan prescribes. The
+	// plans in the catalog describe the latest template, so changing plan also upgrades the stack to it
+	if request.PlanID != nil && *request.PlanID != instance.PlanID {
+		newPlan := getPlan(service, *request.PlanID)
+		if newPlan == nil || !stringInSlice(newPlan.Name, getUpdatablePlans(plan)) {
+			desc := fmt.Sprintf("The service plan cannot be changed from %q to %q.", instance.PlanID, *request.PlanID)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+		params = changePlanParams(plan, newPlan, instance.Params)
+		plan = newPlan
+		paramsUpdated = true
+		upgrade = true
+	}
+
+	// Upgrade the stack to the latest template when the platform requests the plan's current maintenance_info
+	if info := getRequestExtensions(c).MaintenanceInfo; info != nil {
+		if err := checkMaintenanceInfo(plan, info); err != nil {
+			return nil, err
+		}
+		if !upgrade && instance.TemplateVersion != getTemplateVersion(service) {
+			params = changePlanParams(plan, plan, instance.Params)
+			paramsUpdated = true
+			upgrade = true
+		}
+	}
+
+	updatableParams := getUpdatableParams(plan)
+	var paramErrs []string
+	updated := make(map[string]interface{})
+	for _, k := range sortedKeys(request.Parameters) {
+		if k == dryRunParameter {
+			continue
+		}
+		newValue := paramValue(request.Parameters[k])
 		if params[k] != newValue {
 			if !stringInSlice(k, updatableParams) {
-				desc := fmt.Sprintf("The parameter %q is not updatable.", k)
-				return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+				paramErrs = append(paramErrs, fmt.Sprintf("The parameter %q is not updatable.", k))
+				continue
 			}
 			params[k] = newValue
+			updated[k] = request.Parameters[k]
 			paramsUpdated = true
 		}
 	}
-	if !paramsUpdated {
-		// Nothing to do, so return success (if we try a CFN update, it'll fail)
-		return &broker.UpdateInstanceResponse{}, nil
+	if plan.Schemas.ServiceInstance.Update != nil {
+		paramErrs = append(paramErrs, validateParameters(plan.Schemas.ServiceInstance.Update.Parameters, updated)...)
 	}
-	glog.V(10).Infof("params=%v", params)
-
-	// Update the CFN stack
-	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
-	_, err = cfnSvc.Client.UpdateStack(&cloudformation.UpdateStackInput{
-		Capabilities: aws.StringSlice([]string{cloudformation.CapabilityCapabilityNamedIam}),
-		Parameters:   toCFNParams(params),
-		StackName:    aws.String(instance.StackID),
-		TemplateURL:  b.generateS3HTTPUrl(service.Name),
-	})
-	if err != nil {
-		desc := fmt.Sprintf("Failed to update the CloudFormation stack %q: %v", instance.StackID, err)
-		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	if upgrade {
+		paramErrs = append(paramErrs, checkRequiredParams(plan, params)...)
 	}
-
-	// Update the params in the DB
-	instance.Params = params
-	err = b.db.DataStorePort.PutServiceInstance(*instance)
-	if err != nil {
-		// Try to cancel the update
-		if _, err := cfnSvc.Client.CancelUpdateStack(&cloudformation.CancelUpdateStackInput{StackName: aws.String(instance.StackID)}); err != nil {
-			glog.Errorf("Failed to cancel updating the CloudFormation stack %q: %v", instance.StackID, err)
-			glog.Errorf("Service instance %q and CloudFormation stack %q may be out of sync!", instance.ID, instance.StackID)
-		}
-
-		desc := fmt.Sprintf("Failed to update the service instance %q: %v", instance.ID, err)
-		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	if len(paramErrs) > 0 {
+		return nil, newParametersError(paramErrs)
 	}
 
-	b.metrics.Actions.With(
-		prom.Labels{
-			"action":  "update",
-			"service": service.Name,
-			"plan":    plan.Name,
-		}).Inc()
+	// Updates that only change the context, e.g. after a namespace or space is renamed, re-tag the stack
+	context := instance.Context
+	contextUpdated := false
+	if request.Context != nil && !reflect.DeepEqual(request.Context, instance.Context) {
+		context = request.Context
+		contextUpdated = true
+	}
+	if !paramsUpdated && !contextUpdated {
+		return nil, nil
+	}
+	glog.V(10).Infof("params=%v", params)
 
-	response := broker.UpdateInstanceResponse{}
-	response.Async = true
-	return &response, nil
+	return &instanceUpdate{service: service, plan: plan, params: params, context: context, requested: updated, upgrade: upgrade}, nil
 }
 
 // BindingLastOperation is not implemented, as async binding is not supported.
@@ -1,9 +1,13 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -94,6 +98,12 @@ func (db mockDataStoreProvision) GetParam(paramname string) (value string, err e
 	return "some-value", nil
 }
 func (db mockDataStoreProvision) PutParam(paramname string, paramvalue string) error { return nil }
+func (db mockDataStoreProvision) ListParams(prefix string) (map[string]string, error) {
+	return nil, nil
+}
+func (db mockDataStoreProvision) SwapParam(paramname string, old string, new string) (bool, error) {
+	return true, nil
+}
 func (db mockDataStoreProvision) PutServiceInstance(si serviceinstance.ServiceInstance) error {
 	for _, v := range si.Params {
 		if v == "err" {
@@ -115,13 +125,14 @@ func (db mockDataStoreProvision) GetServiceDefinition(serviceuuid string) (*osb.
 	}
 	if serviceuuid == "test-service-id" {
 		return &osb.Service{
-			ID:   "test-service-id",
-			Name: "test-service-name",
+			ID:       "test-service-id",
+			Name:     "test-service-name",
+			Metadata: map[string]interface{}{"templateVersion": testTemplateVersion},
 			Plans: []osb.Plan{
-				{ID: "test-plan-id", Name: "test-plan-name", Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
+				{ID: "test-plan-id", Name: "test-plan-name", Metadata: map[string]interface{}{"updatablePlans": []interface{}{"production-plan-name"}, "maintenanceInfo": map[string]interface{}{"version": "1.0.0+v2"}}, Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
 					Create: &osb.InputParametersSchema{
 						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
-							"req_param":      map[string]interface{}{"type": "string"},
+							"req_param":      map[string]interface{}{"type": "string", "pattern": "^(?:[a-z-]+)$", "maxLength": float64(10)},
 							"override_param": map[string]interface{}{"type": "string"},
 							"region":         map[string]interface{}{"type": "string"},
 						},
@@ -133,15 +144,39 @@ func (db mockDataStoreProvision) GetServiceDefinition(serviceuuid string) (*osb.
 						Parameters: map[string]interface{}{
 							"type": "object",
 							"properties": map[string]interface{}{
-								"req_param": map[string]interface{}{"type": "string"},
+								"req_param": map[string]interface{}{"type": "string", "pattern": "^(?:[a-z-]+)$", "constraint_description": "must be lowercase"},
 							},
 							"$schema":  "http://json-schema.org/draft-06/schema#",
 							"required": []string{"req_param"},
 						},
 					},
+				}, ServiceBinding: &osb.ServiceBindingSchema{
+					Create: &osb.RequestResponseSchema{InputParametersSchema: osb.InputParametersSchema{
+						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+							"RoleName": map[string]interface{}{"type": "string"},
+							"Scope":    map[string]interface{}{"type": "string", "enum": []interface{}{"ReadOnly", "ReadWrite"}},
+						}},
+					}},
+				}}},
+				{ID: "production-plan-id", Name: "production-plan-name", Metadata: map[string]interface{}{"synchronous": true}, Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
+					Create: &osb.InputParametersSchema{
+						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+							"req_param": map[string]interface{}{"type": "string"},
+						},
+							"required":   []interface{}{"req_param"},
+							"prescribed": map[string]interface{}{"size": "large"},
+						},
+					},
 				}}},
 			},
 		}, nil
+	} else if serviceuuid == "retired-service-id" {
+		return &osb.Service{
+			ID:       "retired-service-id",
+			Name:     "retired-service-name",
+			Metadata: map[string]interface{}{"deprecated": true, "retiredAt": "2018-08-14T22:47:53Z"},
+			Plans:    []osb.Plan{{ID: "test-plan-id", Name: "test-plan-name"}},
+		}, nil
 	} else if serviceuuid == "err" {
 		return nil, errors.New("test failure")
 	} else if serviceuuid == "noplan" {
@@ -157,12 +192,34 @@ func (db mockDataStoreProvision) GetServiceInstance(sid string) (*serviceinstanc
 		return &serviceinstance.ServiceInstance{ID: "err-stack", StackID: "err", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
 	case "exists":
 		return &serviceinstance.ServiceInstance{ID: "exists", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
+	case "exists-latest":
+		return &serviceinstance.ServiceInstance{ID: "exists-latest", ServiceID: "test-service-id", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}, TemplateVersion: testTemplateVersion}, nil
+	case "exists-outdated":
+		return &serviceinstance.ServiceInstance{ID: "exists-outdated", ServiceID: "test-service-id", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}, TemplateVersion: "v1"}, nil
+	case "no-updates":
+		return &serviceinstance.ServiceInstance{ID: "no-updates", ServiceID: "test-service-id", StackID: "no-updates", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}, TemplateVersion: "v1"}, nil
+	case "exists-provisioning":
+		return &serviceinstance.ServiceInstance{ID: "exists-provisioning", ServiceID: "test-service-id", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "pval", "region": "us-east-1", "override_param": "old_value"}, Operations: []serviceinstance.Operation{
+			{ID: "op-provision", Type: serviceinstance.OperationProvision, Params: map[string]string{"req_param": "pval", "region": "us-east-1"}},
+		}}, nil
+	case "with-operations":
+		return &serviceinstance.ServiceInstance{ID: "with-operations", StackID: "an-id", PlanID: "test-plan-id", Operations: []serviceinstance.Operation{
+			{ID: "op-provision", Type: serviceinstance.OperationProvision},
+			{ID: "op-update", Type: serviceinstance.OperationUpdate, StackStatus: cloudformation.StackStatusCreateComplete},
+			{ID: "op-no-changes", Type: serviceinstance.OperationUpdate, StackStatus: cloudformation.StackStatusUpdateRollbackComplete, State: string(osb.StateSucceeded)},
+			{ID: "op-latest", Type: serviceinstance.OperationUpdate, StackStatus: cloudformation.StackStatusUpdateRollbackComplete},
+		}}, nil
+	case "exists-production":
+		return &serviceinstance.ServiceInstance{ID: "exists-production", StackID: "an-id", PlanID: "production-plan-id", Params: map[string]string{"req_param": "a-value", "size": "large"}}, nil
 	case "foo-plan":
 		return &serviceinstance.ServiceInstance{ID: "foo-plan", StackID: "an-id", PlanID: "foo"}, nil
 	default:
 		return nil, nil
 	}
 }
+func (db mockDataStoreProvision) ListServiceInstances(serviceid string) ([]serviceinstance.ServiceInstance, error) {
+	return nil, nil
+}
 func (db mockDataStoreProvision) DeleteServiceInstance(id string) error { return nil }
 func (db mockDataStoreProvision) GetServiceBinding(id string) (*serviceinstance.ServiceBinding, error) {
 	switch id {
@@ -245,10 +302,18 @@ func TestProvision(t *testing.T) {
 	}
 	reqContext := &broker.RequestContext{}
 
-	expectedErr := newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter anotherParam is not available.")
+	expectedErr := newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter anotherParam is not available. The parameter req_param is required.")
 	_, err := bl.Provision(provReq, reqContext)
 	assertor.Equal(expectedErr, err, "should fail with missing parameter error")
 
+	provReq.Parameters = map[string]interface{}{
+		"region":    "us-east-1",
+		"req_param": "Invalid-Value",
+	}
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter req_param must be at most 10 characters long. The parameter req_param must match the pattern ^(?:[a-z-]+)$.")
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with schema validation errors")
+
 	provReq.Parameters = map[string]interface{}{
 		"region": "us-east-1",
 	}
@@ -260,10 +325,10 @@ func TestProvision(t *testing.T) {
 		"region":    "us-east-1",
 		"req_param": "pval",
 	}
-	expected := &broker.ProvisionResponse{ProvisionResponse: osb.ProvisionResponse{Async: true}}
 	actual, err := bl.Provision(provReq, reqContext)
 	assertor.Equal(nil, err, "err should be nil")
-	assertor.Equal(expected, actual, "should return empty provision response")
+	assertor.True(actual.Async, "should return an async provision response")
+	assertor.NotNil(actual.OperationKey, "should return the operation")
 
 	expectedErr = osb.HTTPStatusCodeError{
 		StatusCode:   422,
@@ -273,6 +338,11 @@ func TestProvision(t *testing.T) {
 	_, err = bl.Provision(&osb.ProvisionRequest{AcceptsIncomplete: false}, &broker.RequestContext{})
 	assertor.Equal(expectedErr, err, "err should be 422")
 
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The service retired-service-id has been retired and can no longer be provisioned.")
+	provReq.ServiceID = "retired-service-id"
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with retired service error")
+
 	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan test-plan-id was not found.")
 	provReq.ServiceID = "noplan"
 	_, err = bl.Provision(provReq, reqContext)
@@ -302,6 +372,136 @@ func TestProvision(t *testing.T) {
 
 }
 
+func TestProvisionExisting(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         map[string]interface{}
+		stackStatus    string
+		expectedExists bool
+		expectedAsync  bool
+		expectedErr    error
+	}{
+		{
+			name:           "provisioned",
+			params:         map[string]interface{}{"region": "us-east-1", "req_param": "pval"},
+			stackStatus:    cloudformation.StackStatusCreateComplete,
+			expectedExists: true,
+		},
+		{
+			name:          "provisioning",
+			params:        map[string]interface{}{"region": "us-east-1", "req_param": "pval"},
+			stackStatus:   cloudformation.StackStatusCreateInProgress,
+			expectedAsync: true,
+		},
+		{
+			name:        "failed",
+			params:      map[string]interface{}{"region": "us-east-1", "req_param": "pval"},
+			stackStatus: cloudformation.StackStatusRollbackComplete,
+			expectedErr: newHTTPStatusCodeError(http.StatusConflict, "", "Service instance exists-provisioning already exists but failed to provision, its CloudFormation stack status is ROLLBACK_COMPLETE."),
+		},
+		{
+			name:        "different_parameter",
+			params:      map[string]interface{}{"region": "us-east-1", "req_param": "other"},
+			stackStatus: cloudformation.StackStatusCreateComplete,
+			expectedErr: newHTTPStatusCodeError(http.StatusConflict, "", "Service instance exists-provisioning already exists but with different attributes."),
+		},
+		{
+			name:        "parameter_no_longer_requested",
+			params:      map[string]interface{}{"req_param": "pval"},
+			stackStatus: cloudformation.StackStatusCreateComplete,
+			expectedErr: newHTTPStatusCodeError(http.StatusConflict, "", "Service instance exists-provisioning already exists but with different attributes."),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+			b.db.DataStorePort = mockDataStoreProvision{}
+			// overrides that changed since the instance was provisioned are ignored
+			b.globalOverrides = map[string]string{"override_param": "some_value"}
+			b.Clients.NewCfn = func(sess *session.Session) CfnClient {
+				return CfnClient{mockCfn{DescribeStacksResponse: cloudformation.DescribeStacksOutput{
+					Stacks: []*cloudformation.Stack{{StackStatus: aws.String(tt.stackStatus)}},
+				}}}
+			}
+
+			resp, err := b.Provision(&osb.ProvisionRequest{
+				InstanceID:        "exists-provisioning",
+				ServiceID:         "test-service-id",
+				PlanID:            "test-plan-id",
+				AcceptsIncomplete: true,
+				Parameters:        tt.params,
+			}, &broker.RequestContext{})
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedExists, resp.Exists)
+				assert.Equal(t, tt.expectedAsync, resp.Async)
+				if tt.expectedAsync {
+					assert.Equal(t, operationKey("op-provision"), resp.OperationKey)
+				}
+			}
+		})
+	}
+}
+
+func TestProvisionAfterUpdate(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign()
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}}
+	b := newCampaignTestBroker(db, cfn)
+	provision := func(params map[string]interface{}) (*broker.ProvisionResponse, error) {
+		return b.Provision(&osb.ProvisionRequest{
+			InstanceID:        "i1",
+			ServiceID:         "test-service-id",
+			PlanID:            "test-plan-id",
+			AcceptsIncomplete: true,
+			Parameters:        params,
+		}, &broker.RequestContext{})
+	}
+
+	_, err := provision(map[string]interface{}{"req_param": "pval"})
+	assert.NoError(err)
+	cfn.set(db.instances["i1"].StackID, cloudformation.StackStatusCreateComplete)
+	_, err = b.Update(&osb.UpdateInstanceRequest{
+		InstanceID:        "i1",
+		ServiceID:         "test-service-id",
+		AcceptsIncomplete: true,
+		Parameters:        map[string]interface{}{"req_param": "other"},
+	}, &broker.RequestContext{})
+	assert.NoError(err)
+	assert.Equal("other", db.instances["i1"].Params["req_param"])
+	cfn.set(db.instances["i1"].StackID, cloudformation.StackStatusUpdateComplete)
+
+	// a repeated provision request still matches the request the instance was provisioned with
+	resp, err := provision(map[string]interface{}{"req_param": "pval"})
+	assert.NoError(err)
+	assert.True(resp.Exists)
+	_, err = provision(map[string]interface{}{"req_param": "other"})
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusConflict, "", "Service instance i1 already exists but with different attributes.").Error())
+
+	// parameters only one of the requests set are compared with the plan's defaults applied
+	_, err = provision(map[string]interface{}{"req_param": "pval", "region": "us-west-2"})
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusConflict, "", "Service instance i1 already exists but with different attributes.").Error())
+	assert.NoError(db.DeleteServiceInstance("i1"))
+	_, err = provision(map[string]interface{}{"req_param": "pval", "region": "us-west-2"})
+	assert.NoError(err)
+	cfn.set(db.instances["i1"].StackID, cloudformation.StackStatusCreateComplete)
+	_, err = b.Update(&osb.UpdateInstanceRequest{
+		InstanceID:        "i1",
+		ServiceID:         "test-service-id",
+		AcceptsIncomplete: true,
+		Parameters:        map[string]interface{}{"req_param": "other"},
+	}, &broker.RequestContext{})
+	assert.NoError(err)
+	cfn.set(db.instances["i1"].StackID, cloudformation.StackStatusUpdateComplete)
+	resp, err = provision(map[string]interface{}{"req_param": "pval", "region": "us-west-2"})
+	assert.NoError(err)
+	assert.True(resp.Exists)
+	_, err = provision(map[string]interface{}{"req_param": "pval"})
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusConflict, "", "Service instance i1 already exists but with different attributes.").Error())
+}
+
 func TestDeprovision(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -365,6 +565,7 @@ func TestDeprovision(t *testing.T) {
 			} else {
 				assert.NoError(t, err)
 				assert.True(t, resp.Async)
+				assert.NotNil(t, resp.OperationKey)
 			}
 		})
 	}
@@ -376,6 +577,7 @@ func TestLastOperation(t *testing.T) {
 		request           *osb.LastOperationRequest
 		stackStatus       string
 		stackStatusReason string
+		query             string
 		expectedState     osb.LastOperationState
 		expectedDesc      *string
 		expectedErr       error
@@ -445,6 +647,59 @@ func TestLastOperation(t *testing.T) {
 			expectedState:     osb.StateFailed,
 			expectedDesc:      aws.String("foo"),
 		},
+		{
+			name: "unknown_operation",
+			request: &osb.LastOperationRequest{
+				InstanceID:   "with-operations",
+				OperationKey: operationKey("foo"),
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The operation foo was not found for the service instance with-operations."),
+		},
+		{
+			name: "earlier_provision_succeeded",
+			request: &osb.LastOperationRequest{
+				InstanceID:   "with-operations",
+				OperationKey: operationKey("op-provision"),
+			},
+			stackStatus:   cloudformation.StackStatusUpdateInProgress,
+			expectedState: osb.StateSucceeded,
+		},
+		{
+			name: "earlier_update_failed",
+			request: &osb.LastOperationRequest{
+				InstanceID: "with-operations",
+			},
+			query:         "operation=op-update",
+			stackStatus:   cloudformation.StackStatusUpdateInProgress,
+			expectedState: osb.StateFailed,
+			expectedDesc:  aws.String("The CloudFormation stack an-id finished with status UPDATE_ROLLBACK_COMPLETE."),
+		},
+		{
+			name: "update_without_changes",
+			request: &osb.LastOperationRequest{
+				InstanceID:   "with-operations",
+				OperationKey: operationKey("op-no-changes"),
+			},
+			stackStatus:   cloudformation.StackStatusUpdateInProgress,
+			expectedState: osb.StateSucceeded,
+		},
+		{
+			name: "latest_update_in_progress",
+			request: &osb.LastOperationRequest{
+				InstanceID: "with-operations",
+			},
+			stackStatus:   cloudformation.StackStatusUpdateCompleteCleanupInProgress,
+			expectedState: osb.StateInProgress,
+		},
+		{
+			name: "latest_update_complete",
+			request: &osb.LastOperationRequest{
+				InstanceID:   "with-operations",
+				OperationKey: operationKey("op-latest"),
+			},
+			stackStatus:   cloudformation.StackStatusUpdateComplete,
+			expectedState: osb.StateSucceeded,
+		},
 	}
 
 	for _, tt := range tests {
@@ -482,7 +737,7 @@ func TestLastOperation(t *testing.T) {
 			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
 			b.db.DataStorePort = mockDataStoreProvision{}
 
-			resp, err := b.LastOperation(tt.request, &broker.RequestContext{Request: &http.Request{Header: http.Header{}}})
+			resp, err := b.LastOperation(tt.request, &broker.RequestContext{Request: &http.Request{Header: http.Header{}, URL: &url.URL{RawQuery: tt.query}}})
 			if tt.expectedErr != nil {
 				assert.EqualError(t, err, tt.expectedErr.Error())
 			} else {
@@ -494,6 +749,11 @@ func TestLastOperation(t *testing.T) {
 	}
 }
 
+func operationKey(key string) *osb.OperationKey {
+	k := osb.OperationKey(key)
+	return &k
+}
+
 func toDescribeStacksOutput(outputs map[string]string) cloudformation.DescribeStacksOutput {
 	var cfnOutputs []*cloudformation.Output
 	for k, v := range outputs {
@@ -679,6 +939,20 @@ func TestBind(t *testing.T) {
 			},
 			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The CloudFormation stack an-id does not support binding with scope 'ReadOnly': output not found: PolicyArnReadOnly"),
 		},
+		{
+			name: "invalid_scope",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				PlanID:     "test-plan-id",
+				Parameters: map[string]interface{}{
+					"RoleName": "foo",
+					"Scope":    "Admin",
+				},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter Scope must be one of: ReadOnly, ReadWrite."),
+		},
 		{
 			name: "error_attaching_role_policy",
 			request: &osb.BindRequest{
@@ -926,10 +1200,11 @@ func TestUnbind(t *testing.T) {
 
 func TestUpdate(t *testing.T) {
 	tests := []struct {
-		name          string
-		request       *osb.UpdateInstanceRequest
-		expectedAsync bool
-		expectedErr   error
+		name            string
+		request         *osb.UpdateInstanceRequest
+		maintenanceInfo *MaintenanceInfo
+		expectedAsync   bool
+		expectedErr     error
 	}{
 		{
 			name: "async_required",
@@ -968,6 +1243,56 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan cannot be changed from \"test-plan-id\" to \"new-plan-id\"."),
 		},
+		{
+			name: "change_plan_not_updatable",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists-production",
+				ServiceID:         "test-service-id",
+				PlanID:            aws.String("test-plan-id"),
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan cannot be changed from \"production-plan-id\" to \"test-plan-id\"."),
+		},
+		{
+			name: "change_plan_updatable",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				PlanID:            aws.String("production-plan-id"),
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "maintenance_info_conflict",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists-outdated",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "1.0.0+v1"},
+			expectedErr:     newHTTPStatusCodeError(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", "The maintenance_info.version field provided in the request does not match the maintenance_info.version field provided in the Service Broker's Catalog."),
+		},
+		{
+			name: "maintenance_info_upgrade",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists-outdated",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "1.0.0+v2"},
+			expectedAsync:   true,
+		},
+		{
+			name: "maintenance_info_current",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists-latest",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "1.0.0+v2"},
+			expectedAsync:   false,
+		},
 		{
 			name: "error_getting_service",
 			request: &osb.UpdateInstanceRequest{
@@ -1005,6 +1330,16 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter \"foo\" is not updatable."),
 		},
+		{
+			name: "invalid_parameter",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"req_param": "NEW", "foo": "bar"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter \"foo\" is not updatable. The parameter req_param must match the pattern ^(?:[a-z-]+)$ (must be lowercase)."),
+		},
 		{
 			name: "parameter_not_updated",
 			request: &osb.UpdateInstanceRequest{
@@ -1015,6 +1350,26 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedAsync: false,
 		},
+		{
+			name: "context_updated",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Context:           map[string]interface{}{"platform": "kubernetes", "namespace": "renamed"},
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "dry_run_not_updated",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: false,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"req_param": "a-value", "dry_run": true},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusUnprocessableEntity, "DryRun", `Dry run: the update would not change any resources. Changes: {"add":[],"modify":[],"replace":[],"remove":[]}`),
+		},
 		{
 			name: "error_updating_stack",
 			request: &osb.UpdateInstanceRequest{
@@ -1052,11 +1407,14 @@ func TestUpdate(t *testing.T) {
 			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
 			b.db.DataStorePort = mockDataStoreProvision{}
 
-			resp, err := b.Update(tt.request, &broker.RequestContext{})
+			r := httptest.NewRequest("PATCH", "/v2/service_instances/"+tt.request.InstanceID, nil)
+			r = r.WithContext(context.WithValue(r.Context(), requestExtensionsKey{}, requestExtensions{MaintenanceInfo: tt.maintenanceInfo}))
+			resp, err := b.Update(tt.request, &broker.RequestContext{Request: r})
 			if tt.expectedErr != nil {
 				assert.EqualError(t, err, tt.expectedErr.Error())
 			} else if assert.NoError(t, err) {
 				assert.Equal(t, tt.expectedAsync, resp.Async)
+				assert.Equal(t, tt.expectedAsync, resp.OperationKey != nil)
 			}
 		})
 	}
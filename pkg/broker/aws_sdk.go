@@ -15,6 +15,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -67,6 +69,10 @@ func AwsLambdaClientGetter(sess *session.Session) lambdaiface.LambdaAPI {
 	return lambda.New(sess)
 }
 
+func AwsSqsClientGetter(sess *session.Session) sqsiface.SQSAPI {
+	return sqs.New(sess)
+}
+
 func GetCallerId(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, error) {
 	return svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
 }
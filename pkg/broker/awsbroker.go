@@ -1,17 +1,16 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/awslabs/aws-servicebroker/pkg/dynamodbadapter"
 	"github.com/go-errors/errors"
 	"github.com/golang/glog"
@@ -56,11 +55,6 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 	var catalogcache = cache.NewMemoryWithTTL(time.Duration(CacheTTL))
 	var listingcache = cache.NewMemoryWithTTL(time.Duration(CacheTTL))
 	listingcache.StartGC(time.Minute * 5)
-	bd := &BucketDetailsRequest{
-		o.S3Bucket,
-		o.S3Key,
-		o.TemplateFilter,
-	}
 
 	// retrieve AWS partition from instance metadata service
 	partition, err := ec2metadata.New(sess).GetMetadata("/services/partition")
@@ -68,10 +62,24 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 	if err != nil {
 		partition = "aws" // no access to metadata service, defaults to AWS Standard Partition
 	}
+	source := NewCatalogSource(o, s3svc, partition)
+
+	var tagTemplates []TagTemplate
+	if o.TagTemplates != "" {
+		if tagTemplates, err = LoadTagTemplates(o.TagTemplates); err != nil {
+			return &AwsBroker{}, err
+		}
+	}
+
+	if o.SynchronousTimeout > MaxSynchronousTimeout {
+		glog.Warningf("-synchronousTimeout %v is longer than platforms wait for a response, using %v", o.SynchronousTimeout, MaxSynchronousTimeout)
+		o.SynchronousTimeout = MaxSynchronousTimeout
+	}
 
 	// populate broker variables
 	bl := AwsBroker{
 		accountId:          accountid,
+		catalog:            source,
 		keyid:              o.KeyID,
 		secretkey:          o.SecretKey,
 		profile:            o.Profile,
@@ -92,19 +100,53 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 		prescribeOverrides: o.PrescribeOverrides,
 		globalOverrides:    getGlobalOverrides(o.BrokerID),
 		metrics: mc,
+		leaseOwner:         uuid.NewV4().String(),
+		cfnRoleArn:         o.CfnRoleArn,
+		orphanMitigation:   o.OrphanMitigation,
+		orphanRetention:    o.OrphanRetention,
+		synchronous:        o.Synchronous,
+		synchronousTimeout: o.SynchronousTimeout,
+		tagTemplates:       tagTemplates,
 	}
 
-	// get catalog and setup periodic updates from S3
-	err = updateCatalog(listingcache, catalogcache, *bd, s3svc, db, bl, ListTemplates, ListingUpdate, MetadataUpdate)
+	// get catalog and setup periodic updates
+	err = updateCatalog(listingcache, catalogcache, source, db, ListingUpdate, MetadataUpdate)
 	if err != nil {
 		return &AwsBroker{}, err
 	}
-	go pollUpdate(600, listingcache, catalogcache, *bd, s3svc, db, bl, updateCatalog, ListTemplates)
+	mc.RecordCatalogRefresh(refreshTriggerStartup, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	bl.refresh = make(chan CatalogRefreshRequest)
+	bl.stop = cancel
+	schedule := RefreshSchedule{Interval: o.RefreshInterval, Jitter: o.RefreshJitter}
+	go pollUpdate(ctx, schedule, bl.refresh, listingcache, catalogcache, source, db, updateCatalog, mc)
+	go bl.RunUpgradeCampaigns(ctx, UpgradeCampaignInterval)
+	if o.OrphanMitigation {
+		go bl.RunOrphanMitigation(ctx, OrphanMitigationInterval)
+	}
+	if o.CatalogPath != "" {
+		go WatchCatalogSource(ctx, CatalogPathWatchInterval, source, bl.refresh)
+	}
+	if o.CatalogQueueURL != "" {
+		s3source, ok := source.(S3CatalogSource)
+		if !ok {
+			cancel()
+			return &AwsBroker{}, errors.New("catalogQueueURL can only be used when loading templates from S3")
+		}
+		events := SQSCatalogEventSource{
+			Client:   clients.NewSqs(s3sess),
+			QueueURL: o.CatalogQueueURL,
+			Bucket:   s3source.Bucket,
+			Prefix:   s3source.Prefix,
+			Suffix:   s3source.Suffix,
+		}
+		go ConsumeCatalogEvents(ctx, events, bl.refresh)
+	}
 	return &bl, nil
 }
 
-func UpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
-	l, err := listTemplates(&bd, &bl)
+func UpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, source CatalogSource, db Db, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+	l, err := source.ListTemplates()
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "NoSuchBucket: The specified bucket does not exist") {
 			return errors.New("Cannot access S3 Bucket, either it does not exist or the IAM user/role the broker is configured to use has no access to the bucket")
@@ -115,32 +157,31 @@ func UpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, bd Bucket
 	if err != nil {
 		return err
 	}
-	err = metadataUpdate(listingcache, catalogcache, bd, s3svc, db, MetadataUpdate, bl.templatefilter)
+	err = metadataUpdate(listingcache, catalogcache, source, db, MetadataUpdate)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func PollUpdate(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
-	for {
-		time.Sleep(time.Duration(interval) * time.Second)
-		go updateCatalog(l, c, bd, s3svc, db, bl, listTemplates, ListingUpdate, MetadataUpdate)
-	}
-}
-
-func MetadataUpdate(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
+func MetadataUpdate(l cache.Cache, c cache.Cache, source CatalogSource, db Db, metadataUpdate MetadataUpdater) error {
 	data, err := l.Get("__LISTINGS__")
 	if err != nil {
 		return err
 	}
 	for _, item := range data.([]ServiceNeedsUpdate) {
 		if item.Update {
-			file, err := getObjectBody(s3svc, bd.bucket, bd.prefix+item.Name+templatefilter)
+			file, err := source.GetTemplate(item.Name)
 			if err != nil {
 				glog.Errorln(err)
 				continue
 			}
+			if source.TemplateURL(item.Name) == nil {
+				if err := checkTemplateBodySize(item.Name, file); err != nil {
+					glog.Errorln(err)
+					continue
+				}
+			}
 			if err := templateToServiceDefinition(file, db, c, item); err != nil {
 				glog.Errorln(err)
 			}
@@ -153,9 +194,77 @@ func MetadataUpdate(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc
 			}
 		}
 	}
+	retireRemovedServices(l, c, db, data.([]ServiceNeedsUpdate), time.Now())
 	return nil
 }
 
+// retireRemovedServices deprecates services whose templates have been removed from the catalog source since the
+// last update. The template names seen in each update are persisted, so templates removed while the broker was not
+// running are also retired
+func retireRemovedServices(l cache.Cache, c cache.Cache, db Db, listings []ServiceNeedsUpdate, retiredAt time.Time) {
+	previous := make(map[string]string)
+	if value, err := db.DataStorePort.GetParam(catalogServicesParam); err == nil {
+		if err := json.Unmarshal([]byte(value), &previous); err != nil {
+			glog.Errorf("Failed to parse the services from the previous catalog update: %v", err)
+		}
+	}
+	current := make(map[string]string)
+	for _, item := range listings {
+		if sd, err := c.Get(item.Name); err == nil {
+			current[item.Name] = sd.(osb.Service).Name
+		} else if name, ok := previous[item.Name]; ok {
+			current[item.Name] = name
+		}
+	}
+	for name, serviceName := range previous {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		if err := retireService(db, uuid.NewV5(db.Accountuuid, serviceName).String(), retiredAt); err != nil {
+			glog.Errorf("Failed to retire service %q: %v", serviceName, err)
+			// try again on the next update
+			current[name] = serviceName
+			continue
+		}
+		c.Delete(name)
+		l.Delete(name)
+	}
+	b, err := json.Marshal(current)
+	if err != nil {
+		glog.Errorln(err)
+		return
+	}
+	if err := db.DataStorePort.PutParam(catalogServicesParam, string(b)); err != nil {
+		glog.Errorln(err)
+	}
+}
+
+// retireService marks a service and all of its plans as deprecated, recording when it was retired. The definition
+// is kept in the DataStore so existing instances can still be updated, bound and deprovisioned
+func retireService(db Db, serviceID string, retiredAt time.Time) error {
+	sd, err := db.DataStorePort.GetServiceDefinition(serviceID)
+	if err != nil {
+		return err
+	} else if sd == nil || isDeprecated(sd.Metadata) {
+		return nil
+	}
+	glog.Infof("Retiring service %q, its template is no longer in the catalog", sd.Name)
+	sd.Metadata = deprecatedMetadata(sd.Metadata, retiredAt)
+	for i := range sd.Plans {
+		sd.Plans[i].Metadata = deprecatedMetadata(sd.Plans[i].Metadata, retiredAt)
+	}
+	return db.DataStorePort.PutServiceDefinition(*sd)
+}
+
+func deprecatedMetadata(metadata map[string]interface{}, retiredAt time.Time) map[string]interface{} {
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["deprecated"] = true
+	metadata["retiredAt"] = retiredAt.UTC().Format(time.RFC3339)
+	return metadata
+}
+
 func ListingUpdate(l *[]ServiceLastUpdate, c cache.Cache) error {
 	var services []ServiceNeedsUpdate
 	for _, item := range *l {
@@ -181,37 +290,11 @@ func ListingUpdate(l *[]ServiceLastUpdate, c cache.Cache) error {
 	return nil
 }
 
-func ListTemplates(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
-	glog.Infoln("Listing objects bucket: " + s3source.bucket + " region: " + b.s3region + " prefix: " + s3source.prefix)
-	ListResponse, err := b.s3svc.Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(s3source.bucket),
-		Prefix: aws.String(s3source.prefix),
-	})
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			fmt.Fprintf(os.Stderr, "upload canceled due to timeout, %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "failed to list objects, %v\n", err)
-		}
-		return nil, err
-	}
-	numberOfRecords := 0
-	for _, s3obj := range ListResponse.Contents {
-		if strings.HasSuffix(*s3obj.Key, s3source.suffix) {
-			numberOfRecords = numberOfRecords + 1
-		}
+// Close stops refreshing the catalog in the background
+func (b *AwsBroker) Close() {
+	if b.stop != nil {
+		b.stop()
 	}
-	glog.Infof("Found %x objects\n", numberOfRecords)
-	s := make([]ServiceLastUpdate, 0, numberOfRecords)
-	for _, s3obj := range ListResponse.Contents {
-		if strings.HasSuffix(*s3obj.Key, s3source.suffix) {
-			s = append(s, ServiceLastUpdate{
-				Name: strings.TrimSuffix(strings.TrimPrefix(*s3obj.Key, s3source.prefix), s3source.suffix),
-				Date: *s3obj.LastModified,
-			})
-		}
-	}
-	return &s, nil
 }
 
 // ValidateBrokerAPIVersion still to determine supported api versions
@@ -246,23 +329,40 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 			"outputsAsIs":         sd.Metadata.Spec.OutputsAsIs,
 			"cloudFoundry":        sd.Metadata.Spec.CloudFoundry,
 			"bindViaLambda":       sd.Metadata.Spec.BindViaLambda,
+			"allowContextUpdates": true,
 		},
 		PlanUpdatable: aws.Bool(false),
 	}
+	if len(sd.Metadata.Spec.Capabilities) > 0 {
+		outp.Metadata["capabilities"] = sd.Metadata.Spec.Capabilities
+	}
+	if sd.Transform != nil {
+		outp.Metadata["transform"] = true
+	}
+	if len(sd.Metadata.Spec.ProtectedResources) > 0 {
+		outp.Metadata["protectedResources"] = sd.Metadata.Spec.ProtectedResources
+	}
+	if sd.Metadata.Spec.FinalSnapshotParameter != "" {
+		outp.Metadata["finalSnapshotParameter"] = sd.Metadata.Spec.FinalSnapshotParameter
+	}
 
 	var plans []osb.Plan
 	params := cfnParamsToOsb(sd)
-	for k, p := range sd.Metadata.Spec.ServicePlans {
+	for _, k := range sortedKeys(sd.Metadata.Spec.ServicePlans) {
+		p := sd.Metadata.Spec.ServicePlans[k]
 		planid := uuid.NewV5(db.Accountuuid, "service__"+sd.Metadata.Spec.Name+"__plan__"+k).String()
-		plan := db.servicePlanToOSBPlan(planid, k, p, sd.Metadata.Spec.UpdatableParameters, params)
+		plan := db.servicePlanToOSBPlan(planid, k, p, sd.Metadata.Spec.UpdatableParameters, params, sd.Metadata.Spec.Bindings.Scopes)
 		plans = append(plans, plan)
+		if len(p.UpdatablePlans) > 0 {
+			outp.PlanUpdatable = aws.Bool(true)
+		}
 	}
 	outp.Plans = plans
 	glog.Infof("done converting service definition %q ", sd.Metadata.Spec.Name)
 	return outp
 }
 
-func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePlan, updatableParameters []string, params map[string]interface{}) osb.Plan {
+func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePlan, updatableParameters []string, params map[string]interface{}, bindingScopes []string) osb.Plan {
 	plan := osb.Plan{
 		ID:          planId,
 		Name:        name,
@@ -277,9 +377,24 @@ func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePla
 		},
 		Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{}},
 	}
+	if len(servicePlan.UpdatablePlans) > 0 {
+		plan.Metadata["updatablePlans"] = servicePlan.UpdatablePlans
+	}
+	if servicePlan.Synchronous {
+		plan.Metadata["synchronous"] = true
+	}
+	if !reflect.DeepEqual(servicePlan.StackOptions, StackOptions{}) {
+		plan.Metadata["stackOptions"] = servicePlan.StackOptions
+	}
+	if !reflect.DeepEqual(servicePlan.RetentionPolicy, RetentionPolicy{}) {
+		plan.Metadata["retentionPolicy"] = servicePlan.RetentionPolicy
+	}
 	propsForCreate := make(map[string]interface{})
+	propsForUpdate := make(map[string]interface{})
 	var openshiftFormCreate []OpenshiftFormDefinition
-	for nk, nv := range nonCfnParamDefs {
+	var openshiftFormUpdate []OpenshiftFormDefinition
+	for _, nk := range sortedKeys(nonCfnParamDefs) {
+		nv := nonCfnParamDefs[nk]
 		openshiftFormCreate = openshiftFormAppend(openshiftFormCreate, nk, nv.(map[string]interface{}))
 		nonCfnParam := make(map[string]interface{})
 		for nnk, nnv := range nv.(map[string]interface{}) {
@@ -288,13 +403,23 @@ func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePla
 			}
 		}
 		propsForCreate[nk] = nonCfnParam
+		// Tags can be changed on update, the stack is re-tagged
+		if stringInSlice(nk, tagParams) {
+			openshiftFormUpdate = openshiftFormAppend(openshiftFormUpdate, nk, nv.(map[string]interface{}))
+			updateParam := make(map[string]interface{})
+			for nnk, nnv := range nonCfnParam {
+				if nnk != "default" {
+					updateParam[nnk] = nnv
+				}
+			}
+			propsForUpdate[nk] = updateParam
+		}
 	}
-	propsForUpdate := make(map[string]interface{})
 	requiredForCreate := make([]string, 0)
 	requiredForUpdate := make([]string, 0)
 	prescribed := make(map[string]string)
-	var openshiftFormUpdate []OpenshiftFormDefinition
-	for paramName, paramValue := range params {
+	for _, paramName := range sortedKeys(params) {
+		paramValue := params[paramName]
 		include := true
 		for planParam, planValue := range servicePlan.ParameterValues {
 			if planParam == paramName {
@@ -315,7 +440,11 @@ func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePla
 			for planDefaultParam, planDefaultValue := range servicePlan.ParameterDefaults {
 				if planDefaultParam == paramName {
 					glog.V(10).Infof("Updating default with plan default for plan %q param %q\n", name, paramName)
-					createParam["default"] = planDefaultValue
+					if createParam["type"] == "array" {
+						createParam["default"] = splitListParam(planDefaultValue)
+					} else {
+						createParam["default"] = planDefaultValue
+					}
 				}
 			}
 			for _, v := range []string{"required", "display_group"} {
@@ -356,6 +485,11 @@ func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePla
 		plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})["required"] = requiredForCreate
 	}
 	if len(propsForUpdate) > 0 {
+		// Updates can preview their changes, see newDryRunError
+		propsForUpdate[dryRunParameter] = map[string]interface{}{
+			"type":        "boolean",
+			"description": "Preview the changes the update would make instead of performing it, the update fails with the DryRun error describing them",
+		}
 		plan.Schemas.ServiceInstance.Update = &osb.InputParametersSchema{
 			Parameters: map[string]interface{}{
 				"type":       "object",
@@ -372,22 +506,56 @@ func (db Db) servicePlanToOSBPlan(planId, name string, servicePlan CfnServicePla
 			plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["required"] = requiredForUpdate
 		}
 	}
+	if len(bindingScopes) > 0 {
+		plan.Schemas.ServiceBinding = &osb.ServiceBindingSchema{
+			Create: &osb.RequestResponseSchema{
+				InputParametersSchema: osb.InputParametersSchema{
+					Parameters: map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							bindParamRoleName: map[string]interface{}{
+								"type":        "string",
+								"description": "Name of an existing IAM role to attach the scope's policy to",
+							},
+							bindParamScope: map[string]interface{}{
+								"type":        "string",
+								"description": "Access granted to the role",
+								"enum":        bindingScopes,
+							},
+						},
+						"$schema": "http://json-schema.org/draft-06/schema#",
+					},
+				},
+			},
+		}
+	}
 	return plan
 }
 
-func (b *AwsBroker) generateS3HTTPUrl(serviceDefName string) *string {
-	if b.partition == "aws-cn" {
-		// AWS China Partition
-		objKey := b.s3key + strings.TrimSuffix(serviceDefName, "-apb") + b.templatefilter
-		objURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com.cn/%s", b.s3bucket, b.s3region, objKey)
-		return aws.String(objURL)
-	} else {
-		// AWS Standard Partition and GovCloud Partition
-		objKey := b.s3key + strings.TrimSuffix(serviceDefName, "-apb") + b.templatefilter
-		objURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", b.s3bucket, objKey)
-		if b.s3region != "us-east-1" {
-			objURL = fmt.Sprintf("https://%s.s3-%s.amazonaws.com/%s", b.s3bucket, b.s3region, objKey)
-		}
-		return aws.String(objURL)
+// getTemplateLocation returns the template body to pass to CloudFormation or, when it's too large to send inline, a
+// URL CloudFormation can fetch it from. The body fetched is sent whenever it fits, so the version returned identifies
+// the template the stack is deployed with even if it changed since the catalog was loaded
+func (b *AwsBroker) getTemplateLocation(serviceDefName string) (url *string, body *string, version string, err error) {
+	name := strings.TrimSuffix(serviceDefName, "-apb")
+	file, err := b.catalog.GetTemplate(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	version = templateVersion(file)
+	sizeErr := checkTemplateBodySize(name, file)
+	if sizeErr == nil {
+		return nil, aws.String(string(file)), version, nil
+	}
+	if u := b.catalog.TemplateURL(name); u != nil {
+		return u, nil, version, nil
 	}
+	return nil, nil, "", sizeErr
+}
+
+// checkTemplateBodySize returns an error if a template sent inline is larger than CloudFormation accepts
+func checkTemplateBodySize(name string, body []byte) error {
+	if len(body) > maxTemplateBodySize {
+		return fmt.Errorf("template %s is %d bytes, templates sent inline are limited to %d bytes, load it from S3 instead", name, len(body), maxTemplateBodySize)
+	}
+	return nil
 }
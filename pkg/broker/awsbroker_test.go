@@ -1,12 +1,14 @@
 package broker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -26,6 +28,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/awslabs/aws-servicebroker/pkg/dynamodbadapter"
 	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
 	"github.com/koding/cache"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
@@ -69,10 +72,24 @@ func mockAwsStsClientGetter(sess *session.Session) *sts.STS {
 	return &sts.STS{Client: mock.NewMockClient(conf)}
 }
 
+// testTemplateVersion is the version of the templates served by the mock S3 client
+var testTemplateVersion = templateVersion([]byte(testS3Template))
+
+const testS3Template = "Description: test template"
+
 func mockAwsS3ClientGetter(sess *session.Session) S3Client {
 	conf := aws.NewConfig()
 	conf.Region = sess.Config.Region
-	return S3Client{s3iface.S3API(&s3.S3{Client: mock.NewMockClient(conf)})}
+	return S3Client{mockS3Template{&s3.S3{Client: mock.NewMockClient(conf)}}}
+}
+
+// mockS3Template serves testS3Template for every object
+type mockS3Template struct {
+	s3iface.S3API
+}
+
+func (m mockS3Template) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(testS3Template))}, nil
 }
 
 func mockAwsDdbClientGetter(sess *session.Session) *dynamodb.DynamoDB {
@@ -169,15 +186,15 @@ func mockGetAccountIDFail(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, er
 	return &sts.GetCallerIdentityOutput{}, errors.New("I should be failing")
 }
 
-func mockUpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+func mockUpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, source CatalogSource, db Db, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
 	return nil
 }
 
-func mockUpdateCatalogFail(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+func mockUpdateCatalogFail(listingcache cache.Cache, catalogcache cache.Cache, source CatalogSource, db Db, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
 	return errors.New("I failed")
 }
 
-func mockPollUpdate(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
+func mockPollUpdate(ctx context.Context, schedule RefreshSchedule, requests <-chan CatalogRefreshRequest, l cache.Cache, c cache.Cache, source CatalogSource, db Db, updateCatalog UpdateCataloger, metrics *MetricsCollector) {
 
 }
 
@@ -188,7 +205,11 @@ func (db mockDataStore) PutServiceDefinition(sd osb.Service) error { return nil
 func (db mockDataStore) GetParam(paramname string) (value string, err error) {
 	return "some-value", nil
 }
-func (db mockDataStore) PutParam(paramname string, paramvalue string) error          { return nil }
+func (db mockDataStore) PutParam(paramname string, paramvalue string) error  { return nil }
+func (db mockDataStore) ListParams(prefix string) (map[string]string, error) { return nil, nil }
+func (db mockDataStore) SwapParam(paramname string, old string, new string) (bool, error) {
+	return true, nil
+}
 func (db mockDataStore) PutServiceInstance(si serviceinstance.ServiceInstance) error { return nil }
 func (db mockDataStore) GetServiceDefinition(serviceuuid string) (*osb.Service, error) {
 	service := osb.Service{
@@ -220,6 +241,9 @@ func (db mockDataStore) GetServiceInstance(sid string) (*serviceinstance.Service
 	}
 	return &si, nil
 }
+func (db mockDataStore) ListServiceInstances(serviceid string) ([]serviceinstance.ServiceInstance, error) {
+	return nil, nil
+}
 func (db mockDataStore) DeleteServiceInstance(sid string) error { return nil }
 func (db mockDataStore) GetServiceBinding(id string) (*serviceinstance.ServiceBinding, error) {
 	return nil, nil
@@ -263,16 +287,29 @@ func TestNewAwsBroker(t *testing.T) {
 	}
 }
 
-func mockListTemplates(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
-	return &[]ServiceLastUpdate{}, nil
+type mockCatalogSource struct {
+	ListTemplatesErr error
+	Templates        map[string]string
+}
+
+func (m mockCatalogSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	l := []ServiceLastUpdate{}
+	for name := range m.Templates {
+		l = append(l, ServiceLastUpdate{Name: name})
+	}
+	return &l, m.ListTemplatesErr
 }
 
-func mockListTemplatesFailNoBucket(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
-	return &[]ServiceLastUpdate{}, errors.New("NoSuchBucket: The specified bucket does not exist")
+func (m mockCatalogSource) GetTemplate(name string) ([]byte, error) {
+	t, ok := m.Templates[name]
+	if !ok {
+		return nil, errors.New("template not found")
+	}
+	return []byte(t), nil
 }
 
-func mockListTemplatesFail(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
-	return &[]ServiceLastUpdate{}, errors.New("ListTemplates failed")
+func (m mockCatalogSource) TemplateURL(name string) *string {
+	return nil
 }
 
 func mockListingUpdate(l *[]ServiceLastUpdate, c cache.Cache) error {
@@ -283,11 +320,11 @@ func mockListingUpdateFail(l *[]ServiceLastUpdate, c cache.Cache) error {
 	return errors.New("ListingUpdate failed")
 }
 
-func mockMetadataUpdate(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
+func mockMetadataUpdate(l cache.Cache, c cache.Cache, source CatalogSource, db Db, metadataUpdate MetadataUpdater) error {
 	return nil
 }
 
-func mockMetadataUpdateFail(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
+func mockMetadataUpdateFail(l cache.Cache, c cache.Cache, source CatalogSource, db Db, metadataUpdate MetadataUpdater) error {
 	return errors.New("MetadataUpdate failed")
 }
 
@@ -296,31 +333,25 @@ func TestUpdateCatalog(t *testing.T) {
 	options := new(TestCases)
 	options.GetTests("../../testcases/options.yaml")
 	var bl *AwsBroker
-	var bd *BucketDetailsRequest
 	for _, v := range *options {
 		bl, _ = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
-		bd = &BucketDetailsRequest{
-			v.S3Bucket,
-			v.S3Key,
-			v.TemplateFilter,
-		}
 	}
 
 	bl.db.DataStorePort = mockDataStore{}
 
-	err := UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdate, mockMetadataUpdate)
+	err := UpdateCatalog(bl.listingcache, bl.catalogcache, mockCatalogSource{}, bl.db, mockListingUpdate, mockMetadataUpdate)
 	assert.Nil(err)
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplatesFailNoBucket, mockListingUpdate, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, mockCatalogSource{ListTemplatesErr: errors.New("NoSuchBucket: The specified bucket does not exist")}, bl.db, mockListingUpdate, mockMetadataUpdate)
 	assert.EqualError(err, "Cannot access S3 Bucket, either it does not exist or the IAM user/role the broker is configured to use has no access to the bucket")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplatesFail, mockListingUpdate, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, mockCatalogSource{ListTemplatesErr: errors.New("ListTemplates failed")}, bl.db, mockListingUpdate, mockMetadataUpdate)
 	assert.EqualError(err, "ListTemplates failed")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdateFail, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, mockCatalogSource{}, bl.db, mockListingUpdateFail, mockMetadataUpdate)
 	assert.EqualError(err, "ListingUpdate failed")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdate, mockMetadataUpdateFail)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, mockCatalogSource{}, bl.db, mockListingUpdate, mockMetadataUpdateFail)
 	assert.EqualError(err, "MetadataUpdate failed")
 }
 
@@ -370,6 +401,11 @@ func (m mockCfn) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformati
 func (m mockCfn) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
 	if aws.StringValue(in.StackName) == "err" {
 		return nil, errors.New("test failure")
+	} else if aws.StringValue(in.StackName) == "no-updates" {
+		return nil, awserr.New("ValidationError", "No updates are to be performed.", nil)
+	}
+	if aws.BoolValue(in.UsePreviousTemplate) == (in.TemplateURL != nil || in.TemplateBody != nil) {
+		return nil, errors.New("exactly one of UsePreviousTemplate, TemplateURL or TemplateBody must be set")
 	}
 	return &m.UpdateStackResponse, nil
 }
@@ -383,23 +419,18 @@ func TestMetadataUpdate(t *testing.T) {
 	options := new(TestCases)
 	options.GetTests("../../testcases/options.yaml")
 	var bl *AwsBroker
-	var bd *BucketDetailsRequest
 	for _, v := range *options {
 		bl, _ = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
-		bd = &BucketDetailsRequest{
-			v.S3Bucket,
-			v.S3Key,
-			v.TemplateFilter,
-		}
 	}
 	bl.db.DataStorePort = mockDataStore{}
 
-	s3svc := S3Client{
-		Client: mockS3{GetObjectResp: s3.GetObjectOutput{}},
+	source := S3CatalogSource{
+		Client: S3Client{Client: mockS3{GetObjectResp: s3.GetObjectOutput{}}},
+		Suffix: "-main.yaml",
 	}
 
 	// test "__LISTINGS__" not in cache
-	err := MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
+	err := MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate)
 	assert.EqualError(err, "not found")
 
 	// test empty s3 body
@@ -409,20 +440,91 @@ func TestMetadataUpdate(t *testing.T) {
 		Update: true,
 	})
 	bl.listingcache.Set("__LISTINGS__", serviceUpdates)
-	err = MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
+	err = MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate)
 	assert.Equal(err, nil, "should handle empty s3 objects without erroring")
 
 	// test object not yaml
 	s3obj := s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("test"))}
-	s3svc = S3Client{
-		Client: mockS3{GetObjectResp: s3obj},
-	}
-	err = MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
+	source.Client = S3Client{Client: mockS3{GetObjectResp: s3obj}}
+	err = MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate)
 	assert.Equal(err, nil, "should handle bad templates without erroring")
 
 	// TODO: test success and more failure scenarios
 }
 
+// mockDataStoreCatalog records service definitions and params so catalog updates can be inspected
+type mockDataStoreCatalog struct {
+	mockDataStore
+	services map[string]osb.Service
+	params   map[string]string
+}
+
+func (db mockDataStoreCatalog) PutServiceDefinition(sd osb.Service) error {
+	db.services[sd.ID] = sd
+	return nil
+}
+func (db mockDataStoreCatalog) GetServiceDefinition(serviceuuid string) (*osb.Service, error) {
+	sd, ok := db.services[serviceuuid]
+	if !ok {
+		return nil, nil
+	}
+	return &sd, nil
+}
+func (db mockDataStoreCatalog) GetParam(paramname string) (string, error) {
+	value, ok := db.params[paramname]
+	if !ok {
+		return "", dynamodbadapter.ErrParamNotFound
+	}
+	return value, nil
+}
+func (db mockDataStoreCatalog) PutParam(paramname string, paramvalue string) error {
+	db.params[paramname] = paramvalue
+	return nil
+}
+func (db mockDataStoreCatalog) ListParams(prefix string) (map[string]string, error) { return nil, nil }
+func (db mockDataStoreCatalog) SwapParam(paramname string, old string, new string) (bool, error) {
+	return true, nil
+}
+
+func TestRetireRemovedServices(t *testing.T) {
+	assert := assert.New(t)
+	ds := mockDataStoreCatalog{services: map[string]osb.Service{}, params: map[string]string{}}
+	db := Db{DataStorePort: ds, Accountuuid: uuid.NewV5(uuid.NullUUID{}.UUID, "123456789012awsservicebroker")}
+	l := cache.NewMemory()
+	c := cache.NewMemory()
+	source := mockCatalogSource{Templates: map[string]string{"localtest": testLocalTemplate}}
+	serviceID := uuid.NewV5(db.Accountuuid, "localtest").String()
+
+	assert.NoError(UpdateCatalog(l, c, source, db, ListingUpdate, MetadataUpdate))
+	assert.False(isDeprecated(ds.services[serviceID].Metadata))
+	assert.Equal(`{"localtest":"localtest"}`, ds.params[catalogServicesParam])
+
+	// a template that fails to load is not retired
+	source.Templates = map[string]string{"localtest": "not: [valid"}
+	l.Delete("localtest")
+	c.Delete("localtest")
+	assert.NoError(UpdateCatalog(l, c, source, db, ListingUpdate, MetadataUpdate))
+	assert.False(isDeprecated(ds.services[serviceID].Metadata))
+
+	source.Templates = map[string]string{}
+	assert.NoError(UpdateCatalog(l, c, source, db, ListingUpdate, MetadataUpdate))
+	assert.True(isDeprecated(ds.services[serviceID].Metadata))
+	assert.True(isDeprecated(ds.services[serviceID].Plans[0].Metadata))
+	retiredAt, err := time.Parse(time.RFC3339, ds.services[serviceID].Metadata["retiredAt"].(string))
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), retiredAt, time.Minute)
+	assert.Equal("{}", ds.params[catalogServicesParam])
+	_, err = c.Get("localtest")
+	assert.EqualError(err, "not found")
+
+	// re-adding the template reinstates the service
+	source.Templates = map[string]string{"localtest": testLocalTemplate}
+	assert.NoError(UpdateCatalog(l, c, source, db, ListingUpdate, MetadataUpdate))
+	assert.False(isDeprecated(ds.services[serviceID].Metadata))
+	_, err = c.Get("localtest")
+	assert.NoError(err)
+}
+
 func TestAssumeArnGeneration(t *testing.T) {
 	params := map[string]string{"target_role_name": "worker"}
 
@@ -455,7 +557,7 @@ func TestServicePlanToOSBPlan(t *testing.T) {
 			LongDescription: "This is the test service plan.",
 		}
 		db := Db{}
-		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", sp, nil, nil)
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", sp, nil, nil, nil)
 		assert.NotZero(t, plan)
 		assert.Equal(t, "test-plan-id", plan.ID)
 		assert.Equal(t, "test-plan-id", plan.ID)
@@ -486,7 +588,7 @@ func TestServicePlanToOSBPlan(t *testing.T) {
 			LongDescription: "This is the test service plan.",
 		}
 		db := Db{}
-		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", sp, nil, nil)
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", sp, nil, nil, nil)
 		assert.NotZero(t, plan)
 		assert.EqualValues(t, map[string]interface{}{
 			"cost": "",
@@ -504,4 +606,45 @@ func TestServicePlanToOSBPlan(t *testing.T) {
 
 	})
 
+	t.Run("Stack Options", func(t *testing.T) {
+		db := Db{}
+		options := StackOptions{TimeoutInMinutes: 30, OnFailure: "DELETE", NotificationARNs: []string{"arn:aws:sns:us-east-1:123456789012:topic"}}
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", CfnServicePlan{StackOptions: options}, nil, nil, nil)
+		assert.Equal(t, options, plan.Metadata["stackOptions"])
+		assert.Equal(t, options, getStackOptions(&plan))
+	})
+
+	t.Run("Plan Defaults", func(t *testing.T) {
+		db := Db{}
+		sp := CfnServicePlan{ParameterDefaults: map[string]string{"BucketName": "bucket", "Subnets": "a, b"}}
+		params := map[string]interface{}{
+			"BucketName": map[string]interface{}{"type": "string", "default": "default-bucket"},
+			"Subnets":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", sp, nil, params, nil)
+		properties := plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})["properties"].(map[string]interface{})
+		assert.Equal(t, "bucket", properties["BucketName"].(map[string]interface{})["default"])
+		assert.Equal(t, []string{"a", "b"}, properties["Subnets"].(map[string]interface{})["default"])
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		db := Db{}
+		params := map[string]interface{}{"BucketName": map[string]interface{}{"type": "string"}}
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", CfnServicePlan{}, []string{"BucketName"}, params, nil)
+		properties := plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["properties"].(map[string]interface{})
+		assert.Equal(t, []string{"BucketName", "admin_tags", "dry_run", "user_tags"}, sortedKeys(properties))
+		assert.Equal(t, "boolean", properties["dry_run"].(map[string]interface{})["type"])
+	})
+
+	t.Run("Binding Scopes", func(t *testing.T) {
+		db := Db{}
+		plan := db.servicePlanToOSBPlan("test-plan-id", "test-plan", CfnServicePlan{}, nil, nil, nil)
+		assert.Nil(t, plan.Schemas.ServiceBinding)
+
+		plan = db.servicePlanToOSBPlan("test-plan-id", "test-plan", CfnServicePlan{}, nil, nil, []string{"ReadOnly", "ReadWrite"})
+		assert.NotNil(t, plan.Schemas.ServiceBinding)
+		properties := plan.Schemas.ServiceBinding.Create.Parameters.(map[string]interface{})["properties"].(map[string]interface{})
+		assert.Equal(t, "string", properties["RoleName"].(map[string]interface{})["type"])
+		assert.Equal(t, []string{"ReadOnly", "ReadWrite"}, properties["Scope"].(map[string]interface{})["enum"])
+	})
 }
@@ -0,0 +1,478 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/dynamodbadapter"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Upgrade campaign statuses
+const (
+	campaignStatusRunning   = "running"
+	campaignStatusPaused    = "paused"
+	campaignStatusCompleted = "completed"
+	campaignStatusCancelled = "cancelled"
+)
+
+// Upgrade campaign instance statuses
+const (
+	campaignInstancePending   = "pending"
+	campaignInstanceUpgrading = "upgrading"
+	campaignInstanceUpgraded  = "upgraded"
+	campaignInstanceSkipped   = "skipped"
+	campaignInstanceFailed    = "failed"
+)
+
+// UpgradeCampaign upgrades the instances of a service, or of one of its plans, to the latest template in batches. The
+// first CanarySize instances are upgraded on their own, then BatchSize instances at a time. Each batch must finish
+// before the next one starts, and the campaign is paused as soon as an instance fails to upgrade
+type UpgradeCampaign struct {
+	ID         string                    `json:"id"`
+	ServiceID  string                    `json:"service_id"`
+	PlanID     string                    `json:"plan_id,omitempty"`
+	CanarySize int                       `json:"canary_size"`
+	BatchSize  int                       `json:"batch_size"`
+	Status     string                    `json:"status"`
+	Reason     string                    `json:"reason,omitempty"`
+	Instances  []UpgradeCampaignInstance `json:"instances"`
+	Started    time.Time                 `json:"started"`
+	Updated    time.Time                 `json:"updated"`
+}
+
+// UpgradeCampaignInstance records the progress of an instance in an upgrade campaign
+type UpgradeCampaignInstance struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Operation is the key of the update operation upgrading the instance
+	Operation string `json:"operation,omitempty"`
+}
+
+// upgradeCampaignInstanceRecord is how an instance in an upgrade campaign is stored. Each instance is stored in its
+// own DataStore parameter, so the size of a campaign isn't limited by the size of a single item
+type upgradeCampaignInstanceRecord struct {
+	CampaignID string `json:"campaign_id"`
+	UpgradeCampaignInstance
+}
+
+// upgradeCampaignLease is held by the broker changing the upgrade campaign, so brokers sharing a DataStore don't
+// advance the same campaign at once
+type upgradeCampaignLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// StartUpgradeCampaign starts upgrading the instances of a service that don't use its latest template. If planID is
+// set only the instances of that plan are upgraded. Only one campaign can be in progress at a time
+func (b *AwsBroker) StartUpgradeCampaign(serviceID string, planID string, canarySize int, batchSize int) (*UpgradeCampaign, error) {
+	if canarySize < 0 || batchSize < 1 {
+		desc := "The canary size must not be negative and the batch size must be at least 1."
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	unlock, err := b.lockUpgradeCampaign()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := b.getUpgradeCampaign()
+	if err != nil {
+		return nil, err
+	} else if current != nil && (current.Status == campaignStatusRunning || current.Status == campaignStatusPaused) {
+		desc := fmt.Sprintf("The upgrade campaign %q is %s, it must be completed or cancelled first.", current.ID, current.Status)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
+
+	service, err := b.db.DataStorePort.GetServiceDefinition(serviceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %q: %v", serviceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if service == nil {
+		desc := fmt.Sprintf("The service %q was not found.", serviceID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	if planID != "" && getPlan(service, planID) == nil {
+		desc := fmt.Sprintf("The service plan %q was not found.", planID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	instances, err := b.db.DataStorePort.ListServiceInstances(serviceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to list the instances of service %q: %v", serviceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	now := time.Now().UTC()
+	campaign := &UpgradeCampaign{
+		ID:         uuid.NewV4().String(),
+		ServiceID:  serviceID,
+		PlanID:     planID,
+		CanarySize: canarySize,
+		BatchSize:  batchSize,
+		Status:     campaignStatusRunning,
+		Instances:  []UpgradeCampaignInstance{},
+		Started:    now,
+		Updated:    now,
+	}
+	version := getTemplateVersion(service)
+	for _, instance := range instances {
+		if planID != "" && instance.PlanID != planID {
+			continue
+		}
+		if instance.TemplateVersion != "" && instance.TemplateVersion == version {
+			continue
+		}
+		campaign.Instances = append(campaign.Instances, UpgradeCampaignInstance{ID: instance.ID, Status: campaignInstancePending})
+	}
+	glog.Infof("Starting upgrade campaign %q for %d instances of service %q", campaign.ID, len(campaign.Instances), serviceID)
+
+	b.advanceUpgradeCampaign(campaign)
+	return campaign, b.putUpgradeCampaign(campaign, nil)
+}
+
+// GetUpgradeCampaign returns the latest upgrade campaign, or nil if no campaign has been started
+func (b *AwsBroker) GetUpgradeCampaign() (*UpgradeCampaign, error) {
+	b.campaignLock.Lock()
+	defer b.campaignLock.Unlock()
+
+	return b.getUpgradeCampaign()
+}
+
+// ResumeUpgradeCampaign continues a paused upgrade campaign. Instances that failed to upgrade are not retried
+func (b *AwsBroker) ResumeUpgradeCampaign() (*UpgradeCampaign, error) {
+	return b.changeUpgradeCampaign(campaignStatusPaused, func(campaign *UpgradeCampaign) {
+		glog.Infof("Resuming upgrade campaign %q", campaign.ID)
+		campaign.Status = campaignStatusRunning
+		campaign.Reason = ""
+		b.advanceUpgradeCampaign(campaign)
+	})
+}
+
+// CancelUpgradeCampaign stops a running or paused upgrade campaign. Stack updates that have already started are not
+// cancelled
+func (b *AwsBroker) CancelUpgradeCampaign() (*UpgradeCampaign, error) {
+	return b.changeUpgradeCampaign("", func(campaign *UpgradeCampaign) {
+		glog.Infof("Cancelling upgrade campaign %q", campaign.ID)
+		campaign.Status = campaignStatusCancelled
+		campaign.Updated = time.Now().UTC()
+	})
+}
+
+// changeUpgradeCampaign applies change to the current campaign if it has the expected status, or if status is empty
+// and the campaign is running or paused
+func (b *AwsBroker) changeUpgradeCampaign(status string, change func(*UpgradeCampaign)) (*UpgradeCampaign, error) {
+	unlock, err := b.lockUpgradeCampaign()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	campaign, err := b.getUpgradeCampaign()
+	if err != nil {
+		return nil, err
+	} else if campaign == nil {
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", "No upgrade campaign has been started.")
+	}
+	if status == "" && campaign.Status != campaignStatusRunning && campaign.Status != campaignStatusPaused ||
+		status != "" && campaign.Status != status {
+		desc := fmt.Sprintf("The upgrade campaign %q is %s.", campaign.ID, campaign.Status)
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
+	stored := campaignInstances(campaign)
+	change(campaign)
+	return campaign, b.putUpgradeCampaign(campaign, stored)
+}
+
+// RunUpgradeCampaigns advances the running upgrade campaign every interval, until ctx is cancelled. The campaign's
+// progress is stored in the DataStore, so a campaign carries on where it left off when the broker is restarted
+func (b *AwsBroker) RunUpgradeCampaigns(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := b.advanceRunningUpgradeCampaign(); err != nil {
+			glog.Errorln(err)
+		}
+	}
+}
+
+// advanceRunningUpgradeCampaign advances the running upgrade campaign, unless another broker is changing it
+func (b *AwsBroker) advanceRunningUpgradeCampaign() error {
+	unlock, err := b.lockUpgradeCampaign()
+	if httpErr, ok := err.(osb.HTTPStatusCodeError); ok && httpErr.StatusCode == http.StatusConflict {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer unlock()
+
+	campaign, err := b.getUpgradeCampaign()
+	if err != nil || campaign == nil || campaign.Status != campaignStatusRunning {
+		return err
+	}
+	stored := campaignInstances(campaign)
+	b.advanceUpgradeCampaign(campaign)
+	return b.putUpgradeCampaign(campaign, stored)
+}
+
+// advanceUpgradeCampaign checks the instances that are being upgraded and, once they have all finished, starts
+// upgrading the next batch. The campaign is paused if an instance fails to upgrade, and completed once every instance
+// has been upgraded
+func (b *AwsBroker) advanceUpgradeCampaign(campaign *UpgradeCampaign) {
+	defer func() { campaign.Updated = time.Now().UTC() }()
+
+	upgrading, started := 0, 0
+	for i := range campaign.Instances {
+		ci := &campaign.Instances[i]
+		if ci.Status == campaignInstanceUpgrading {
+			b.checkCampaignInstance(campaign, ci)
+		}
+		switch ci.Status {
+		case campaignInstanceUpgrading:
+			upgrading++
+			started++
+		case campaignInstanceUpgraded, campaignInstanceFailed:
+			started++
+		}
+	}
+	if upgrading > 0 || campaign.Status != campaignStatusRunning {
+		return
+	}
+
+	// The canary batch is upgraded on its own before the remaining instances
+	size := campaign.BatchSize
+	if started < campaign.CanarySize {
+		size = campaign.CanarySize - started
+	}
+	for i := range campaign.Instances {
+		ci := &campaign.Instances[i]
+		if ci.Status != campaignInstancePending {
+			continue
+		}
+		if upgrading == size {
+			return
+		}
+		key, err := b.upgradeInstance(ci.ID)
+		if httpErr, ok := err.(osb.HTTPStatusCodeError); ok && httpErr.StatusCode == http.StatusNotFound {
+			// the instance was deprovisioned since the campaign started
+			ci.Status = campaignInstanceSkipped
+			ci.Reason = aws.StringValue(httpErr.Description)
+		} else if err != nil {
+			ci.Status = campaignInstanceFailed
+			if httpErr, ok := err.(osb.HTTPStatusCodeError); ok {
+				ci.Reason = aws.StringValue(httpErr.Description)
+			} else {
+				ci.Reason = err.Error()
+			}
+			b.pauseUpgradeCampaign(campaign, ci)
+			return
+		} else if key == nil {
+			ci.Status = campaignInstanceSkipped
+			ci.Reason = "The instance already uses the latest template."
+		} else {
+			ci.Status = campaignInstanceUpgrading
+			ci.Operation = string(*key)
+			upgrading++
+		}
+	}
+	if upgrading == 0 {
+		glog.Infof("Upgrade campaign %q completed", campaign.ID)
+		campaign.Status = campaignStatusCompleted
+	}
+}
+
+// checkCampaignInstance updates the status of an instance being upgraded from its update operation and its stack's
+// status. A stack still reporting the status and update time it had before the upgrade hasn't started updating yet,
+// so e.g. a stack that had rolled back before the campaign isn't taken as failing the upgrade
+func (b *AwsBroker) checkCampaignInstance(campaign *UpgradeCampaign, ci *UpgradeCampaignInstance) {
+	instance, err := b.db.DataStorePort.GetServiceInstance(ci.ID)
+	if err != nil {
+		glog.Errorf("Failed to get the service instance %q: %v", ci.ID, err)
+		return
+	} else if instance == nil {
+		ci.Status = campaignInstanceSkipped
+		ci.Reason = fmt.Sprintf("The service instance %q was not found.", ci.ID)
+		return
+	}
+
+	op, _ := findOperation(instance, ci.Operation)
+	if op != nil && op.State == string(osb.StateSucceeded) {
+		// the stack didn't need updating
+		ci.Status = campaignInstanceUpgraded
+		return
+	}
+
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	stack, err := describeStack(cfnSvc, instance.StackID)
+	if err != nil {
+		glog.Errorf("Failed to describe the CloudFormation stack %q: %v", instance.StackID, err)
+		return
+	}
+	status := aws.StringValue(stack.StackStatus)
+	if op != nil && status == op.StackStatus && !stackUpdatedTime(stack).After(op.StackUpdated) {
+		// the update hasn't started yet
+		return
+	}
+	switch {
+	case status == cloudformation.StackStatusUpdateComplete || status == cloudformation.StackStatusCreateComplete:
+		ci.Status = campaignInstanceUpgraded
+	case strings.HasSuffix(status, "_IN_PROGRESS"):
+		// still updating or rolling back
+	default:
+		ci.Status = campaignInstanceFailed
+		ci.Reason = fmt.Sprintf("The CloudFormation stack %q finished with status %s: %s", instance.StackID, status, aws.StringValue(stack.StackStatusReason))
+		if status == cloudformation.StackStatusUpdateRollbackComplete && op != nil && op.Type == serviceinstance.OperationUpdate && op.State == "" {
+			// the instance is left at the template version it had before
+			b.restorePreviousValues(instance, op, ci.Reason)
+		}
+		b.pauseUpgradeCampaign(campaign, ci)
+	}
+}
+
+func (b *AwsBroker) pauseUpgradeCampaign(campaign *UpgradeCampaign, ci *UpgradeCampaignInstance) {
+	if campaign.Status != campaignStatusRunning {
+		return
+	}
+	glog.Errorf("Pausing upgrade campaign %q, the service instance %q failed to upgrade: %s", campaign.ID, ci.ID, ci.Reason)
+	campaign.Status = campaignStatusPaused
+	campaign.Reason = fmt.Sprintf("The service instance %q failed to upgrade.", ci.ID)
+}
+
+// lockUpgradeCampaign locks the upgrade campaign in this broker and takes the campaign's lease in the DataStore. It
+// returns a 409 error if another broker holds the lease, which expires after UpgradeCampaignLeaseDuration in case
+// that broker stops before releasing it
+func (b *AwsBroker) lockUpgradeCampaign() (unlock func(), err error) {
+	b.campaignLock.Lock()
+
+	var lease upgradeCampaignLease
+	current, err := b.db.DataStorePort.GetParam(upgradeCampaignLeaseParam)
+	if err == dynamodbadapter.ErrParamNotFound {
+		// no lease has been taken yet
+		current = ""
+	} else if err != nil {
+		b.campaignLock.Unlock()
+		desc := fmt.Sprintf("Failed to lock the upgrade campaign: %v", err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if err := json.Unmarshal([]byte(current), &lease); err != nil {
+		glog.Errorf("Ignoring the invalid upgrade campaign lease %q: %v", current, err)
+	}
+	now := time.Now().UTC()
+	if lease.Owner != b.leaseOwner && lease.Expires.After(now) {
+		b.campaignLock.Unlock()
+		desc := fmt.Sprintf("The upgrade campaign is being changed by another broker, try again after %s.", lease.Expires.Format(time.RFC3339))
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
+
+	value, _ := json.Marshal(upgradeCampaignLease{Owner: b.leaseOwner, Expires: now.Add(UpgradeCampaignLeaseDuration)})
+	taken, err := b.db.DataStorePort.SwapParam(upgradeCampaignLeaseParam, current, string(value))
+	if err != nil {
+		b.campaignLock.Unlock()
+		desc := fmt.Sprintf("Failed to lock the upgrade campaign: %v", err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if !taken {
+		b.campaignLock.Unlock()
+		return nil, newHTTPStatusCodeError(http.StatusConflict, "", "The upgrade campaign is being changed by another broker, try again later.")
+	}
+
+	return func() {
+		released, _ := json.Marshal(upgradeCampaignLease{})
+		if _, err := b.db.DataStorePort.SwapParam(upgradeCampaignLeaseParam, string(value), string(released)); err != nil {
+			glog.Errorf("Failed to release the upgrade campaign lease: %v", err)
+		}
+		b.campaignLock.Unlock()
+	}, nil
+}
+
+// getUpgradeCampaign returns the latest upgrade campaign along with the instances stored for it, sorted by ID
+func (b *AwsBroker) getUpgradeCampaign() (*UpgradeCampaign, error) {
+	value, err := b.db.DataStorePort.GetParam(upgradeCampaignParam)
+	if err == dynamodbadapter.ErrParamNotFound {
+		// no campaign has been started
+		return nil, nil
+	} else if err != nil {
+		desc := fmt.Sprintf("Failed to read the upgrade campaign: %v", err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	var campaign UpgradeCampaign
+	if err := json.Unmarshal([]byte(value), &campaign); err != nil {
+		desc := fmt.Sprintf("Failed to read the upgrade campaign: %v", err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	records, err := b.db.DataStorePort.ListParams(upgradeCampaignInstancePrefix)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to read the instances of upgrade campaign %q: %v", campaign.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	for name, value := range records {
+		var record upgradeCampaignInstanceRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			glog.Errorf("Ignoring the invalid upgrade campaign instance %q: %v", name, err)
+			continue
+		}
+		// instances left over from earlier campaigns are overwritten when an instance is in a later one
+		if record.CampaignID == campaign.ID {
+			campaign.Instances = append(campaign.Instances, record.UpgradeCampaignInstance)
+		}
+	}
+	if campaign.Instances == nil {
+		campaign.Instances = []UpgradeCampaignInstance{}
+	}
+	sort.Slice(campaign.Instances, func(i, j int) bool { return campaign.Instances[i].ID < campaign.Instances[j].ID })
+	return &campaign, nil
+}
+
+// putUpgradeCampaign stores an upgrade campaign. Only the instances that differ from stored, the instances as they
+// were read, are written
+func (b *AwsBroker) putUpgradeCampaign(campaign *UpgradeCampaign, stored map[string]UpgradeCampaignInstance) error {
+	for _, ci := range campaign.Instances {
+		if previous, ok := stored[ci.ID]; ok && previous == ci {
+			continue
+		}
+		value, err := json.Marshal(upgradeCampaignInstanceRecord{CampaignID: campaign.ID, UpgradeCampaignInstance: ci})
+		if err == nil {
+			err = b.db.DataStorePort.PutParam(upgradeCampaignInstancePrefix+ci.ID, string(value))
+		}
+		if err != nil {
+			desc := fmt.Sprintf("Failed to store the service instance %q of upgrade campaign %q: %v", ci.ID, campaign.ID, err)
+			return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+	}
+
+	header := *campaign
+	header.Instances = nil
+	value, err := json.Marshal(header)
+	if err == nil {
+		err = b.db.DataStorePort.PutParam(upgradeCampaignParam, string(value))
+	}
+	if err != nil {
+		desc := fmt.Sprintf("Failed to store the upgrade campaign %q: %v", campaign.ID, err)
+		return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	return nil
+}
+
+// campaignInstances returns a copy of a campaign's instances by ID
+func campaignInstances(campaign *UpgradeCampaign) map[string]UpgradeCampaignInstance {
+	instances := make(map[string]UpgradeCampaignInstance)
+	for _, ci := range campaign.Instances {
+		instances[ci.ID] = ci
+	}
+	return instances
+}
@@ -0,0 +1,333 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/dynamodbadapter"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockDataStoreCampaign stores service instances and params so background tasks like upgrade campaigns can be run
+// against them
+type mockDataStoreCampaign struct {
+	mockDataStoreProvision
+	mu        *sync.Mutex
+	instances map[string]serviceinstance.ServiceInstance
+	params    map[string]string
+	paramErr  error
+}
+
+func newMockDataStoreCampaign(instances ...serviceinstance.ServiceInstance) mockDataStoreCampaign {
+	db := mockDataStoreCampaign{mu: &sync.Mutex{}, instances: map[string]serviceinstance.ServiceInstance{}, params: map[string]string{}}
+	for _, i := range instances {
+		db.instances[i.ID] = i
+	}
+	return db
+}
+
+func (db mockDataStoreCampaign) GetParam(paramname string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.paramErr != nil {
+		return "", db.paramErr
+	}
+	value, ok := db.params[paramname]
+	if !ok {
+		return "", dynamodbadapter.ErrParamNotFound
+	}
+	return value, nil
+}
+func (db mockDataStoreCampaign) PutParam(paramname string, paramvalue string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.params[paramname] = paramvalue
+	return nil
+}
+func (db mockDataStoreCampaign) ListParams(prefix string) (map[string]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	params := make(map[string]string)
+	for name, value := range db.params {
+		if strings.HasPrefix(name, prefix) {
+			params[name] = value
+		}
+	}
+	return params, nil
+}
+func (db mockDataStoreCampaign) SwapParam(paramname string, old string, new string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.params[paramname] != old {
+		return false, nil
+	}
+	db.params[paramname] = new
+	return true, nil
+}
+func (db mockDataStoreCampaign) GetServiceInstance(sid string) (*serviceinstance.ServiceInstance, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	si, ok := db.instances[sid]
+	if !ok {
+		return nil, nil
+	}
+	return &si, nil
+}
+func (db mockDataStoreCampaign) PutServiceInstance(si serviceinstance.ServiceInstance) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.instances[si.ID] = si
+	return nil
+}
+func (db mockDataStoreCampaign) DeleteServiceInstance(sid string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.instances, sid)
+	return nil
+}
+func (db mockDataStoreCampaign) ListServiceInstances(serviceid string) ([]serviceinstance.ServiceInstance, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var instances []serviceinstance.ServiceInstance
+	for _, si := range db.instances {
+		if si.ServiceID == serviceid {
+			instances = append(instances, si)
+		}
+	}
+	return instances, nil
+}
+
+// mockCfnStackStatus reports the status set for each stack
+type mockCfnStackStatus struct {
+	mockCfn
+	mu       *sync.Mutex
+	statuses map[string]string
+}
+
+func (m mockCfnStackStatus) set(stack string, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statuses[stack] = status
+}
+
+func (m mockCfnStackStatus) DescribeStacks(in *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{{
+		StackName:   in.StackName,
+		StackStatus: aws.String(m.statuses[aws.StringValue(in.StackName)]),
+	}}}, nil
+}
+
+func (m mockCfnStackStatus) CreateStack(in *cloudformation.CreateStackInput) (*cloudformation.CreateStackOutput, error) {
+	m.set(aws.StringValue(in.StackName), cloudformation.StackStatusCreateInProgress)
+	return &cloudformation.CreateStackOutput{StackId: in.StackName}, nil
+}
+
+func (m mockCfnStackStatus) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
+	m.set(aws.StringValue(in.StackName), cloudformation.StackStatusUpdateInProgress)
+	return m.mockCfn.UpdateStack(in)
+}
+
+func (m mockCfnStackStatus) ContinueUpdateRollback(in *cloudformation.ContinueUpdateRollbackInput) (*cloudformation.ContinueUpdateRollbackOutput, error) {
+	m.set(aws.StringValue(in.StackName), cloudformation.StackStatusUpdateRollbackInProgress)
+	return &cloudformation.ContinueUpdateRollbackOutput{}, nil
+}
+
+func (m mockCfnStackStatus) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	m.set(aws.StringValue(in.StackName), cloudformation.StackStatusDeleteInProgress)
+	return m.mockCfn.DeleteStack(in)
+}
+
+func newCampaignTestBroker(db DataStore, cfn mockCfnStackStatus) *AwsBroker {
+	b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+	b.db.DataStorePort = db
+	b.Clients.NewCfn = func(sess *session.Session) CfnClient { return CfnClient{cfn} }
+	return b
+}
+
+func campaignStatuses(c *UpgradeCampaign) []string {
+	var statuses []string
+	for _, i := range c.Instances {
+		statuses = append(statuses, i.ID+"="+i.Status)
+	}
+	return statuses
+}
+
+func TestUpgradeCampaign(t *testing.T) {
+	assert := assert.New(t)
+	var instances []serviceinstance.ServiceInstance
+	for _, id := range []string{"i1", "i2", "i3", "i4", "i5"} {
+		instances = append(instances, serviceinstance.ServiceInstance{ID: id, ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-" + id, Params: map[string]string{"req_param": "a-value"}, TemplateVersion: "v1"})
+	}
+	instances = append(instances,
+		serviceinstance.ServiceInstance{ID: "i0", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i0", TemplateVersion: testTemplateVersion},
+		serviceinstance.ServiceInstance{ID: "other", ServiceID: "other-service-id", PlanID: "test-plan-id", StackID: "stack-other"},
+	)
+	db := newMockDataStoreCampaign(instances...)
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}}
+	b := newCampaignTestBroker(db, cfn)
+
+	_, err := b.StartUpgradeCampaign("test-service-id", "", 1, 0)
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusBadRequest, "", "The canary size must not be negative and the batch size must be at least 1.").Error())
+	_, err = b.StartUpgradeCampaign("test-service-id", "foo", 1, 2)
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan \"foo\" was not found.").Error())
+	_, err = b.ResumeUpgradeCampaign()
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusNotFound, "", "No upgrade campaign has been started.").Error())
+
+	// the canary is upgraded first
+	campaign, err := b.StartUpgradeCampaign("test-service-id", "", 1, 2)
+	assert.NoError(err)
+	assert.Equal(campaignStatusRunning, campaign.Status)
+	assert.Equal([]string{"i1=upgrading", "i2=pending", "i3=pending", "i4=pending", "i5=pending"}, campaignStatuses(campaign))
+
+	_, err = b.StartUpgradeCampaign("test-service-id", "", 1, 2)
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusConflict, "", "The upgrade campaign \""+campaign.ID+"\" is running, it must be completed or cancelled first.").Error())
+
+	// nothing starts until the canary has finished
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal([]string{"i1=upgrading", "i2=pending", "i3=pending", "i4=pending", "i5=pending"}, campaignStatuses(campaign))
+
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateComplete)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal([]string{"i1=upgraded", "i2=upgrading", "i3=upgrading", "i4=pending", "i5=pending"}, campaignStatuses(campaign))
+	assert.Equal(testTemplateVersion, db.instances["i1"].TemplateVersion)
+
+	// a rolled back update pauses the campaign
+	cfn.set("stack-i2", cloudformation.StackStatusUpdateComplete)
+	cfn.set("stack-i3", cloudformation.StackStatusUpdateRollbackComplete)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal(campaignStatusPaused, campaign.Status)
+	assert.Equal("The service instance \"i3\" failed to upgrade.", campaign.Reason)
+	assert.Equal([]string{"i1=upgraded", "i2=upgraded", "i3=failed", "i4=pending", "i5=pending"}, campaignStatuses(campaign))
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal(campaignStatusPaused, campaign.Status)
+
+	// the campaign carries on from the DataStore, e.g. after a restart
+	b = newCampaignTestBroker(db, cfn)
+	campaign, err = b.ResumeUpgradeCampaign()
+	assert.NoError(err)
+	assert.Equal(campaignStatusRunning, campaign.Status)
+	assert.Equal([]string{"i1=upgraded", "i2=upgraded", "i3=failed", "i4=upgrading", "i5=upgrading"}, campaignStatuses(campaign))
+
+	cfn.set("stack-i4", cloudformation.StackStatusUpdateComplete)
+	cfn.set("stack-i5", cloudformation.StackStatusUpdateComplete)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunUpgradeCampaigns(ctx, time.Millisecond)
+	assert.Eventually(func() bool {
+		campaign, _ := b.GetUpgradeCampaign()
+		return campaign.Status == campaignStatusCompleted
+	}, time.Second, time.Millisecond)
+	cancel()
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal([]string{"i1=upgraded", "i2=upgraded", "i3=failed", "i4=upgraded", "i5=upgraded"}, campaignStatuses(campaign))
+
+	_, err = b.CancelUpgradeCampaign()
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusConflict, "", "The upgrade campaign \""+campaign.ID+"\" is completed.").Error())
+}
+
+func TestUpgradeCampaignPlan(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign(
+		serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1", Params: map[string]string{"req_param": "a-value"}},
+		serviceinstance.ServiceInstance{ID: "i2", ServiceID: "test-service-id", PlanID: "production-plan-id", StackID: "stack-i2", Params: map[string]string{"req_param": "a-value"}},
+		serviceinstance.ServiceInstance{ID: "i3", ServiceID: "test-service-id", PlanID: "production-plan-id", StackID: "stack-i3", Params: map[string]string{"req_param": "a-value"}},
+	)
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}}
+	b := newCampaignTestBroker(db, cfn)
+
+	campaign, err := b.StartUpgradeCampaign("test-service-id", "test-plan-id", 0, 5)
+	assert.NoError(err)
+	assert.Equal([]string{"i1=upgrading"}, campaignStatuses(campaign))
+
+	// cancelling leaves started updates to finish
+	campaign, err = b.CancelUpgradeCampaign()
+	assert.NoError(err)
+	assert.Equal(campaignStatusCancelled, campaign.Status)
+	assert.Equal([]string{"i1=upgrading"}, campaignStatuses(campaign))
+
+	// instances that have been upgraded are left out, and instances that have been deprovisioned are skipped
+	campaign, err = b.StartUpgradeCampaign("test-service-id", "", 0, 1)
+	assert.NoError(err)
+	assert.Equal([]string{"i2=upgrading", "i3=pending"}, campaignStatuses(campaign))
+	delete(db.instances, "i3")
+	cfn.set("stack-i2", cloudformation.StackStatusUpdateComplete)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal(campaignStatusCompleted, campaign.Status)
+	assert.Equal([]string{"i2=upgraded", "i3=skipped"}, campaignStatuses(campaign))
+}
+
+func TestUpgradeCampaignStorage(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign(
+		serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1", Params: map[string]string{"req_param": "a-value"}},
+		serviceinstance.ServiceInstance{ID: "i2", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i2", Params: map[string]string{"req_param": "a-value"}},
+	)
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{"stack-i1": cloudformation.StackStatusUpdateRollbackComplete}}
+	b := newCampaignTestBroker(db, cfn)
+
+	// the campaign can't be changed while another broker holds its lease
+	lease, _ := json.Marshal(upgradeCampaignLease{Owner: "other-broker", Expires: time.Now().Add(time.Minute)})
+	db.params[upgradeCampaignLeaseParam] = string(lease)
+	_, err := b.StartUpgradeCampaign("test-service-id", "", 1, 1)
+	assert.Equal(http.StatusConflict, err.(osb.HTTPStatusCodeError).StatusCode)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+
+	// until it expires
+	lease, _ = json.Marshal(upgradeCampaignLease{Owner: "other-broker", Expires: time.Now().Add(-time.Minute)})
+	db.params[upgradeCampaignLeaseParam] = string(lease)
+	campaign, err := b.StartUpgradeCampaign("test-service-id", "", 1, 1)
+	assert.NoError(err)
+	assert.Equal([]string{"i1=upgrading", "i2=pending"}, campaignStatuses(campaign))
+	assert.JSONEq(`{"owner": "", "expires": "0001-01-01T00:00:00Z"}`, db.params[upgradeCampaignLeaseParam])
+
+	// each instance is stored on its own
+	assert.NotContains(db.params[upgradeCampaignParam], "i1")
+	assert.Contains(db.params, upgradeCampaignInstancePrefix+"i1")
+	assert.Contains(db.params, upgradeCampaignInstancePrefix+"i2")
+
+	// a stack that rolled back before the campaign isn't taken as failing the upgrade
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackComplete)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal(campaignStatusRunning, campaign.Status)
+	assert.Equal([]string{"i1=upgrading", "i2=pending"}, campaignStatuses(campaign))
+
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateComplete)
+	assert.NoError(b.advanceRunningUpgradeCampaign())
+	campaign, _ = b.GetUpgradeCampaign()
+	assert.Equal([]string{"i1=upgraded", "i2=upgrading"}, campaignStatuses(campaign))
+}
+
+func TestUpgradeCampaignStorageError(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign(serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1", Params: map[string]string{"req_param": "a-value"}})
+	db.paramErr = errors.New("ProvisionedThroughputExceededException")
+	b := newCampaignTestBroker(db, mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}})
+
+	// failing to read the campaign isn't taken as no campaign having been started
+	_, err := b.StartUpgradeCampaign("test-service-id", "", 1, 1)
+	assert.Equal(http.StatusInternalServerError, err.(osb.HTTPStatusCodeError).StatusCode)
+	_, err = b.GetUpgradeCampaign()
+	assert.Equal(http.StatusInternalServerError, err.(osb.HTTPStatusCodeError).StatusCode)
+	_, err = b.CancelUpgradeCampaign()
+	assert.Equal(http.StatusInternalServerError, err.(osb.HTTPStatusCodeError).StatusCode)
+	assert.NotContains(db.params, upgradeCampaignParam)
+}
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/golang/glog"
+)
+
+// CatalogEventRetryInterval how long to wait before receiving catalog events again after an error
+var CatalogEventRetryInterval = 10 * time.Second
+
+// CatalogEvent is a change to a single template in the catalog source
+type CatalogEvent struct {
+	Name    string
+	Removed bool
+}
+
+// CatalogEventSource delivers template change events
+type CatalogEventSource interface {
+	// Receive blocks until events are available or ctx is cancelled
+	Receive(ctx context.Context) ([]CatalogEvent, error)
+}
+
+// ConsumeCatalogEvents requests a refresh of the changed templates for every batch of events received, until ctx
+// is cancelled
+func ConsumeCatalogEvents(ctx context.Context, events CatalogEventSource, requests chan<- CatalogRefreshRequest) {
+	for {
+		received, err := events.Receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			glog.Errorf("Failed to receive catalog events: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(CatalogEventRetryInterval):
+			}
+			continue
+		}
+		if len(received) == 0 {
+			continue
+		}
+		req := CatalogRefreshRequest{Trigger: refreshTriggerEvent}
+		for _, e := range received {
+			if e.Removed {
+				req.Removed = append(req.Removed, e.Name)
+			} else {
+				req.Updated = append(req.Updated, e.Name)
+			}
+		}
+		select {
+		case requests <- req:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FakeCatalogEventSource delivers events sent on its channel, for local development and tests
+type FakeCatalogEventSource chan []CatalogEvent
+
+// Receive waits for the next batch of events sent on the channel
+func (f FakeCatalogEventSource) Receive(ctx context.Context) ([]CatalogEvent, error) {
+	select {
+	case events := <-f:
+		return events, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SQSCatalogEventSource receives S3 event notifications for the template bucket from an SQS queue, either sent
+// directly by S3 or via an SNS topic. Messages are deleted once received, if a refresh fails the next scheduled
+// refresh picks up the change
+type SQSCatalogEventSource struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+	Bucket   string
+	Prefix   string
+	Suffix   string
+}
+
+// s3EventNotification is the subset of an S3 event notification needed to identify changed templates
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsNotification wraps messages delivered to SQS via an SNS topic
+type snsNotification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// Receive long polls the queue, returning events for objects in the bucket and prefix matching the suffix
+func (s SQSCatalogEventSource) Receive(ctx context.Context) ([]CatalogEvent, error) {
+	resp, err := s.Client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.QueueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var events []CatalogEvent
+	var entries []*sqs.DeleteMessageBatchRequestEntry
+	for _, m := range resp.Messages {
+		events = append(events, s.parseMessage(aws.StringValue(m.Body))...)
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            m.MessageId,
+			ReceiptHandle: m.ReceiptHandle,
+		})
+	}
+	if len(entries) > 0 {
+		if _, err := s.Client.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(s.QueueURL),
+			Entries:  entries,
+		}); err != nil {
+			glog.Errorf("Failed to delete catalog events from %s: %v", s.QueueURL, err)
+		}
+	}
+	return events, nil
+}
+
+func (s SQSCatalogEventSource) parseMessage(body string) []CatalogEvent {
+	var sns snsNotification
+	if err := json.Unmarshal([]byte(body), &sns); err == nil && sns.Type == "Notification" {
+		body = sns.Message
+	}
+	var n s3EventNotification
+	if err := json.Unmarshal([]byte(body), &n); err != nil {
+		glog.Errorf("Ignoring catalog event that is not an S3 event notification: %v", err)
+		return nil
+	}
+	var events []CatalogEvent
+	for _, r := range n.Records {
+		// object keys in S3 event notifications are URL encoded
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			glog.Errorln(err)
+			continue
+		}
+		if r.S3.Bucket.Name != s.Bucket || !strings.HasPrefix(key, s.Prefix) || !strings.HasSuffix(key, s.Suffix) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, s.Prefix), s.Suffix)
+		switch {
+		case strings.HasPrefix(r.EventName, "ObjectCreated:"):
+			events = append(events, CatalogEvent{Name: name})
+		case strings.HasPrefix(r.EventName, "ObjectRemoved:"):
+			events = append(events, CatalogEvent{Name: name, Removed: true})
+		}
+	}
+	return events
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSQS struct {
+	sqsiface.SQSAPI
+	Messages []*sqs.Message
+	Deleted  *[]string
+}
+
+func (m mockSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	return &sqs.ReceiveMessageOutput{Messages: m.Messages}, nil
+}
+
+func (m mockSQS) DeleteMessageBatchWithContext(ctx aws.Context, in *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	for _, e := range in.Entries {
+		*m.Deleted = append(*m.Deleted, aws.StringValue(e.ReceiptHandle))
+	}
+	return &sqs.DeleteMessageBatchOutput{}, nil
+}
+
+const testS3Event = `{"Records": [
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "abucket"}, "object": {"key": "templates/latest/sqs-main.yaml"}}},
+	{"eventName": "ObjectRemoved:Delete", "s3": {"bucket": {"name": "abucket"}, "object": {"key": "templates/latest/my+service-main.yaml"}}},
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "abucket"}, "object": {"key": "templates/latest/sqs-spec.yaml"}}},
+	{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "otherbucket"}, "object": {"key": "templates/latest/sns-main.yaml"}}}
+]}`
+
+func TestSQSCatalogEventSource(t *testing.T) {
+	var deleted []string
+	source := SQSCatalogEventSource{
+		Client: mockSQS{Deleted: &deleted, Messages: []*sqs.Message{
+			{MessageId: aws.String("1"), ReceiptHandle: aws.String("r1"), Body: aws.String(testS3Event)},
+			{MessageId: aws.String("2"), ReceiptHandle: aws.String("r2"), Body: aws.String(`{"Type": "Notification", "Message": "{\"Records\": [{\"eventName\": \"ObjectCreated:Copy\", \"s3\": {\"bucket\": {\"name\": \"abucket\"}, \"object\": {\"key\": \"templates/latest/sns-main.yaml\"}}}]}"}`)},
+			{MessageId: aws.String("3"), ReceiptHandle: aws.String("r3"), Body: aws.String(`{"Service": "Amazon S3", "Event": "s3:TestEvent"}`)},
+			{MessageId: aws.String("4"), ReceiptHandle: aws.String("r4"), Body: aws.String("not json")},
+		}},
+		QueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/templates",
+		Bucket:   "abucket",
+		Prefix:   "templates/latest/",
+		Suffix:   "-main.yaml",
+	}
+	events, err := source.Receive(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []CatalogEvent{
+		{Name: "sqs"},
+		{Name: "my service", Removed: true},
+		{Name: "sns"},
+	}, events)
+	assert.Equal(t, []string{"r1", "r2", "r3", "r4"}, deleted)
+}
+
+func TestConsumeCatalogEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(FakeCatalogEventSource)
+	requests := make(chan CatalogRefreshRequest)
+	go ConsumeCatalogEvents(ctx, events, requests)
+
+	events <- []CatalogEvent{{Name: "sqs"}, {Name: "sns", Removed: true}, {Name: "s3"}}
+	select {
+	case req := <-requests:
+		assert.Equal(t, CatalogRefreshRequest{Trigger: refreshTriggerEvent, Updated: []string{"sqs", "s3"}, Removed: []string{"sns"}}, req)
+	case <-time.After(time.Second):
+		t.Fatal("expected a refresh request")
+	}
+}
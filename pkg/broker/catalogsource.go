@@ -0,0 +1,417 @@
+package broker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+)
+
+// CatalogSource is a location that service templates can be listed and fetched from
+type CatalogSource interface {
+	// ListTemplates returns the name and last modified date of every template in the source
+	ListTemplates() (*[]ServiceLastUpdate, error)
+	// GetTemplate returns the body of a template given the name returned by ListTemplates
+	GetTemplate(name string) ([]byte, error)
+	// TemplateURL returns a URL CloudFormation can fetch a template too large to send inline from, or nil if the
+	// source can't serve templates that large
+	TemplateURL(name string) *string
+}
+
+// NewCatalogSource picks the catalog backend to use based on cli options, a local directory or bundle takes
+// precedence over a catalog URL, which in turn takes precedence over S3
+func NewCatalogSource(o Options, s3svc S3Client, partition string) CatalogSource {
+	switch {
+	case o.CatalogPath != "" && isTarball(o.CatalogPath):
+		glog.Infof("Loading templates from bundle %q", o.CatalogPath)
+		return &TarballCatalogSource{Location: o.CatalogPath, Suffix: o.TemplateFilter}
+	case o.CatalogPath != "":
+		glog.Infof("Loading templates from local directory %q", o.CatalogPath)
+		return LocalCatalogSource{Path: o.CatalogPath, Suffix: o.TemplateFilter}
+	case o.CatalogURL != "" && isTarball(o.CatalogURL):
+		glog.Infof("Loading templates from bundle %q", o.CatalogURL)
+		return &TarballCatalogSource{Location: o.CatalogURL, Suffix: o.TemplateFilter}
+	case o.CatalogURL != "":
+		glog.Infof("Loading templates from index %q", o.CatalogURL)
+		return &HTTPCatalogSource{IndexURL: o.CatalogURL}
+	}
+	prefix := o.S3Key
+	if prefix != "" {
+		prefix = addTrailingSlash(prefix)
+	}
+	return S3CatalogSource{
+		Client:    s3svc,
+		Bucket:    o.S3Bucket,
+		Prefix:    prefix,
+		Suffix:    o.TemplateFilter,
+		Region:    o.S3Region,
+		Partition: partition,
+	}
+}
+
+func isTarball(location string) bool {
+	if u, err := url.Parse(location); err == nil && u.Path != "" {
+		location = u.Path
+	}
+	return strings.HasSuffix(location, ".tar.gz") || strings.HasSuffix(location, ".tgz")
+}
+
+// S3CatalogSource lists and fetches templates from an S3 bucket
+type S3CatalogSource struct {
+	Client    S3Client
+	Bucket    string
+	Prefix    string
+	Suffix    string
+	Region    string
+	Partition string
+}
+
+// ListTemplates lists all objects under the prefix matching the suffix, following pagination for buckets with
+// more than 1000 objects
+func (s S3CatalogSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.Infoln("Listing objects bucket: " + s.Bucket + " region: " + s.Region + " prefix: " + s.Prefix)
+	l := make([]ServiceLastUpdate, 0)
+	err := s.Client.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, s3obj := range page.Contents {
+			if strings.HasSuffix(*s3obj.Key, s.Suffix) {
+				l = append(l, ServiceLastUpdate{
+					Name: strings.TrimSuffix(strings.TrimPrefix(*s3obj.Key, s.Prefix), s.Suffix),
+					Date: *s3obj.LastModified,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			fmt.Fprintf(os.Stderr, "upload canceled due to timeout, %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "failed to list objects, %v\n", err)
+		}
+		return nil, err
+	}
+	glog.Infof("Found %d objects\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate fetches a template object from the bucket
+func (s S3CatalogSource) GetTemplate(name string) ([]byte, error) {
+	return getObjectBody(s.Client, s.Bucket, s.Prefix+name+s.Suffix)
+}
+
+// TemplateURL returns the partition specific https URL of the template object
+func (s S3CatalogSource) TemplateURL(name string) *string {
+	objKey := s.Prefix + strings.TrimSuffix(name, "-apb") + s.Suffix
+	if s.Partition == "aws-cn" {
+		// AWS China Partition
+		return aws.String(fmt.Sprintf("https://%s.s3.%s.amazonaws.com.cn/%s", s.Bucket, s.Region, objKey))
+	}
+	// AWS Standard Partition and GovCloud Partition
+	objURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.Bucket, objKey)
+	if s.Region != "us-east-1" {
+		objURL = fmt.Sprintf("https://%s.s3-%s.amazonaws.com/%s", s.Bucket, s.Region, objKey)
+	}
+	return aws.String(objURL)
+}
+
+// CatalogIndex is the document served by an HTTP catalog, template URLs may be relative to the index
+type CatalogIndex struct {
+	Templates []CatalogIndexEntry `json:"templates"`
+}
+
+// CatalogIndexEntry describes a single template in a CatalogIndex
+type CatalogIndexEntry struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// HTTPCatalogSource loads templates listed in an index.json served over HTTP(S)
+type HTTPCatalogSource struct {
+	IndexURL string
+	Client   *http.Client
+
+	mu   sync.Mutex
+	urls map[string]string
+}
+
+// ListTemplates fetches the index and records the location of every template in it
+func (s *HTTPCatalogSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.Infoln("Fetching catalog index: " + s.IndexURL)
+	body, header, err := httpGet(s.client(), s.IndexURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var index CatalogIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog index %s: %v", s.IndexURL, err)
+	}
+	base, err := url.Parse(s.IndexURL)
+	if err != nil {
+		return nil, err
+	}
+	// entries without a lastModified date are considered as old as the index itself
+	indexDate, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		indexDate = time.Now()
+	}
+	urls := make(map[string]string)
+	l := make([]ServiceLastUpdate, 0, len(index.Templates))
+	for _, t := range index.Templates {
+		if t.Name == "" || t.URL == "" {
+			glog.Errorf("Skipping catalog index entry without a name or url: %+v", t)
+			continue
+		}
+		ref, err := url.Parse(t.URL)
+		if err != nil {
+			glog.Errorf("Skipping catalog index entry %q: %v", t.Name, err)
+			continue
+		}
+		urls[t.Name] = base.ResolveReference(ref).String()
+		date := t.LastModified
+		if date.IsZero() {
+			date = indexDate
+		}
+		l = append(l, ServiceLastUpdate{Name: t.Name, Date: date})
+	}
+	s.mu.Lock()
+	s.urls = urls
+	s.mu.Unlock()
+	glog.Infof("Found %d templates\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate downloads a template using the URL from the most recently fetched index
+func (s *HTTPCatalogSource) GetTemplate(name string) ([]byte, error) {
+	s.mu.Lock()
+	u, ok := s.urls[name]
+	s.mu.Unlock()
+	if !ok {
+		if _, err := s.ListTemplates(); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		u, ok = s.urls[name]
+		s.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("template %q not found in catalog index %s", name, s.IndexURL)
+		}
+	}
+	body, _, err := httpGet(s.client(), u, nil)
+	return body, err
+}
+
+// TemplateURL always returns nil, as index URLs are not guaranteed to be reachable by CloudFormation
+func (s *HTTPCatalogSource) TemplateURL(name string) *string {
+	return nil
+}
+
+func (s *HTTPCatalogSource) client() *http.Client {
+	if s.Client == nil {
+		return &http.Client{Timeout: CatalogHTTPTimeout}
+	}
+	return s.Client
+}
+
+// TarballCatalogSource loads templates from a versioned .tar.gz bundle, either on the local filesystem or
+// served over HTTP(S). The bundle is only downloaded again when it has changed
+type TarballCatalogSource struct {
+	Location string
+	Suffix   string
+	Client   *http.Client
+
+	mu        sync.Mutex
+	etag      string
+	modified  time.Time
+	version   string
+	templates map[string]tarballTemplate
+}
+
+type tarballTemplate struct {
+	body []byte
+	date time.Time
+}
+
+// ListTemplates refreshes the bundle and lists the templates in it matching the suffix
+func (s *TarballCatalogSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	l := make([]ServiceLastUpdate, 0, len(s.templates))
+	for name, t := range s.templates {
+		l = append(l, ServiceLastUpdate{Name: name, Date: t.date})
+	}
+	glog.Infof("Found %d templates in bundle version %q\n", len(l), s.version)
+	return &l, nil
+}
+
+// GetTemplate returns a template from the most recently loaded bundle
+func (s *TarballCatalogSource) GetTemplate(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.templates == nil {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	t, ok := s.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("template %q not found in bundle %s", name, s.Location)
+	}
+	return t.body, nil
+}
+
+// TemplateURL always returns nil, templates from a bundle are sent inline
+func (s *TarballCatalogSource) TemplateURL(name string) *string {
+	return nil
+}
+
+// Version returns the version of the loaded bundle, taken from a VERSION file in the bundle or, if there is none,
+// the bundle file name
+func (s *TarballCatalogSource) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+func (s *TarballCatalogSource) refresh() error {
+	var data []byte
+	u, err := url.Parse(s.Location)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		headers := map[string]string{}
+		if s.etag != "" {
+			headers["If-None-Match"] = s.etag
+		}
+		client := s.Client
+		if client == nil {
+			client = &http.Client{Timeout: CatalogHTTPTimeout}
+		}
+		body, header, err := httpGet(client, s.Location, headers)
+		if err == errNotModified {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		s.etag = header.Get("ETag")
+		data = body
+	} else {
+		p := s.Location
+		if err == nil && u.Scheme == "file" {
+			p = u.Path
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if s.templates != nil && info.ModTime().Equal(s.modified) {
+			return nil
+		}
+		s.modified = info.ModTime()
+		if data, err = ioutil.ReadFile(p); err != nil {
+			return err
+		}
+	}
+	templates, version, err := readTarball(data, s.Suffix)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle %s: %v", s.Location, err)
+	}
+	if version == "" {
+		version = strings.TrimSuffix(strings.TrimSuffix(path.Base(s.Location), ".tgz"), ".tar.gz")
+	}
+	glog.Infof("Loaded bundle %s version %q", s.Location, version)
+	s.templates = templates
+	s.version = version
+	return nil
+}
+
+// readTarball extracts all regular files ending in suffix from a gzipped tarball, directories within the bundle
+// are ignored when naming templates
+func readTarball(data []byte, suffix string) (map[string]tarballTemplate, string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	templates := make(map[string]tarballTemplate)
+	version := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Base(hdr.Name)
+		if name == "VERSION" {
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, "", err
+			}
+			version = strings.TrimSpace(string(b))
+			continue
+		}
+		if !strings.HasSuffix(name, suffix) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, "", err
+		}
+		templates[strings.TrimSuffix(name, suffix)] = tarballTemplate{body: b, date: hdr.ModTime}
+	}
+	return templates, version, nil
+}
+
+var errNotModified = fmt.Errorf("not modified")
+
+// httpGet fetches a URL returning the body and headers, a 304 response returns errNotModified
+func httpGet(client *http.Client, u string, headers map[string]string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp.Header, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to fetch %s: %s", u, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Header, nil
+}
@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockS3Pages struct {
+	s3iface.S3API
+	Pages []s3.ListObjectsV2Output
+}
+
+func (m mockS3Pages) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	for i := range m.Pages {
+		if !fn(&m.Pages[i], i == len(m.Pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func testTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), ModTime: time.Unix(1534286873, 0), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewCatalogSource(t *testing.T) {
+	o := Options{S3Bucket: "abucket", S3Key: "templates/latest", S3Region: "us-west-2", TemplateFilter: "-main.yaml"}
+	source := NewCatalogSource(o, S3Client{}, "aws")
+	assert.Equal(t, "templates/latest/", source.(S3CatalogSource).Prefix)
+
+	o.CatalogURL = "https://example.com/catalog/index.json"
+	assert.IsType(t, &HTTPCatalogSource{}, NewCatalogSource(o, S3Client{}, "aws"))
+
+	o.CatalogURL = "https://example.com/catalog-1.2.0.tar.gz?token=abc"
+	assert.IsType(t, &TarballCatalogSource{}, NewCatalogSource(o, S3Client{}, "aws"))
+
+	o.CatalogPath = "/etc/templates"
+	assert.IsType(t, LocalCatalogSource{}, NewCatalogSource(o, S3Client{}, "aws"))
+
+	o.CatalogPath = "/etc/bundles/catalog.tgz"
+	assert.IsType(t, &TarballCatalogSource{}, NewCatalogSource(o, S3Client{}, "aws"))
+}
+
+func TestS3CatalogSource(t *testing.T) {
+	date := time.Unix(1534286873, 0)
+	source := S3CatalogSource{
+		Client: S3Client{Client: mockS3Pages{Pages: []s3.ListObjectsV2Output{
+			{Contents: []*s3.Object{
+				{Key: aws.String("templates/latest/sqs-main.yaml"), LastModified: &date},
+				{Key: aws.String("templates/latest/sqs-spec.yaml"), LastModified: &date},
+			}},
+			{Contents: []*s3.Object{
+				{Key: aws.String("templates/latest/sns-main.yaml"), LastModified: &date},
+			}},
+		}}},
+		Bucket: "abucket",
+		Prefix: "templates/latest/",
+		Suffix: "-main.yaml",
+		Region: "us-east-1",
+	}
+	l, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.Equal(t, []ServiceLastUpdate{{Name: "sqs", Date: date}, {Name: "sns", Date: date}}, *l)
+
+	assert.Equal(t, "https://abucket.s3.amazonaws.com/templates/latest/sqs-main.yaml", *source.TemplateURL("sqs-apb"))
+	source.Region = "us-west-2"
+	assert.Equal(t, "https://abucket.s3-us-west-2.amazonaws.com/templates/latest/sqs-main.yaml", *source.TemplateURL("sqs"))
+	source.Region = "cn-north-1"
+	source.Partition = "aws-cn"
+	assert.Equal(t, "https://abucket.s3.cn-north-1.amazonaws.com.cn/templates/latest/sqs-main.yaml", *source.TemplateURL("sqs"))
+}
+
+func TestHTTPCatalogSource(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/catalog/index.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"templates": [
+			{"name": "localtest", "url": "templates/localtest-main.yaml", "lastModified": "2018-08-14T22:47:53Z"},
+			{"name": "nodate", "url": "/other/nodate.yaml"},
+			{"name": "", "url": "ignored.yaml"}
+		]}`))
+	})
+	mux.HandleFunc("/catalog/templates/localtest-main.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testLocalTemplate))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	source := &HTTPCatalogSource{IndexURL: server.URL + "/catalog/index.json"}
+	l, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.Len(t, *l, 2)
+	assert.Equal(t, "localtest", (*l)[0].Name)
+	assert.Equal(t, time.Date(2018, 8, 14, 22, 47, 53, 0, time.UTC), (*l)[0].Date)
+	assert.False(t, (*l)[1].Date.IsZero())
+
+	body, err := source.GetTemplate("localtest")
+	assert.NoError(t, err)
+	assert.Equal(t, testLocalTemplate, string(body))
+	assert.Nil(t, source.TemplateURL("localtest"))
+
+	_, err = source.GetTemplate("nodate")
+	assert.EqualError(t, err, "failed to fetch "+server.URL+"/other/nodate.yaml: 404 Not Found")
+
+	_, err = source.GetTemplate("missing")
+	assert.Error(t, err)
+
+	_, err = (&HTTPCatalogSource{IndexURL: server.URL + "/missing.json"}).ListTemplates()
+	assert.Error(t, err)
+}
+
+func TestTarballCatalogSource(t *testing.T) {
+	bundle := testTarball(t, map[string]string{
+		"catalog/VERSION":             "1.2.0\n",
+		"catalog/localtest-main.yaml": testLocalTemplate,
+		"catalog/README.md":           "not a template",
+	})
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(bundle)
+	}))
+	defer server.Close()
+
+	source := &TarballCatalogSource{Location: server.URL + "/catalog.tar.gz", Suffix: "-main.yaml"}
+	l, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.Equal(t, []ServiceLastUpdate{{Name: "localtest", Date: time.Unix(1534286873, 0)}}, *l)
+	assert.Equal(t, "1.2.0", source.Version())
+
+	_, err = source.ListTemplates()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, downloads, "unchanged bundles should not be downloaded again")
+
+	body, err := source.GetTemplate("localtest")
+	assert.NoError(t, err)
+	assert.Equal(t, testLocalTemplate, string(body))
+	assert.Nil(t, source.TemplateURL("localtest"))
+
+	_, err = source.GetTemplate("README")
+	assert.Error(t, err)
+
+	// local bundles without a VERSION file are versioned by file name
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "catalog-1.3.0.tgz", string(testTarball(t, map[string]string{
+		"localtest-main.yaml": testLocalTemplate,
+		"other-main.yaml":     testLocalTemplate,
+	})))
+	local := &TarballCatalogSource{Location: filepath.Join(dir, "catalog-1.3.0.tgz"), Suffix: "-main.yaml"}
+	l, err = local.ListTemplates()
+	assert.NoError(t, err)
+	var names []string
+	for _, item := range *l {
+		names = append(names, item.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"localtest", "other"}, names)
+	assert.Equal(t, "catalog-1.3.0", local.Version())
+
+	writeTestTemplate(t, dir, "broken.tar.gz", "not a tarball")
+	_, err = (&TarballCatalogSource{Location: filepath.Join(dir, "broken.tar.gz"), Suffix: "-main.yaml"}).ListTemplates()
+	assert.Error(t, err)
+}
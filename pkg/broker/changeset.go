@@ -0,0 +1,293 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	uuid "github.com/satori/go.uuid"
+)
+
+// getCapabilities returns the capabilities stacks of the service are created and updated with
+func getCapabilities(service *osb.Service) []string {
+	capabilities := []string{cloudformation.CapabilityCapabilityNamedIam}
+	for _, c := range toStringSlice(service.Metadata["capabilities"]) {
+		if !stringInSlice(c, capabilities) {
+			capabilities = append(capabilities, c)
+		}
+	}
+	return capabilities
+}
+
+// usesTransform returns true if the service's template uses transforms, so its stacks must be created and updated
+// with change sets
+func usesTransform(service *osb.Service) bool {
+	return service.Metadata["transform"] == true
+}
+
+// getProtectedResources returns the logical IDs of the resources of the service's template that updates must not
+// replace
+func getProtectedResources(service *osb.Service) []string {
+	return toStringSlice(service.Metadata["protectedResources"])
+}
+
+// createStackWithChangeSet creates a stack by creating and executing a change set, returning the stack's ID. Change
+// sets don't support a timeout or deleting the stack on failure, the other stack options are applied separately
+func createStackWithChangeSet(cfnSvc CfnClient, input *cloudformation.CreateStackInput) (string, error) {
+	out, err := cfnSvc.Client.CreateChangeSet(&cloudformation.CreateChangeSetInput{
+		Capabilities:     input.Capabilities,
+		ChangeSetName:    aws.String(newChangeSetName()),
+		ChangeSetType:    aws.String(cloudformation.ChangeSetTypeCreate),
+		NotificationARNs: input.NotificationARNs,
+		Parameters:       input.Parameters,
+		RoleARN:          input.RoleARN,
+		StackName:        input.StackName,
+		Tags:             input.Tags,
+		TemplateBody:     input.TemplateBody,
+		TemplateURL:      input.TemplateURL,
+	})
+	if err != nil {
+		return "", err
+	}
+	stackID := aws.StringValue(out.StackId)
+	if err := executeCreateChangeSet(cfnSvc, input, stackID, out.Id); err != nil {
+		// Nothing has been created until the change set is executed, the stack is left in REVIEW_IN_PROGRESS
+		if err := deleteStackInput(cfnSvc, &cloudformation.DeleteStackInput{RoleARN: input.RoleARN, StackName: aws.String(stackID)}); err != nil {
+			glog.Errorf("Failed to delete the CloudFormation stack %s: %v", stackID, err)
+		}
+		return "", err
+	}
+	return stackID, nil
+}
+
+func executeCreateChangeSet(cfnSvc CfnClient, input *cloudformation.CreateStackInput, stackID string, changeSetID *string) error {
+	if err := waitForChangeSet(cfnSvc, changeSetID); err != nil {
+		return err
+	}
+	if input.StackPolicyBody != nil {
+		if _, err := cfnSvc.Client.SetStackPolicy(&cloudformation.SetStackPolicyInput{StackName: aws.String(stackID), StackPolicyBody: input.StackPolicyBody}); err != nil {
+			return err
+		}
+	}
+	if aws.BoolValue(input.EnableTerminationProtection) {
+		if _, err := cfnSvc.Client.UpdateTerminationProtection(&cloudformation.UpdateTerminationProtectionInput{EnableTerminationProtection: aws.Bool(true), StackName: aws.String(stackID)}); err != nil {
+			return err
+		}
+	}
+	_, err := cfnSvc.Client.ExecuteChangeSet(&cloudformation.ExecuteChangeSetInput{
+		ChangeSetName:   changeSetID,
+		DisableRollback: aws.Bool(aws.StringValue(input.OnFailure) == cloudformation.OnFailureDoNothing),
+	})
+	return err
+}
+
+// updateStackWithChangeSet updates a stack by creating and executing a change set. Like UpdateStack, it returns a
+// "No updates are to be performed" error if the stack wouldn't change. The change set isn't executed, and a
+// protectedReplacementError is returned, if it would replace any of the protected resources. Protected resources that
+// may be replaced only log a warning. The change set is deleted if it isn't executed
+func updateStackWithChangeSet(cfnSvc CfnClient, input *cloudformation.UpdateStackInput, protected []string) error {
+	changeSetID, err := createUpdateChangeSet(cfnSvc, input)
+	if err != nil {
+		return err
+	}
+	if len(protected) > 0 {
+		changes, err := describeChangeSetChanges(cfnSvc, changeSetID)
+		if err == nil {
+			preview := getUpdatePreview(changes, protected)
+			if len(preview.Protected) > 0 {
+				err = protectedReplacementError{resources: preview.Protected}
+			} else if len(preview.ConditionallyProtected) > 0 {
+				glog.Warningf("Updating the CloudFormation stack %s may replace the protected resources %s", aws.StringValue(input.StackName), strings.Join(preview.ConditionallyProtected, ", "))
+			}
+		}
+		if err != nil {
+			deleteChangeSet(cfnSvc, changeSetID)
+			return err
+		}
+	}
+	if input.StackPolicyBody != nil {
+		if _, err := cfnSvc.Client.SetStackPolicy(&cloudformation.SetStackPolicyInput{StackName: input.StackName, StackPolicyBody: input.StackPolicyBody}); err != nil {
+			deleteChangeSet(cfnSvc, changeSetID)
+			return err
+		}
+	}
+	if _, err := cfnSvc.Client.ExecuteChangeSet(&cloudformation.ExecuteChangeSetInput{ChangeSetName: changeSetID}); err != nil {
+		deleteChangeSet(cfnSvc, changeSetID)
+		return err
+	}
+	return nil
+}
+
+// previewStackUpdate creates a change set for a stack update and summarizes its changes, without executing it
+func previewStackUpdate(cfnSvc CfnClient, input *cloudformation.UpdateStackInput, protected []string) (*UpdatePreview, error) {
+	changeSetID, err := createUpdateChangeSet(cfnSvc, input)
+	if isNoUpdatesError(err) {
+		return getUpdatePreview(nil, protected), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer deleteChangeSet(cfnSvc, changeSetID)
+	changes, err := describeChangeSetChanges(cfnSvc, changeSetID)
+	if err != nil {
+		return nil, err
+	}
+	return getUpdatePreview(changes, protected), nil
+}
+
+// createUpdateChangeSet creates a change set for a stack update and waits until it can be executed, returning its ID.
+// The change set is deleted if it can't be created
+func createUpdateChangeSet(cfnSvc CfnClient, input *cloudformation.UpdateStackInput) (*string, error) {
+	out, err := cfnSvc.Client.CreateChangeSet(&cloudformation.CreateChangeSetInput{
+		Capabilities:        input.Capabilities,
+		ChangeSetName:       aws.String(newChangeSetName()),
+		ChangeSetType:       aws.String(cloudformation.ChangeSetTypeUpdate),
+		NotificationARNs:    input.NotificationARNs,
+		Parameters:          input.Parameters,
+		RoleARN:             input.RoleARN,
+		StackName:           input.StackName,
+		Tags:                input.Tags,
+		TemplateBody:        input.TemplateBody,
+		TemplateURL:         input.TemplateURL,
+		UsePreviousTemplate: input.UsePreviousTemplate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := waitForChangeSet(cfnSvc, out.Id); err != nil {
+		deleteChangeSet(cfnSvc, out.Id)
+		return nil, err
+	}
+	return out.Id, nil
+}
+
+func deleteChangeSet(cfnSvc CfnClient, changeSetID *string) {
+	if _, err := cfnSvc.Client.DeleteChangeSet(&cloudformation.DeleteChangeSetInput{ChangeSetName: changeSetID}); err != nil {
+		glog.Errorf("Failed to delete the CloudFormation change set %s: %v", aws.StringValue(changeSetID), err)
+	}
+}
+
+// describeChangeSetChanges returns all the changes of a change set
+func describeChangeSetChanges(cfnSvc CfnClient, changeSetID *string) ([]*cloudformation.Change, error) {
+	var changes []*cloudformation.Change
+	input := &cloudformation.DescribeChangeSetInput{ChangeSetName: changeSetID}
+	for {
+		out, err := cfnSvc.Client.DescribeChangeSet(input)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, out.Changes...)
+		if aws.StringValue(out.NextToken) == "" {
+			return changes, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// waitForChangeSet waits until a change set has been created and can be executed
+func waitForChangeSet(cfnSvc CfnClient, changeSetID *string) error {
+	timeout := time.After(ChangeSetTimeout)
+	for {
+		out, err := cfnSvc.Client.DescribeChangeSet(&cloudformation.DescribeChangeSetInput{ChangeSetName: changeSetID})
+		if err != nil {
+			return err
+		}
+		switch aws.StringValue(out.Status) {
+		case cloudformation.ChangeSetStatusCreateComplete:
+			return nil
+		case cloudformation.ChangeSetStatusFailed:
+			reason := aws.StringValue(out.StatusReason)
+			if strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed") {
+				return awserr.New("ValidationError", "No updates are to be performed.", nil)
+			}
+			return fmt.Errorf("change set %s failed: %s", aws.StringValue(changeSetID), reason)
+		}
+
+		select {
+		case <-timeout:
+			return fmt.Errorf("change set %s was not created within %v, try again later", aws.StringValue(changeSetID), ChangeSetTimeout)
+		case <-time.After(ChangeSetPollInterval):
+		}
+	}
+}
+
+func newChangeSetName() string {
+	return "aws-service-broker-" + uuid.NewV4().String()
+}
+
+// UpdatePreview summarizes the changes an update would make to the resources of an instance's stack
+type UpdatePreview struct {
+	Add     []ResourceChange `json:"add"`
+	Modify  []ResourceChange `json:"modify"`
+	Replace []ResourceChange `json:"replace"`
+	Remove  []ResourceChange `json:"remove"`
+	// Protected are the logical IDs of the protected resources that would be replaced, which blocks the update
+	Protected []string `json:"protected,omitempty"`
+	// ConditionallyProtected are the logical IDs of the protected resources that may be replaced, depending on values
+	// CloudFormation only knows during the update. They don't block the update, a StackPolicy denying Update:Replace
+	// protects them
+	ConditionallyProtected []string `json:"conditionally_protected,omitempty"`
+}
+
+// ResourceChange is a resource an update would change. Replacement is "Conditional" for modified resources that may
+// be replaced depending on the values of other resources
+type ResourceChange struct {
+	LogicalResourceID string `json:"logical_resource_id"`
+	ResourceType      string `json:"resource_type"`
+	Replacement       string `json:"replacement,omitempty"`
+}
+
+// getUpdatePreview summarizes a change set's changes
+func getUpdatePreview(changes []*cloudformation.Change, protected []string) *UpdatePreview {
+	preview := &UpdatePreview{
+		Add:     []ResourceChange{},
+		Modify:  []ResourceChange{},
+		Replace: []ResourceChange{},
+		Remove:  []ResourceChange{},
+	}
+	for _, c := range changes {
+		if c.ResourceChange == nil {
+			continue
+		}
+		rc := ResourceChange{
+			LogicalResourceID: aws.StringValue(c.ResourceChange.LogicalResourceId),
+			ResourceType:      aws.StringValue(c.ResourceChange.ResourceType),
+		}
+		switch aws.StringValue(c.ResourceChange.Action) {
+		case cloudformation.ChangeActionAdd:
+			preview.Add = append(preview.Add, rc)
+		case cloudformation.ChangeActionRemove:
+			preview.Remove = append(preview.Remove, rc)
+		case cloudformation.ChangeActionModify:
+			switch replacement := aws.StringValue(c.ResourceChange.Replacement); replacement {
+			case cloudformation.ReplacementTrue:
+				preview.Replace = append(preview.Replace, rc)
+				if stringInSlice(rc.LogicalResourceID, protected) {
+					preview.Protected = append(preview.Protected, rc.LogicalResourceID)
+				}
+			case cloudformation.ReplacementConditional:
+				rc.Replacement = replacement
+				preview.Modify = append(preview.Modify, rc)
+				if stringInSlice(rc.LogicalResourceID, protected) {
+					preview.ConditionallyProtected = append(preview.ConditionallyProtected, rc.LogicalResourceID)
+				}
+			default:
+				preview.Modify = append(preview.Modify, rc)
+			}
+		}
+	}
+	return preview
+}
+
+// protectedReplacementError is returned when an update would replace protected resources
+type protectedReplacementError struct {
+	resources []string
+}
+
+func (e protectedReplacementError) Error() string {
+	return fmt.Sprintf("the update would replace the protected resources %s", strings.Join(e.resources, ", "))
+}
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockCfnChangeSet creates change sets with the given status and records the calls made
+type mockCfnChangeSet struct {
+	mockCfn
+	status  string
+	reason  string
+	changes []*cloudformation.Change
+	calls   []string
+	create  *cloudformation.CreateChangeSetInput
+	// fail is the call that returns an error
+	fail string
+}
+
+func (m *mockCfnChangeSet) CreateChangeSet(in *cloudformation.CreateChangeSetInput) (*cloudformation.CreateChangeSetOutput, error) {
+	m.calls = append(m.calls, "CreateChangeSet")
+	m.create = in
+	return &cloudformation.CreateChangeSetOutput{Id: aws.String("change-set-id"), StackId: aws.String("stack-id")}, nil
+}
+
+func (m *mockCfnChangeSet) DescribeChangeSet(in *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	return &cloudformation.DescribeChangeSetOutput{Changes: m.changes, Status: aws.String(m.status), StatusReason: aws.String(m.reason)}, nil
+}
+
+func (m *mockCfnChangeSet) ExecuteChangeSet(in *cloudformation.ExecuteChangeSetInput) (*cloudformation.ExecuteChangeSetOutput, error) {
+	m.calls = append(m.calls, "ExecuteChangeSet")
+	if m.fail == "ExecuteChangeSet" {
+		return nil, errors.New("execute failed")
+	}
+	return &cloudformation.ExecuteChangeSetOutput{}, nil
+}
+
+func (m *mockCfnChangeSet) DeleteChangeSet(in *cloudformation.DeleteChangeSetInput) (*cloudformation.DeleteChangeSetOutput, error) {
+	m.calls = append(m.calls, "DeleteChangeSet")
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+
+func (m *mockCfnChangeSet) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	m.calls = append(m.calls, "DeleteStack")
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+func (m *mockCfnChangeSet) SetStackPolicy(in *cloudformation.SetStackPolicyInput) (*cloudformation.SetStackPolicyOutput, error) {
+	m.calls = append(m.calls, "SetStackPolicy")
+	if m.fail == "SetStackPolicy" {
+		return nil, errors.New("set stack policy failed")
+	}
+	return &cloudformation.SetStackPolicyOutput{}, nil
+}
+
+func (m *mockCfnChangeSet) UpdateTerminationProtection(in *cloudformation.UpdateTerminationProtectionInput) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	m.calls = append(m.calls, "UpdateTerminationProtection")
+	return &cloudformation.UpdateTerminationProtectionOutput{}, nil
+}
+
+func TestGetCapabilities(t *testing.T) {
+	assert.Equal(t, []string{"CAPABILITY_NAMED_IAM"}, getCapabilities(&osb.Service{}))
+	service := &osb.Service{Metadata: map[string]interface{}{"capabilities": []interface{}{"CAPABILITY_NAMED_IAM", "CAPABILITY_AUTO_EXPAND"}}}
+	assert.Equal(t, []string{"CAPABILITY_NAMED_IAM", "CAPABILITY_AUTO_EXPAND"}, getCapabilities(service))
+}
+
+func TestCreateStackWithChangeSet(t *testing.T) {
+	assert := assert.New(t)
+	input := &cloudformation.CreateStackInput{
+		Capabilities:                aws.StringSlice([]string{"CAPABILITY_AUTO_EXPAND"}),
+		EnableTerminationProtection: aws.Bool(true),
+		StackName:                   aws.String("stack"),
+		StackPolicyBody:             aws.String(`{"Statement":[]}`),
+		TemplateURL:                 aws.String("https://example.com/template.yaml"),
+	}
+
+	m := &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete}
+	stackID, err := createStackWithChangeSet(CfnClient{m}, input)
+	assert.NoError(err)
+	assert.Equal("stack-id", stackID)
+	assert.Equal([]string{"CreateChangeSet", "SetStackPolicy", "UpdateTerminationProtection", "ExecuteChangeSet"}, m.calls)
+	assert.Equal(cloudformation.ChangeSetTypeCreate, aws.StringValue(m.create.ChangeSetType))
+	assert.Equal(input.Capabilities, m.create.Capabilities)
+	assert.Equal(input.TemplateURL, m.create.TemplateURL)
+
+	// the empty stack is deleted if the change set can't be created
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusFailed, reason: "Transform failed"}
+	_, err = createStackWithChangeSet(CfnClient{m}, input)
+	assert.EqualError(err, "change set change-set-id failed: Transform failed")
+	assert.Equal([]string{"CreateChangeSet", "DeleteStack"}, m.calls)
+}
+
+func TestUpdateStackWithChangeSet(t *testing.T) {
+	assert := assert.New(t)
+	input := &cloudformation.UpdateStackInput{StackName: aws.String("stack"), UsePreviousTemplate: aws.Bool(true)}
+
+	m := &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete}
+	assert.NoError(updateStackWithChangeSet(CfnClient{m}, input, nil))
+	assert.Equal([]string{"CreateChangeSet", "ExecuteChangeSet"}, m.calls)
+	assert.Equal(cloudformation.ChangeSetTypeUpdate, aws.StringValue(m.create.ChangeSetType))
+	assert.True(aws.BoolValue(m.create.UsePreviousTemplate))
+
+	// a change set without changes is reported like UpdateStack reports it
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusFailed, reason: "The submitted information didn't contain changes. Submit different information to create a change set."}
+	err := updateStackWithChangeSet(CfnClient{m}, input, nil)
+	assert.True(isNoUpdatesError(err))
+	assert.Equal([]string{"CreateChangeSet", "DeleteChangeSet"}, m.calls)
+
+	// the change set is deleted if it can't be executed
+	input.StackPolicyBody = aws.String(`{"Statement":[]}`)
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, fail: "SetStackPolicy"}
+	assert.EqualError(updateStackWithChangeSet(CfnClient{m}, input, nil), "set stack policy failed")
+	assert.Equal([]string{"CreateChangeSet", "SetStackPolicy", "DeleteChangeSet"}, m.calls)
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, fail: "ExecuteChangeSet"}
+	assert.EqualError(updateStackWithChangeSet(CfnClient{m}, input, nil), "execute failed")
+	assert.Equal([]string{"CreateChangeSet", "SetStackPolicy", "ExecuteChangeSet", "DeleteChangeSet"}, m.calls)
+}
+
+func TestWaitForChangeSetTimeout(t *testing.T) {
+	assert := assert.New(t)
+	defer func(interval, timeout time.Duration) { ChangeSetPollInterval, ChangeSetTimeout = interval, timeout }(ChangeSetPollInterval, ChangeSetTimeout)
+	ChangeSetPollInterval, ChangeSetTimeout = time.Millisecond, 10*time.Millisecond
+	input := &cloudformation.UpdateStackInput{StackName: aws.String("stack"), UsePreviousTemplate: aws.Bool(true)}
+
+	// the request fails rather than waiting for a change set that isn't ready
+	m := &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateInProgress}
+	err := updateStackWithChangeSet(CfnClient{m}, input, nil)
+	assert.EqualError(err, "change set change-set-id was not created within 10ms, try again later")
+	assert.Equal([]string{"CreateChangeSet", "DeleteChangeSet"}, m.calls)
+}
+
+func newResourceChange(id, resourceType, action, replacement string) *cloudformation.Change {
+	return &cloudformation.Change{ResourceChange: &cloudformation.ResourceChange{
+		Action:            aws.String(action),
+		LogicalResourceId: aws.String(id),
+		Replacement:       aws.String(replacement),
+		ResourceType:      aws.String(resourceType),
+	}}
+}
+
+var testChanges = []*cloudformation.Change{
+	newResourceChange("Alarm", "AWS::CloudWatch::Alarm", cloudformation.ChangeActionAdd, ""),
+	newResourceChange("Database", "AWS::RDS::DBInstance", cloudformation.ChangeActionModify, cloudformation.ReplacementTrue),
+	newResourceChange("ParameterGroup", "AWS::RDS::DBParameterGroup", cloudformation.ChangeActionModify, cloudformation.ReplacementConditional),
+	newResourceChange("SecurityGroup", "AWS::EC2::SecurityGroup", cloudformation.ChangeActionModify, cloudformation.ReplacementFalse),
+	newResourceChange("Topic", "AWS::SNS::Topic", cloudformation.ChangeActionRemove, ""),
+}
+
+func TestGetUpdatePreview(t *testing.T) {
+	assert.Equal(t, &UpdatePreview{
+		Add: []ResourceChange{{LogicalResourceID: "Alarm", ResourceType: "AWS::CloudWatch::Alarm"}},
+		Modify: []ResourceChange{
+			{LogicalResourceID: "ParameterGroup", ResourceType: "AWS::RDS::DBParameterGroup", Replacement: "Conditional"},
+			{LogicalResourceID: "SecurityGroup", ResourceType: "AWS::EC2::SecurityGroup"},
+		},
+		Replace:                []ResourceChange{{LogicalResourceID: "Database", ResourceType: "AWS::RDS::DBInstance"}},
+		Remove:                 []ResourceChange{{LogicalResourceID: "Topic", ResourceType: "AWS::SNS::Topic"}},
+		Protected:              []string{"Database"},
+		ConditionallyProtected: []string{"ParameterGroup"},
+	}, getUpdatePreview(testChanges, []string{"Database", "ParameterGroup", "Topic"}))
+}
+
+func TestUpdateStackWithChangeSetProtected(t *testing.T) {
+	assert := assert.New(t)
+	input := &cloudformation.UpdateStackInput{StackName: aws.String("stack"), UsePreviousTemplate: aws.Bool(true)}
+
+	m := &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, changes: testChanges}
+	assert.NoError(updateStackWithChangeSet(CfnClient{m}, input, []string{"SecurityGroup"}))
+	assert.Equal([]string{"CreateChangeSet", "ExecuteChangeSet"}, m.calls)
+
+	// resources that may be replaced aren't blocked
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, changes: testChanges}
+	assert.NoError(updateStackWithChangeSet(CfnClient{m}, input, []string{"ParameterGroup"}))
+	assert.Equal([]string{"CreateChangeSet", "ExecuteChangeSet"}, m.calls)
+
+	// the change set isn't executed if it replaces a protected resource
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, changes: testChanges}
+	err := updateStackWithChangeSet(CfnClient{m}, input, []string{"Database"})
+	assert.Equal(protectedReplacementError{resources: []string{"Database"}}, err)
+	assert.Equal([]string{"CreateChangeSet", "DeleteChangeSet"}, m.calls)
+}
+
+func TestPreviewStackUpdate(t *testing.T) {
+	assert := assert.New(t)
+	input := &cloudformation.UpdateStackInput{StackName: aws.String("stack"), UsePreviousTemplate: aws.Bool(true)}
+
+	m := &mockCfnChangeSet{status: cloudformation.ChangeSetStatusCreateComplete, changes: testChanges}
+	preview, err := previewStackUpdate(CfnClient{m}, input, []string{"Database"})
+	assert.NoError(err)
+	assert.Len(preview.Replace, 1)
+	assert.Equal([]string{"Database"}, preview.Protected)
+	assert.Equal([]string{"CreateChangeSet", "DeleteChangeSet"}, m.calls)
+
+	// an update without changes has an empty preview
+	m = &mockCfnChangeSet{status: cloudformation.ChangeSetStatusFailed, reason: "The submitted information didn't contain changes. Submit different information to create a change set."}
+	preview, err = previewStackUpdate(CfnClient{m}, input, nil)
+	assert.NoError(err)
+	assert.Equal(getUpdatePreview(nil, nil), preview)
+	assert.Equal([]string{"CreateChangeSet", "DeleteChangeSet"}, m.calls)
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"flag"
+	"time"
 )
 
 // AddFlags adds defined flags to cli options
@@ -15,7 +16,17 @@ func AddFlags(o *Options) {
 	flag.StringVar(&o.S3Region, "s3Region", "us-east-1", "region S3 bucket is located in.")
 	flag.StringVar(&o.S3Key, "s3Key", "templates/latest/", "S3 key where templates are stored.")
 	flag.StringVar(&o.TemplateFilter, "templateFilter", "-main.yaml", "only process templates with the defined suffix.")
-	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog.")
+	flag.StringVar(&o.CatalogPath, "catalogPath", "", "Local directory (or ConfigMap mount) to load templates from instead of S3, the directory is watched for changes. A path ending in .tar.gz or .tgz is loaded as a template bundle.")
+	flag.StringVar(&o.CatalogURL, "catalogURL", "", "HTTP(S) URL of a catalog index.json or .tar.gz template bundle to load templates from instead of S3.")
+	flag.StringVar(&o.CatalogQueueURL, "catalogQueueURL", "", "URL of an SQS queue receiving S3 event notifications for the template bucket, changed templates are refreshed as soon as an event is received.")
+	flag.DurationVar(&o.RefreshInterval, "refreshInterval", 10*time.Minute, "How often to refresh the catalog from the template source, 0 disables scheduled refreshes.")
+	flag.DurationVar(&o.RefreshJitter, "refreshJitter", 0, "Maximum random delay added to each scheduled catalog refresh, spreads load when running multiple brokers.")
 	flag.StringVar(&o.BrokerID, "brokerId", "awsservicebroker", "An ID to use for partitioning broker data in DynamoDb. if multiple brokers are used in the same AWS account, this value must be unique per broker")
+	flag.StringVar(&o.CfnRoleArn, "cfnRoleArn", "", "ARN of the CloudFormation service role to create, update and delete stacks with, unless a plan or the cfn_role_arn override sets another role. If left blank the broker's own credentials are used.")
+	flag.BoolVar(&o.OrphanMitigation, "orphanMitigation", false, "Delete the CloudFormation stacks of service instances that fail to provision, and the instances once their stacks are deleted, so the platform can retry provisioning.")
+	flag.DurationVar(&o.OrphanRetention, "orphanRetention", 0, "How long to keep the stack of a service instance that failed to provision before deleting it when -orphanMitigation is set, so it can be inspected.")
+	flag.BoolVar(&o.Synchronous, "synchronous", false, "Complete operations synchronously for all plans when the platform doesn't accept asynchronous operations, instead of only for plans that allow it.")
+	flag.DurationVar(&o.SynchronousTimeout, "synchronousTimeout", 45*time.Second, "How long to wait for the CloudFormation stack of a synchronous operation to finish before failing the request, at most 50s.")
+	flag.StringVar(&o.TagTemplates, "tagTemplates", "", "YAML or JSON file mapping tag keys to templates rendered from the platform context of each instance, e.g. owner: \"{{.OrganizationName}}/{{.SpaceName}}\". The tags are added to the CloudFormation stacks.")
 	flag.BoolVar(&o.PrescribeOverrides, "prescribeOverrides", false, "Plan properties that are globally overridden will be removed from service plan parameters, this enforces their values for users and simplifies the list of required parameters. Common overrides are aws_access_key, aws_secret_key, region and VpcId")
 }
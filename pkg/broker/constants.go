@@ -7,6 +7,73 @@ import (
 // CacheTTL TTL for catalog cache record expiry
 var CacheTTL = 1 * time.Hour
 
+// CatalogPathWatchInterval how often a local catalog directory is checked for changes
+var CatalogPathWatchInterval = 10 * time.Second
+
+// CatalogHTTPTimeout how long to wait when fetching a catalog index, template or bundle over HTTP(S)
+var CatalogHTTPTimeout = 30 * time.Second
+
+// UpgradeCampaignInterval how often the progress of a running upgrade campaign is checked
+var UpgradeCampaignInterval = 30 * time.Second
+
+// UpgradeCampaignLeaseDuration how long an upgrade campaign stays locked if the broker changing it stops before
+// unlocking it
+var UpgradeCampaignLeaseDuration = 5 * time.Minute
+
+// OrphanMitigationInterval how often the stacks of service instances that failed to provision are checked and deleted
+var OrphanMitigationInterval = 1 * time.Minute
+
+// SynchronousPollInterval how often the CloudFormation stack of a synchronous operation is checked
+var SynchronousPollInterval = 5 * time.Second
+
+// MaxSynchronousTimeout the longest a synchronous operation waits for its CloudFormation stack. Platforms give up on
+// requests after 60 seconds, and treat an operation that's still running as failed
+const MaxSynchronousTimeout = 50 * time.Second
+
+// ChangeSetPollInterval how often a change set is checked while it's being created
+var ChangeSetPollInterval = 2 * time.Second
+
+// ChangeSetTimeout how long to wait for a change set to be created before failing the request. Requests wait for
+// change sets, so this is kept well below the 60 seconds platforms wait for a response
+var ChangeSetTimeout = 20 * time.Second
+
+// maxTemplateBodySize the largest template CloudFormation accepts inline in TemplateBody
+const maxTemplateBodySize = 51200
+
+// catalogServicesParam DataStore parameter holding the template and service names seen in the last catalog update
+const catalogServicesParam = "__CATALOG_SERVICES__"
+
+// upgradeCampaignParam DataStore parameter holding the latest upgrade campaign and its progress
+const upgradeCampaignParam = "__UPGRADE_CAMPAIGN__"
+
+// upgradeCampaignInstancePrefix prefix of the DataStore parameters holding the progress of each instance in the
+// latest upgrade campaign
+const upgradeCampaignInstancePrefix = upgradeCampaignParam + "/"
+
+// upgradeCampaignLeaseParam DataStore parameter holding the lease of the broker changing the upgrade campaign
+const upgradeCampaignLeaseParam = "__UPGRADE_CAMPAIGN_LEASE__"
+
+// orphanedInstancesParam DataStore parameter holding the service instances whose failed stacks are being deleted
+const orphanedInstancesParam = "__ORPHANED_INSTANCES__"
+
+// cfnRoleArnOverride parameter override setting the CloudFormation service role for stacks
+const cfnRoleArnOverride = "cfn_role_arn"
+
+// deletionProtectionOverride parameter override refusing to deprovision instances, "true" or "false"
+const deletionProtectionOverride = "deletion_protection"
+
+// finalSnapshotOverride parameter override taking a final snapshot before deprovisioning instances, "true" or "false"
+const finalSnapshotOverride = "final_snapshot"
+
+// dryRunParameter update parameter previewing the update's changes instead of performing it
+const dryRunParameter = "dry_run"
+
+// tagParams are the parameters holding JSON lists of tags for the instance's stack
+var tagParams = []string{
+	"user_tags",
+	"admin_tags",
+}
+
 var nonCfnParams = []string{
 	"region",
 	"target_role_name",
@@ -0,0 +1,63 @@
+package broker
+
+// PlatformContext is the platform context of a provision or update request, as defined by the Cloud Foundry and
+// Kubernetes profiles (https://github.com/openservicebrokerapi/servicebroker/blob/v2.15/profile.md#context-object).
+// Fields the platform doesn't send are left empty
+type PlatformContext struct {
+	Platform string
+
+	// Cloud Foundry
+	OrganizationGUID        string
+	OrganizationName        string
+	OrganizationAnnotations map[string]string
+	SpaceGUID               string
+	SpaceName               string
+	SpaceAnnotations        map[string]string
+
+	// Kubernetes
+	ClusterID            string
+	Namespace            string
+	NamespaceAnnotations map[string]string
+	// Labels are the instance's labels, which some Kubernetes platforms send in addition to its annotations
+	Labels map[string]string
+
+	InstanceName        string
+	InstanceAnnotations map[string]string
+}
+
+// parsePlatformContext reads the fields of a request's context. Missing fields and fields of the wrong type are
+// ignored
+func parsePlatformContext(context map[string]interface{}) PlatformContext {
+	return PlatformContext{
+		Platform:                contextString(context, "platform"),
+		OrganizationGUID:        contextString(context, "organization_guid"),
+		OrganizationName:        contextString(context, "organization_name"),
+		OrganizationAnnotations: contextMap(context, "organization_annotations"),
+		SpaceGUID:               contextString(context, "space_guid"),
+		SpaceName:               contextString(context, "space_name"),
+		SpaceAnnotations:        contextMap(context, "space_annotations"),
+		ClusterID:               contextString(context, "clusterid"),
+		Namespace:               contextString(context, "namespace"),
+		NamespaceAnnotations:    contextMap(context, "namespace_annotations"),
+		Labels:                  contextMap(context, "labels"),
+		InstanceName:            contextString(context, "instance_name"),
+		InstanceAnnotations:     contextMap(context, "instance_annotations"),
+	}
+}
+
+func contextString(context map[string]interface{}, key string) string {
+	s, _ := context[key].(string)
+	return s
+}
+
+func contextMap(context map[string]interface{}, key string) map[string]string {
+	m, _ := context[key].(map[string]interface{})
+	if len(m) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(m))
+	for k, v := range m {
+		values[k] = paramValue(v)
+	}
+	return values
+}
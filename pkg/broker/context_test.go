@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlatformContext(t *testing.T) {
+	assert.Equal(t, PlatformContext{
+		Platform:                "cloudfoundry",
+		OrganizationGUID:        "org-guid",
+		OrganizationName:        "finance",
+		OrganizationAnnotations: map[string]string{"cost-center": "42"},
+		SpaceGUID:               "space-guid",
+		SpaceName:               "reporting",
+		InstanceName:            "reports-db",
+		InstanceAnnotations:     map[string]string{"owner": "jane", "replicas": "3"},
+	}, parsePlatformContext(map[string]interface{}{
+		"platform":                 "cloudfoundry",
+		"organization_guid":        "org-guid",
+		"organization_name":        "finance",
+		"organization_annotations": map[string]interface{}{"cost-center": "42"},
+		"space_guid":               "space-guid",
+		"space_name":               "reporting",
+		"space_annotations":        map[string]interface{}{},
+		"instance_name":            "reports-db",
+		"instance_annotations":     map[string]interface{}{"owner": "jane", "replicas": 3},
+	}))
+
+	// fields of the wrong type are ignored
+	assert.Equal(t, PlatformContext{Platform: "kubernetes", Namespace: "default"}, parsePlatformContext(map[string]interface{}{
+		"platform":             "kubernetes",
+		"namespace":            "default",
+		"clusterid":            42,
+		"instance_annotations": "owner=jane",
+	}))
+	assert.Equal(t, PlatformContext{}, parsePlatformContext(nil))
+}
@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// LocalCatalogSource loads templates from a directory on the local filesystem, such as a mounted ConfigMap
+type LocalCatalogSource struct {
+	Path   string
+	Suffix string
+}
+
+// ListTemplates lists the templates in the directory that match the suffix, using the file modification time as
+// the last updated date
+func (s LocalCatalogSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.V(10).Infoln("Listing templates in directory: " + s.Path)
+	files, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]ServiceLastUpdate, 0)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), s.Suffix) || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		// ConfigMap mounts expose each key as a symlink into a timestamped
+		// directory, so stat the target to pick up the real modification time
+		info, err := os.Stat(filepath.Join(s.Path, f.Name()))
+		if err != nil {
+			glog.Errorln(err)
+			continue
+		}
+		if info.IsDir() {
+			continue
+		}
+		l = append(l, ServiceLastUpdate{
+			Name: strings.TrimSuffix(f.Name(), s.Suffix),
+			Date: info.ModTime(),
+		})
+	}
+	glog.V(10).Infof("Found %d templates\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate reads a template from the directory
+func (s LocalCatalogSource) GetTemplate(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.Path, name+s.Suffix))
+}
+
+// TemplateURL always returns nil, local templates are sent inline
+func (s LocalCatalogSource) TemplateURL(name string) *string {
+	return nil
+}
+
+// catalogFingerprint summarises the names and modification times of the templates in a catalog source
+func catalogFingerprint(source CatalogSource) (string, error) {
+	l, err := source.ListTemplates()
+	if err != nil {
+		return "", err
+	}
+	var entries []string
+	for _, t := range *l {
+		entries = append(entries, fmt.Sprintf("%s@%d", t.Name, t.Date.UnixNano()))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ","), nil
+}
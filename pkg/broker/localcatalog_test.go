@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/koding/cache"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLocalTemplate = `
+Description: Local test service (qs-1nt0fs93h)
+Parameters:
+  BucketName:
+    Type: String
+    Default: test
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: localtest
+    ServicePlans:
+      default:
+        Description: default plan
+`
+
+func writeTestTemplate(t *testing.T, dir, name, body string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListLocalTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	writeTestTemplate(t, dir, "README.md", "not a template")
+	writeTestTemplate(t, dir, ".hidden-main.yaml", testLocalTemplate)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "nested-main.yaml"), 0755))
+
+	source := LocalCatalogSource{Path: dir, Suffix: "-main.yaml"}
+	l, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.Len(t, *l, 1)
+	assert.Equal(t, "localtest", (*l)[0].Name)
+
+	body, err := source.GetTemplate("localtest")
+	assert.NoError(t, err)
+	assert.Equal(t, testLocalTemplate, string(body))
+	assert.Nil(t, source.TemplateURL("localtest"))
+
+	_, err = LocalCatalogSource{Path: filepath.Join(dir, "missing"), Suffix: "-main.yaml"}.ListTemplates()
+	assert.Error(t, err)
+}
+
+func TestLocalMetadataUpdate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	source := LocalCatalogSource{Path: dir, Suffix: "-main.yaml"}
+	db := Db{DataStorePort: mockDataStore{}}
+	l := cache.NewMemory()
+	c := cache.NewMemory()
+
+	templates, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.NoError(t, ListingUpdate(templates, l))
+	assert.NoError(t, MetadataUpdate(l, c, source, db, MetadataUpdate))
+
+	sd, err := c.Get("localtest")
+	assert.NoError(t, err)
+	assert.Equal(t, "localtest", sd.(osb.Service).Name)
+	assert.Len(t, sd.(osb.Service).Plans, 1)
+}
+
+func TestGetTemplateLocation(t *testing.T) {
+	s3obj := s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(testLocalTemplate))}
+	b := &AwsBroker{catalog: S3CatalogSource{Client: S3Client{Client: mockS3{GetObjectResp: s3obj}}, Bucket: "abucket", Region: "us-east-1", Prefix: "templates/", Suffix: "-main.yaml"}}
+	url, body, version, err := b.getTemplateLocation("localtest")
+	assert.NoError(t, err)
+	assert.Nil(t, url, "templates from S3 that fit are sent inline, so CloudFormation deploys the template fetched")
+	assert.Equal(t, testLocalTemplate, *body)
+	assert.Equal(t, templateVersion([]byte(testLocalTemplate)), version, "the version should be that of the template fetched")
+
+	large := testLocalTemplate + "# " + strings.Repeat("x", maxTemplateBodySize) + "\n"
+	s3obj = s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(large))}
+	b.catalog = S3CatalogSource{Client: S3Client{Client: mockS3{GetObjectResp: s3obj}}, Bucket: "abucket", Region: "us-east-1", Prefix: "templates/", Suffix: "-main.yaml"}
+	url, body, version, err = b.getTemplateLocation("localtest")
+	assert.NoError(t, err)
+	assert.Nil(t, body)
+	assert.Equal(t, "https://abucket.s3.amazonaws.com/templates/localtest-main.yaml", *url)
+	assert.Equal(t, templateVersion([]byte(large)), version)
+
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	b.catalog = LocalCatalogSource{Path: dir, Suffix: "-main.yaml"}
+	url, body, version, err = b.getTemplateLocation("localtest-apb")
+	assert.NoError(t, err)
+	assert.Nil(t, url)
+	assert.Equal(t, testLocalTemplate, *body)
+	assert.Equal(t, templateVersion([]byte(testLocalTemplate)), version)
+
+	// a template changed since the catalog was loaded is deployed with its new version
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate+"# changed\n")
+	_, _, version, err = b.getTemplateLocation("localtest")
+	assert.NoError(t, err)
+	assert.Equal(t, templateVersion([]byte(testLocalTemplate+"# changed\n")), version)
+
+	_, _, _, err = b.getTemplateLocation("missing")
+	assert.Error(t, err)
+}
+
+func TestTemplateBodySize(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Replace(testLocalTemplate, "Name: localtest", "Name: large", 1) + "# " + strings.Repeat("x", maxTemplateBodySize) + "\n"
+	writeTestTemplate(t, dir, "large-main.yaml", large)
+	source := LocalCatalogSource{Path: dir, Suffix: "-main.yaml"}
+	l := cache.NewMemory()
+	c := cache.NewMemory()
+
+	templates, err := source.ListTemplates()
+	assert.NoError(t, err)
+	assert.NoError(t, ListingUpdate(templates, l))
+	assert.NoError(t, MetadataUpdate(l, c, source, Db{DataStorePort: mockDataStore{}}, MetadataUpdate))
+	_, err = c.Get("large")
+	assert.Error(t, err, "templates too large to send inline aren't added to the catalog")
+
+	b := &AwsBroker{catalog: source}
+	_, _, _, err = b.getTemplateLocation("large")
+	assert.EqualError(t, err, fmt.Sprintf("template large is %d bytes, templates sent inline are limited to 51200 bytes, load it from S3 instead", len(large)))
+}
@@ -10,7 +10,11 @@ import (
 // it exists so that we don't reuse the same metric name, and we don't
 // conflict with the metric gathering in that library.
 type MetricsCollector struct {
-	Actions *prom.CounterVec
+	Actions                   *prom.CounterVec
+	CatalogRefreshes          *prom.CounterVec
+	CatalogLastRefresh        prom.Gauge
+	CatalogLastRefreshSuccess prom.Gauge
+	OrphanedStacks            *prom.CounterVec
 }
 
 
@@ -21,17 +25,56 @@ func NewMetricsCollector() *MetricsCollector {
 			Name: "aws_sb_actions_total",
 			Help: "Total amount of OpenServiceBroker actions requested.",
 		}, []string{"action", "service", "plan"}),
+		CatalogRefreshes: prom.NewCounterVec(prom.CounterOpts{
+			Name: "aws_sb_catalog_refreshes_total",
+			Help: "Total amount of catalog refreshes, by what triggered them and their result.",
+		}, []string{"trigger", "result"}),
+		CatalogLastRefresh: prom.NewGauge(prom.GaugeOpts{
+			Name: "aws_sb_catalog_last_refresh_timestamp_seconds",
+			Help: "Time of the last catalog refresh.",
+		}),
+		CatalogLastRefreshSuccess: prom.NewGauge(prom.GaugeOpts{
+			Name: "aws_sb_catalog_last_refresh_success",
+			Help: "Whether the last catalog refresh succeeded (1) or failed (0).",
+		}),
+		OrphanedStacks: prom.NewCounterVec(prom.CounterOpts{
+			Name: "aws_sb_orphaned_stacks_total",
+			Help: "Total amount of CloudFormation stacks deleted after failing to provision.",
+		}, []string{"service", "plan"}),
+	}
+}
+
+// RecordCatalogRefresh records the result of a catalog refresh.
+func (c *MetricsCollector) RecordCatalogRefresh(trigger string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.CatalogRefreshes.With(prom.Labels{"trigger": trigger, "result": result}).Inc()
+	c.CatalogLastRefresh.SetToCurrentTime()
+	if err != nil {
+		c.CatalogLastRefreshSuccess.Set(0)
+	} else {
+		c.CatalogLastRefreshSuccess.Set(1)
 	}
 }
 
 // Describe returns all descriptions of the collector.
 func (c *MetricsCollector) Describe(ch chan<- *prom.Desc) {
 	c.Actions.Describe(ch)
+	c.CatalogRefreshes.Describe(ch)
+	c.CatalogLastRefresh.Describe(ch)
+	c.CatalogLastRefreshSuccess.Describe(ch)
+	c.OrphanedStacks.Describe(ch)
 }
 
 // Collect returns the current state of all metrics of the collector.
 func (c *MetricsCollector) Collect(ch chan<- prom.Metric) {
 	c.Actions.Collect(ch)
+	c.CatalogRefreshes.Collect(ch)
+	c.CatalogLastRefresh.Collect(ch)
+	c.CatalogLastRefreshSuccess.Collect(ch)
+	c.OrphanedStacks.Collect(ch)
 }
 
 
@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxOperations is how many operations are kept for each service instance
+const maxOperations = 10
+
+// startOperation records a new operation on an instance, keeping only the latest maxOperations. The caller is
+// responsible for storing the instance
+func startOperation(instance *serviceinstance.ServiceInstance, opType string, stackStatus string, params map[string]interface{}) *serviceinstance.Operation {
+	op := serviceinstance.Operation{
+		ID:          uuid.NewV4().String(),
+		Type:        opType,
+		Started:     time.Now().UTC(),
+		StackStatus: stackStatus,
+		Params:      make(map[string]string),
+	}
+	for k, v := range params {
+		op.Params[k] = paramValue(v)
+	}
+	instance.Operations = append(instance.Operations, op)
+	if len(instance.Operations) > maxOperations {
+		instance.Operations = instance.Operations[len(instance.Operations)-maxOperations:]
+	}
+	return &instance.Operations[len(instance.Operations)-1]
+}
+
+// findOperation returns the operation with the given key, or the latest operation if key is empty, along with the
+// operation that followed it. Both are nil if the instance has no such operation
+func findOperation(instance *serviceinstance.ServiceInstance, key string) (op *serviceinstance.Operation, next *serviceinstance.Operation) {
+	for i := len(instance.Operations) - 1; i >= 0; i-- {
+		if key == "" || instance.Operations[i].ID == key {
+			if i+1 < len(instance.Operations) {
+				next = &instance.Operations[i+1]
+			}
+			return &instance.Operations[i], next
+		}
+	}
+	return nil, nil
+}
+
+// getOperationKey returns the operation key from a last operation request. The OSB library doesn't read the
+// operation query parameter, so it's taken from the HTTP request if it's not set
+func getOperationKey(request *osb.LastOperationRequest, c *broker.RequestContext) string {
+	if request.OperationKey != nil {
+		return string(*request.OperationKey)
+	}
+	if c != nil && c.Request != nil && c.Request.URL != nil {
+		return c.Request.URL.Query().Get(osb.VarKeyOperation)
+	}
+	return ""
+}
+
+func toOperationKey(op *serviceinstance.Operation) *osb.OperationKey {
+	if op == nil {
+		return nil
+	}
+	key := osb.OperationKey(op.ID)
+	return &key
+}
+
+// operationState maps a stack status to the state of an operation of the given type. An empty type accepts any
+// completed status as success, for instances created before operations were recorded. A failed update is in progress
+// until it has rolled back, so the instance's previous parameters can be restored
+func operationState(opType string, status string) osb.LastOperationState {
+	if strings.HasSuffix(status, "_IN_PROGRESS") && !strings.Contains(status, "ROLLBACK") {
+		return osb.StateInProgress
+	}
+	if opType == serviceinstance.OperationUpdate && strings.HasPrefix(status, "UPDATE_ROLLBACK_") && strings.HasSuffix(status, "_IN_PROGRESS") {
+		return osb.StateInProgress
+	}
+	switch opType {
+	case serviceinstance.OperationProvision:
+		if status == cloudformation.StackStatusCreateComplete {
+			return osb.StateSucceeded
+		}
+	case serviceinstance.OperationUpdate:
+		if status == cloudformation.StackStatusUpdateComplete {
+			return osb.StateSucceeded
+		}
+	case serviceinstance.OperationDeprovision:
+		if status == cloudformation.StackStatusDeleteComplete {
+			return osb.StateSucceeded
+		}
+	default:
+		if status == cloudformation.StackStatusCreateComplete ||
+			status == cloudformation.StackStatusDeleteComplete ||
+			status == cloudformation.StackStatusUpdateComplete {
+			return osb.StateSucceeded
+		}
+	}
+	return osb.StateFailed
+}
+
+// getStackStatus returns the current status of a stack
+func getStackStatus(cfnSvc CfnClient, stackID string) (string, error) {
+	stack, err := describeStack(cfnSvc, stackID)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(stack.StackStatus), nil
+}
+
+func describeStack(cfnSvc CfnClient, stackID string) (*cloudformation.Stack, error) {
+	resp, err := cfnSvc.Client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackID),
+	})
+	if err != nil {
+		return nil, err
+	} else if len(resp.Stacks) == 0 {
+		return nil, fmt.Errorf("stack %s not found", stackID)
+	}
+	return resp.Stacks[0], nil
+}
+
+// stackUpdatedTime returns when a stack was last updated, or created if it has never been updated
+func stackUpdatedTime(stack *cloudformation.Stack) time.Time {
+	if stack.LastUpdatedTime != nil {
+		return *stack.LastUpdatedTime
+	}
+	return aws.TimeValue(stack.CreationTime)
+}
+
+func newOperationNotFoundError(instanceID string, key string) error {
+	desc := fmt.Sprintf("The operation %s was not found for the service instance %s.", key, instanceID)
+	return newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+}
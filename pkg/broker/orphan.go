@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// isOrphaned returns true if the instance failed to provision and its stack is being deleted by orphan mitigation
+func isOrphaned(instance *serviceinstance.ServiceInstance) bool {
+	op, _ := findOperation(instance, "")
+	return op != nil && op.Type == serviceinstance.OperationProvision && op.State == string(osb.StateFailed)
+}
+
+// recordOrphan marks an instance whose stack failed to create as orphaned, keeping the reason it failed so it's still
+// reported once the stack has been deleted. The stack is deleted now, or by RunOrphanMitigation once the orphan
+// retention period has passed
+func (b *AwsBroker) recordOrphan(instance *serviceinstance.ServiceInstance, op *serviceinstance.Operation, description string) {
+	op.State = string(osb.StateFailed)
+	op.Description = description
+	if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+		glog.Errorf("Failed to record the failed provision of service instance %s: %v", instance.ID, err)
+		return
+	}
+
+	labels := prom.Labels{"service": "", "plan": ""}
+	if service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID); err == nil && service != nil {
+		labels["service"] = service.Name
+		if plan := getPlan(service, instance.PlanID); plan != nil {
+			labels["plan"] = plan.Name
+		}
+	}
+	b.metrics.OrphanedStacks.With(labels).Inc()
+
+	b.orphanLock.Lock()
+	defer b.orphanLock.Unlock()
+
+	orphans := b.getOrphanedInstances()
+	orphans[instance.ID] = time.Now().UTC()
+	if b.orphanRetention <= 0 {
+		b.deleteOrphanedStack(instance)
+	}
+	b.putOrphanedInstances(orphans)
+}
+
+// cleanUpOrphan is called when a service instance is provisioned again after failing to provision. It returns nil
+// once the orphaned instance has been deleted, otherwise deletion of its stack is started if necessary and the
+// request must be retried later
+func (b *AwsBroker) cleanUpOrphan(instance *serviceinstance.ServiceInstance) (*serviceinstance.ServiceInstance, error) {
+	b.orphanLock.Lock()
+	defer b.orphanLock.Unlock()
+
+	orphans := b.getOrphanedInstances()
+	if b.checkOrphan(instance, true) {
+		delete(orphans, instance.ID)
+		b.putOrphanedInstances(orphans)
+		return nil, nil
+	}
+	desc := fmt.Sprintf("Service instance %s failed to provision and its CloudFormation stack is being deleted, retry once it has been deleted.", instance.ID)
+	return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", desc)
+}
+
+// RunOrphanMitigation deletes the stacks of service instances that failed to provision once the orphan retention
+// period has passed, and the instances once their stacks have been deleted, until ctx is cancelled
+func (b *AwsBroker) RunOrphanMitigation(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		b.mitigateOrphans()
+	}
+}
+
+func (b *AwsBroker) mitigateOrphans() {
+	b.orphanLock.Lock()
+	defer b.orphanLock.Unlock()
+
+	orphans := b.getOrphanedInstances()
+	if len(orphans) == 0 {
+		return
+	}
+	for id, orphaned := range orphans {
+		instance, err := b.db.DataStorePort.GetServiceInstance(id)
+		if err != nil {
+			glog.Errorf("Failed to get the service instance %s: %v", id, err)
+			continue
+		} else if instance == nil {
+			delete(orphans, id)
+			continue
+		}
+		if b.checkOrphan(instance, time.Since(orphaned) >= b.orphanRetention) {
+			delete(orphans, id)
+		}
+	}
+	b.putOrphanedInstances(orphans)
+}
+
+// checkOrphan deletes an orphaned instance if its stack has been deleted, returning true once it has been. Otherwise,
+// if remove is set, deleting the stack is started unless it's already in progress
+func (b *AwsBroker) checkOrphan(instance *serviceinstance.ServiceInstance, remove bool) bool {
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	status, err := getStackStatus(cfnSvc, instance.StackID)
+	if err != nil {
+		glog.Errorf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+		return false
+	}
+	switch {
+	case status == cloudformation.StackStatusDeleteComplete:
+		glog.Infof("Deleting service instance %s, its orphaned CloudFormation stack has been deleted", instance.ID)
+		if err := b.db.DataStorePort.DeleteServiceInstance(instance.ID); err != nil {
+			glog.Errorf("Failed to delete the service instance %s: %v", instance.ID, err)
+			return false
+		}
+		return true
+	case status != cloudformation.StackStatusDeleteInProgress && remove:
+		b.deleteOrphanedStack(instance)
+	}
+	return false
+}
+
+func (b *AwsBroker) deleteOrphanedStack(instance *serviceinstance.ServiceInstance) {
+	glog.Infof("Deleting the orphaned CloudFormation stack %s of service instance %s", instance.StackID, instance.ID)
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	if err := deleteStackInput(cfnSvc, &cloudformation.DeleteStackInput{RoleARN: stackRoleARN(instance), StackName: aws.String(instance.StackID)}); err != nil {
+		glog.Errorf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
+	}
+}
+
+// getOrphanedInstances returns the IDs of orphaned service instances and when they were found to have failed
+func (b *AwsBroker) getOrphanedInstances() map[string]time.Time {
+	orphans := make(map[string]time.Time)
+	if value, err := b.db.DataStorePort.GetParam(orphanedInstancesParam); err == nil {
+		if err := json.Unmarshal([]byte(value), &orphans); err != nil {
+			glog.Errorf("Failed to parse the orphaned service instances: %v", err)
+		}
+	}
+	return orphans
+}
+
+func (b *AwsBroker) putOrphanedInstances(orphans map[string]time.Time) {
+	value, err := json.Marshal(orphans)
+	if err == nil {
+		err = b.db.DataStorePort.PutParam(orphanedInstancesParam, string(value))
+	}
+	if err != nil {
+		glog.Errorf("Failed to store the orphaned service instances: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanMitigation(t *testing.T) {
+	assert := assert.New(t)
+	newInstance := func(id string) serviceinstance.ServiceInstance {
+		return serviceinstance.ServiceInstance{ID: id, ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-" + id, Params: map[string]string{"req_param": "pval"}, Operations: []serviceinstance.Operation{
+			{ID: "op-" + id, Type: serviceinstance.OperationProvision, Params: map[string]string{"req_param": "pval"}},
+		}}
+	}
+	db := newMockDataStoreCampaign(newInstance("i1"), newInstance("i2"))
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{
+		"stack-i1": cloudformation.StackStatusRollbackComplete,
+		"stack-i2": cloudformation.StackStatusCreateFailed,
+	}}
+	b := newCampaignTestBroker(db, cfn)
+	b.orphanMitigation = true
+	b.orphanRetention = time.Hour
+	lastOperation := func(id string) (*broker.LastOperationResponse, error) {
+		return b.LastOperation(&osb.LastOperationRequest{InstanceID: id}, &broker.RequestContext{Request: &http.Request{Header: http.Header{}}})
+	}
+	provision := func(id string) (*broker.ProvisionResponse, error) {
+		return b.Provision(&osb.ProvisionRequest{
+			InstanceID:        id,
+			ServiceID:         "test-service-id",
+			PlanID:            "test-plan-id",
+			AcceptsIncomplete: true,
+			Parameters:        map[string]interface{}{"req_param": "pval"},
+		}, &broker.RequestContext{})
+	}
+
+	// the failed stack is kept for the retention period
+	resp, err := lastOperation("i1")
+	assert.NoError(err)
+	assert.Equal(osb.StateFailed, resp.State)
+	assert.True(isOrphaned(&serviceinstance.ServiceInstance{Operations: db.instances["i1"].Operations}))
+	assert.Equal(float64(1), testutil.ToFloat64(b.metrics.OrphanedStacks.WithLabelValues("test-service-name", "test-plan-name")))
+	b.mitigateOrphans()
+	assert.Equal(cloudformation.StackStatusRollbackComplete, cfn.statuses["stack-i1"])
+
+	// provisioning the instance again starts deleting the stack
+	_, err = provision("i1")
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", "Service instance i1 failed to provision and its CloudFormation stack is being deleted, retry once it has been deleted.").Error())
+	assert.Equal(cloudformation.StackStatusDeleteInProgress, cfn.statuses["stack-i1"])
+
+	// the failure is still reported while the stack is deleted
+	resp, err = lastOperation("i1")
+	assert.NoError(err)
+	assert.Equal(osb.StateFailed, resp.State)
+	assert.Equal(float64(1), testutil.ToFloat64(b.metrics.OrphanedStacks.WithLabelValues("test-service-name", "test-plan-name")))
+
+	// the instance is deleted along with its stack, and can then be provisioned
+	cfn.set("stack-i1", cloudformation.StackStatusDeleteComplete)
+	b.mitigateOrphans()
+	assert.NotContains(db.instances, "i1")
+	assert.Equal("{}", db.params[orphanedInstancesParam])
+	presp, err := provision("i1")
+	assert.NoError(err)
+	assert.True(presp.Async)
+
+	// without a retention period the stack is deleted as soon as the failure is seen
+	b.orphanRetention = 0
+	resp, err = lastOperation("i2")
+	assert.NoError(err)
+	assert.Equal(osb.StateFailed, resp.State)
+	assert.Equal(cloudformation.StackStatusDeleteInProgress, cfn.statuses["stack-i2"])
+	cfn.set("stack-i2", cloudformation.StackStatusDeleteComplete)
+	presp, err = provision("i2")
+	assert.NoError(err)
+	assert.True(presp.Async)
+	assert.Equal(float64(2), testutil.ToFloat64(b.metrics.OrphanedStacks.WithLabelValues("test-service-name", "test-plan-name")))
+}
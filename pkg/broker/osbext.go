@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// MaintenanceInfo identifies the template version a plan's instances are deployed with
+// (https://github.com/openservicebrokerapi/servicebroker/blob/v2.15/spec.md#maintenance-info-object).
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// catalogServiceFields are service metadata keys that OSBExtensions moves to fields of the service, as the client
+// library's osb.Service doesn't have them
+var catalogServiceFields = map[string]string{
+	"allowContextUpdates": "allow_context_updates",
+}
+
+// catalogPlanFields are plan metadata keys that OSBExtensions moves to fields of the plan, as the client library's
+// osb.Plan doesn't have them
+var catalogPlanFields = map[string]string{
+	"maintenanceInfo": "maintenance_info",
+}
+
+type requestExtensionsKey struct{}
+
+// requestExtensions are the fields of OSB requests that the client library's request types don't have
+type requestExtensions struct {
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// OSBExtensions is middleware for the OSB API that supports fields from versions of the API newer than the client
+// library. Catalog services and plans get the fields stored in their metadata, and the extra fields of provision and update
+// requests are made available to the broker through the request context
+func OSBExtensions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/catalog":
+			rec := &bufferedResponseWriter{header: make(http.Header), status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			body := rec.body.Bytes()
+			if rec.status == http.StatusOK {
+				if promoted, err := promoteCatalogFields(body); err != nil {
+					glog.Errorf("Failed to add extension fields to the catalog: %v", err)
+				} else {
+					body = promoted
+				}
+			}
+			for k, v := range rec.header {
+				w.Header()[k] = v
+			}
+			w.Header().Del("Content-Length")
+			w.WriteHeader(rec.status)
+			w.Write(body)
+			return
+		case (r.Method == http.MethodPut || r.Method == http.MethodPatch) && isInstancePath(r.URL.Path):
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				glog.Errorf("Failed to read the request body: %v", err)
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var ext requestExtensions
+			if err := json.Unmarshal(body, &ext); err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), requestExtensionsKey{}, ext))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getRequestExtensions returns the extra fields of a provision or update request
+func getRequestExtensions(c *broker.RequestContext) requestExtensions {
+	if c == nil || c.Request == nil {
+		return requestExtensions{}
+	}
+	ext, _ := c.Request.Context().Value(requestExtensionsKey{}).(requestExtensions)
+	return ext
+}
+
+func isInstancePath(path string) bool {
+	id := strings.TrimPrefix(path, "/v2/service_instances/")
+	return id != path && id != "" && !strings.Contains(id, "/")
+}
+
+func promoteCatalogFields(body []byte) ([]byte, error) {
+	var catalog map[string]interface{}
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return nil, err
+	}
+	services, _ := catalog["services"].([]interface{})
+	for _, s := range services {
+		service, _ := s.(map[string]interface{})
+		promoteMetadataFields(service, catalogServiceFields)
+		plans, _ := service["plans"].([]interface{})
+		for _, p := range plans {
+			plan, _ := p.(map[string]interface{})
+			promoteMetadataFields(plan, catalogPlanFields)
+		}
+	}
+	return json.Marshal(catalog)
+}
+
+func promoteMetadataFields(obj map[string]interface{}, fields map[string]string) {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	for key, field := range fields {
+		if v, ok := metadata[key]; ok {
+			obj[field] = v
+			delete(metadata, key)
+		}
+	}
+}
+
+// bufferedResponseWriter holds a response so it can be modified before it's written
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOSBExtensionsCatalog(t *testing.T) {
+	handler := OSBExtensions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"services": [{"name": "test", "metadata": {"allowContextUpdates": true}, "plans": [
+			{"name": "default", "metadata": {"displayName": "Default", "maintenanceInfo": {"version": "1.0.0"}}},
+			{"name": "other"}
+		]}]}`))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"services": [{"name": "test", "metadata": {}, "allow_context_updates": true, "plans": [
+		{"name": "default", "metadata": {"displayName": "Default"}, "maintenance_info": {"version": "1.0.0"}},
+		{"name": "other"}
+	]}]}`, w.Body.String())
+}
+
+func TestOSBExtensionsRequest(t *testing.T) {
+	var body string
+	var ext requestExtensions
+	handler := OSBExtensions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		ext = getRequestExtensions(&broker.RequestContext{Request: r})
+	}))
+
+	request := `{"service_id": "test", "maintenance_info": {"version": "1.0.0"}}`
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/v2/service_instances/an-id", strings.NewReader(request)))
+	assert.Equal(t, request, body)
+	assert.Equal(t, &MaintenanceInfo{Version: "1.0.0"}, ext.MaintenanceInfo)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/service_instances/an-id/service_bindings/b", strings.NewReader(request)))
+	assert.Nil(t, ext.MaintenanceInfo)
+
+	assert.Nil(t, getRequestExtensions(nil).MaintenanceInfo)
+	assert.Nil(t, getRequestExtensions(&broker.RequestContext{}).MaintenanceInfo)
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// PreviewUpdate returns the changes updating a service instance to planID (if set) and parameters would make to its
+// stack, without updating it
+func (b *AwsBroker) PreviewUpdate(id string, planID *string, parameters map[string]interface{}) (*UpdatePreview, error) {
+	instance, err := b.db.DataStorePort.GetServiceInstance(id)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %q: %v", id, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %q was not found.", id)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	request := &osb.UpdateInstanceRequest{
+		InstanceID: id,
+		ServiceID:  instance.ServiceID,
+		PlanID:     planID,
+		Parameters: parameters,
+	}
+	update, err := b.getInstanceUpdate(instance, request, nil)
+	if err != nil {
+		return nil, err
+	} else if update == nil {
+		return getUpdatePreview(nil, nil), nil
+	}
+	return b.previewInstanceUpdate(instance, update)
+}
+
+// previewInstanceUpdate creates a change set for an update of an instance's stack and summarizes its changes. The
+// change set is deleted without being executed
+func (b *AwsBroker) previewInstanceUpdate(instance *serviceinstance.ServiceInstance, update *instanceUpdate) (*UpdatePreview, error) {
+	input, _, err := b.getUpdateStackInput(instance, update.service, update.plan, update.params, update.upgrade)
+	if err != nil {
+		return nil, err
+	}
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, update.params))
+	preview, err := previewStackUpdate(cfnSvc, input, getProtectedResources(update.service))
+	if err != nil {
+		desc := fmt.Sprintf("Failed to preview the update of the CloudFormation stack %q: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	glog.Infof("Previewed the update of service instance %q: %+v", instance.ID, *preview)
+	return preview, nil
+}
+
+// isDryRun returns true if the dry_run update parameter is set
+func isDryRun(parameters map[string]interface{}) bool {
+	return paramValue(parameters[dryRunParameter]) == "true"
+}
+
+// newDryRunError returns the error a dry run update fails with, describing the changes the update would make. The OSB
+// API has no way to return a successful update without performing it, the admin preview-update endpoint returns the
+// preview as its response instead
+func newDryRunError(preview *UpdatePreview) error {
+	summary, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	var changes []string
+	for _, c := range []struct {
+		action    string
+		resources []ResourceChange
+	}{
+		{"add", preview.Add},
+		{"modify", preview.Modify},
+		{"replace", preview.Replace},
+		{"remove", preview.Remove},
+	} {
+		if len(c.resources) > 0 {
+			ids := make([]string, len(c.resources))
+			for i, r := range c.resources {
+				ids[i] = r.LogicalResourceID
+			}
+			changes = append(changes, fmt.Sprintf("%s %s", c.action, strings.Join(ids, ", ")))
+		}
+	}
+	desc := "Dry run: the update would not change any resources."
+	if len(changes) > 0 {
+		desc = fmt.Sprintf("Dry run: the update would %s.", strings.Join(changes, "; "))
+	}
+	if len(preview.Protected) > 0 {
+		desc += fmt.Sprintf(" It would be refused, as it replaces the protected resources %s.", strings.Join(preview.Protected, ", "))
+	}
+	if len(preview.ConditionallyProtected) > 0 {
+		desc += fmt.Sprintf(" It may replace the protected resources %s.", strings.Join(preview.ConditionallyProtected, ", "))
+	}
+	return newHTTPStatusCodeError(http.StatusUnprocessableEntity, "DryRun", fmt.Sprintf("%s Changes: %s", desc, summary))
+}
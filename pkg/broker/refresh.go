@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/koding/cache"
+)
+
+// Catalog refresh triggers, used to label metrics
+const (
+	refreshTriggerStartup  = "startup"
+	refreshTriggerSchedule = "schedule"
+	refreshTriggerAdmin    = "admin"
+	refreshTriggerEvent    = "event"
+	refreshTriggerWatch    = "watch"
+)
+
+// RefreshSchedule controls how often the catalog is refreshed, a random delay of up to Jitter is added to each
+// Interval. An Interval of 0 disables scheduled refreshes
+type RefreshSchedule struct {
+	Interval time.Duration
+	Jitter   time.Duration
+}
+
+func (s RefreshSchedule) next() <-chan time.Time {
+	if s.Interval <= 0 {
+		return nil
+	}
+	d := s.Interval
+	if s.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.Jitter)))
+	}
+	return time.After(d)
+}
+
+// CatalogRefreshRequest asks for the catalog to be refreshed. If Updated and Removed are empty the whole catalog is
+// reloaded, otherwise only the named templates are. If Done is set it receives the result of the refresh
+type CatalogRefreshRequest struct {
+	Trigger string
+	Updated []string
+	Removed []string
+	Done    chan error
+}
+
+// PollUpdate refreshes the catalog on a schedule and whenever a refresh is requested, until ctx is cancelled.
+// Refreshes are run one at a time
+func PollUpdate(ctx context.Context, schedule RefreshSchedule, requests <-chan CatalogRefreshRequest, l cache.Cache, c cache.Cache, source CatalogSource, db Db, updateCatalog UpdateCataloger, metrics *MetricsCollector) {
+	scheduled := schedule.next()
+	for {
+		var req CatalogRefreshRequest
+		select {
+		case <-ctx.Done():
+			return
+		case <-scheduled:
+			req = CatalogRefreshRequest{Trigger: refreshTriggerSchedule}
+		case req = <-requests:
+		}
+
+		var err error
+		if len(req.Updated) > 0 || len(req.Removed) > 0 {
+			err = RefreshTemplates(l, c, source, db, req.Updated, req.Removed)
+		}
+		if len(req.Updated) == 0 && len(req.Removed) == 0 || err == errCatalogNotLoaded {
+			err = updateCatalog(l, c, source, db, ListingUpdate, MetadataUpdate)
+			// a full refresh restarts the schedule
+			scheduled = schedule.next()
+		}
+		if err != nil {
+			glog.Errorf("Failed to refresh the catalog (%s): %v", req.Trigger, err)
+		}
+		metrics.RecordCatalogRefresh(req.Trigger, err)
+		if req.Done != nil {
+			req.Done <- err
+		}
+	}
+}
+
+var errCatalogNotLoaded = errors.New("the catalog has not been loaded")
+
+// RefreshTemplates reloads the updated templates and retires the removed ones without listing the whole catalog
+// source
+func RefreshTemplates(l cache.Cache, c cache.Cache, source CatalogSource, db Db, updated []string, removed []string) error {
+	data, err := l.Get("__LISTINGS__")
+	if err != nil {
+		return errCatalogNotLoaded
+	}
+	var listings []ServiceNeedsUpdate
+	known := make(map[string]bool)
+	for _, item := range data.([]ServiceNeedsUpdate) {
+		if !stringInSlice(item.Name, removed) {
+			listings = append(listings, ServiceNeedsUpdate{Name: item.Name, Update: false})
+			known[item.Name] = true
+		}
+	}
+	for _, name := range updated {
+		glog.Infof("Refreshing template %q", name)
+		file, err := source.GetTemplate(name)
+		if err != nil {
+			glog.Errorln(err)
+			continue
+		}
+		item := ServiceNeedsUpdate{Name: name, Update: true}
+		if err := templateToServiceDefinition(file, db, c, item); err != nil {
+			glog.Errorln(err)
+			continue
+		}
+		// the next full refresh compares the source's modification time against this
+		l.Set(name, time.Now())
+		if !known[name] {
+			listings = append(listings, ServiceNeedsUpdate{Name: name, Update: false})
+		}
+	}
+	l.Set("__LISTINGS__", listings)
+	retireRemovedServices(l, c, db, listings, time.Now())
+	return nil
+}
+
+// WatchCatalogSource polls a catalog source and requests a refresh whenever a template is added, modified or
+// removed, until ctx is cancelled. Listing is cheap for local directories and bundles, so they are checked far more
+// often than the scheduled refresh
+func WatchCatalogSource(ctx context.Context, interval time.Duration, source CatalogSource, requests chan<- CatalogRefreshRequest) {
+	last, err := catalogFingerprint(source)
+	if err != nil {
+		glog.Errorln(err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		current, err := catalogFingerprint(source)
+		if err != nil {
+			glog.Errorln(err)
+			continue
+		}
+		if current != last {
+			glog.Infoln("Detected template changes, updating catalog")
+			last = current
+			select {
+			case requests <- CatalogRefreshRequest{Trigger: refreshTriggerWatch}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koding/cache"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshScheduleNext(t *testing.T) {
+	assert.Nil(t, RefreshSchedule{}.next(), "a zero interval should disable scheduled refreshes")
+	assert.NotNil(t, RefreshSchedule{Interval: time.Hour, Jitter: time.Minute}.next())
+}
+
+func TestPollUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := make(chan CatalogRefreshRequest)
+	metrics := NewMetricsCollector()
+	calls := make(chan bool, 1)
+	var mu sync.Mutex
+	var updateErr error
+	setUpdateErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		updateErr = err
+	}
+	updateCatalog := func(l cache.Cache, c cache.Cache, source CatalogSource, db Db, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+		select {
+		case calls <- true:
+		default:
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return updateErr
+	}
+	stopped := make(chan bool)
+	go func() {
+		PollUpdate(ctx, RefreshSchedule{Interval: 20 * time.Millisecond, Jitter: time.Millisecond}, requests, cache.NewMemory(), cache.NewMemory(), mockCatalogSource{}, Db{}, updateCatalog, metrics)
+		stopped <- true
+	}()
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("expected a scheduled refresh")
+	}
+
+	setUpdateErr(errors.New("refresh failed"))
+	req := CatalogRefreshRequest{Trigger: refreshTriggerAdmin, Done: make(chan error, 1)}
+	requests <- req
+	assert.EqualError(t, <-req.Done, "refresh failed")
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CatalogRefreshes.WithLabelValues(refreshTriggerAdmin, "failure")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.CatalogLastRefreshSuccess))
+
+	// partial refreshes fall back to a full refresh until the catalog has been loaded
+	setUpdateErr(nil)
+	req = CatalogRefreshRequest{Trigger: refreshTriggerEvent, Updated: []string{"localtest"}, Done: make(chan error, 1)}
+	requests <- req
+	assert.NoError(t, <-req.Done)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CatalogLastRefreshSuccess))
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected PollUpdate to stop when the context is cancelled")
+	}
+}
+
+func TestRefreshTemplates(t *testing.T) {
+	assert := assert.New(t)
+	ds := mockDataStoreCatalog{services: map[string]osb.Service{}, params: map[string]string{}}
+	db := Db{DataStorePort: ds, Accountuuid: uuid.NewV5(uuid.NullUUID{}.UUID, "123456789012awsservicebroker")}
+	l := cache.NewMemory()
+	c := cache.NewMemory()
+	source := mockCatalogSource{Templates: map[string]string{"localtest": testLocalTemplate}}
+
+	assert.Equal(errCatalogNotLoaded, RefreshTemplates(l, c, source, db, []string{"localtest"}, nil))
+
+	l.Set("__LISTINGS__", []ServiceNeedsUpdate{})
+	assert.NoError(RefreshTemplates(l, c, source, db, []string{"localtest", "missing"}, nil))
+	listings, _ := l.Get("__LISTINGS__")
+	assert.Equal([]ServiceNeedsUpdate{{Name: "localtest"}}, listings)
+	_, err := c.Get("localtest")
+	assert.NoError(err)
+
+	assert.NoError(RefreshTemplates(l, c, source, db, nil, []string{"localtest"}))
+	listings, _ = l.Get("__LISTINGS__")
+	assert.Empty(listings)
+	assert.True(isDeprecated(ds.services[uuid.NewV5(db.Accountuuid, "localtest").String()].Metadata))
+}
+
+func TestWatchCatalogSource(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requests := make(chan CatalogRefreshRequest)
+	go WatchCatalogSource(ctx, 10*time.Millisecond, LocalCatalogSource{Path: dir, Suffix: "-main.yaml"}, requests)
+
+	time.Sleep(50 * time.Millisecond)
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	select {
+	case req := <-requests:
+		assert.Equal(t, refreshTriggerWatch, req.Trigger)
+	case <-time.After(time.Second):
+		t.Fatal("expected a change to be detected")
+	}
+}
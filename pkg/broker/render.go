@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	uuid "github.com/satori/go.uuid"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RenderOptions describe the broker the catalog is rendered for, service and plan IDs are derived from the
+// account and broker IDs
+type RenderOptions struct {
+	AccountID          string
+	BrokerID           string
+	TemplateFilter     string
+	PrescribeOverrides bool
+}
+
+// RenderCatalog generates the catalog a broker would serve for a directory of templates, without calling AWS
+func RenderCatalog(dir string, o RenderOptions) (*osb.CatalogResponse, error) {
+	if o.AccountID == "" {
+		return nil, fmt.Errorf("an account ID is required to generate service and plan IDs")
+	}
+	db := Db{
+		Accountid:   o.AccountID,
+		Accountuuid: uuid.NewV5(uuid.NullUUID{}.UUID, o.AccountID+o.BrokerID),
+		Brokerid:    o.BrokerID,
+	}
+	services := make([]osb.Service, 0)
+	err := walkTemplates(dir, o.TemplateFilter, func(path string, body []byte) error {
+		var t CfnTemplate
+		if err := yaml.Unmarshal(body, &t); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		sd := db.ServiceDefinitionToOsb(t)
+		if sd.Name == "" {
+			return fmt.Errorf("failed to convert %s, run validate for details", path)
+		}
+		setTemplateVersion(&sd, t, body)
+		services = append(services, sd)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	b := &AwsBroker{prescribeOverrides: o.PrescribeOverrides, globalOverrides: getGlobalOverrides(o.BrokerID)}
+	return &osb.CatalogResponse{Services: prescribeOverrides(b, withoutInternalMetadata(services))}, nil
+}
+
+// MarshalCatalog encodes a catalog as "json" or "yaml", with the fields OSBExtensions adds when the catalog is served
+func MarshalCatalog(catalog *osb.CatalogResponse, format string) ([]byte, error) {
+	if format != "json" && format != "yaml" {
+		return nil, fmt.Errorf("unsupported format %q, must be json or yaml", format)
+	}
+	// round trip through json so the field names match the OSB API
+	generic, err := servedCatalog(catalog)
+	if err != nil {
+		return nil, err
+	}
+	if format == "json" {
+		return json.MarshalIndent(generic, "", "  ")
+	}
+	return yaml.Marshal(generic)
+}
+
+// DiffCatalogs describes the differences between two catalogs, one line per change. Services and plans are matched
+// by name, and services or plans that were added or removed are reported as a single line
+func DiffCatalogs(old, new *osb.CatalogResponse) ([]string, error) {
+	oldServices, err := servicesByName(old)
+	if err != nil {
+		return nil, err
+	}
+	newServices, err := servicesByName(new)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for _, name := range unionKeys(oldServices, newServices) {
+		_, inOld := oldServices[name]
+		_, inNew := newServices[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("+ service %s", name))
+			continue
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("- service %s", name))
+			continue
+		}
+		o := oldServices[name].(map[string]interface{})
+		n := newServices[name].(map[string]interface{})
+		oldPlans := o["plans"].(map[string]interface{})
+		newPlans := n["plans"].(map[string]interface{})
+		for _, plan := range unionKeys(oldPlans, newPlans) {
+			_, inOld := oldPlans[plan]
+			_, inNew := newPlans[plan]
+			if !inOld {
+				changes = append(changes, fmt.Sprintf("+ service %s plan %s", name, plan))
+				delete(newPlans, plan)
+			} else if !inNew {
+				changes = append(changes, fmt.Sprintf("- service %s plan %s", name, plan))
+				delete(oldPlans, plan)
+			}
+		}
+		oldFlat := make(map[string]string)
+		flatten(name, o, oldFlat)
+		newFlat := make(map[string]string)
+		flatten(name, n, newFlat)
+		for _, path := range unionStringKeys(oldFlat, newFlat) {
+			o, inOld := oldFlat[path]
+			n, inNew := newFlat[path]
+			switch {
+			case !inOld:
+				changes = append(changes, fmt.Sprintf("+ %s: %s", path, n))
+			case !inNew:
+				changes = append(changes, fmt.Sprintf("- %s: %s", path, o))
+			case o != n:
+				changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", path, o, n))
+			}
+		}
+	}
+	return changes, nil
+}
+
+// servedCatalog converts a catalog into a generic map as OSBExtensions serves it
+func servedCatalog(catalog *osb.CatalogResponse) (map[string]interface{}, error) {
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = promoteCatalogFields(b); err != nil {
+		return nil, err
+	}
+	var generic map[string]interface{}
+	err = json.Unmarshal(b, &generic)
+	return generic, err
+}
+
+// servicesByName converts services into generic maps as they're served, with plans keyed by name rather than position
+func servicesByName(catalog *osb.CatalogResponse) (map[string]interface{}, error) {
+	generic, err := servedCatalog(catalog)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string]interface{})
+	list, _ := generic["services"].([]interface{})
+	for _, s := range list {
+		service := s.(map[string]interface{})
+		plans := make(map[string]interface{})
+		if list, ok := service["plans"].([]interface{}); ok {
+			for _, p := range list {
+				plan := p.(map[string]interface{})
+				plans[fmt.Sprint(plan["name"])] = plan
+			}
+		}
+		service["plans"] = plans
+		services[fmt.Sprint(service["name"])] = service
+	}
+	return services, nil
+}
+
+// flatten records every leaf value in v under its dotted path, lists of scalars are kept as a single value
+func flatten(path string, v interface{}, out map[string]string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			flatten(path+"."+k, child, out)
+		}
+	case []interface{}:
+		for _, child := range value {
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				for i, child := range value {
+					flatten(fmt.Sprintf("%s[%d]", path, i), child, out)
+				}
+				return
+			}
+		}
+		b, _ := json.Marshal(value)
+		out[path] = string(b)
+	default:
+		b, _ := json.Marshal(value)
+		out[path] = string(b)
+	}
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return sortedKeys(keys)
+}
+
+func unionStringKeys(a, b map[string]string) []string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return sortedKeys(keys)
+}
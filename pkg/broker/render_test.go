@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderCatalog(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	o := RenderOptions{AccountID: "123456789012", BrokerID: "awsservicebroker", TemplateFilter: "-main.yaml"}
+
+	c, err := RenderCatalog(dir, o)
+	assert.NoError(t, err)
+	assert.Len(t, c.Services, 1)
+	assert.Equal(t, "localtest", c.Services[0].Name)
+	assert.Equal(t, "default", c.Services[0].Plans[0].Name)
+
+	again, err := RenderCatalog(dir, o)
+	assert.NoError(t, err)
+	first, _ := MarshalCatalog(c, "json")
+	second, _ := MarshalCatalog(again, "json")
+	assert.Equal(t, string(first), string(second), "rendering should be deterministic")
+
+	y, err := MarshalCatalog(c, "yaml")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(y), "services:\n"))
+	assert.Contains(t, string(y), "plan_updateable: false")
+	assert.Contains(t, string(y), "allow_context_updates: true", "the catalog should have the fields added when it's served")
+	assert.Contains(t, string(y), "    maintenance_info:\n")
+	assert.NotContains(t, string(y), "maintenanceInfo")
+	_, err = MarshalCatalog(c, "xml")
+	assert.Error(t, err)
+
+	_, err = RenderCatalog(dir, RenderOptions{BrokerID: "awsservicebroker", TemplateFilter: "-main.yaml"})
+	assert.Error(t, err)
+
+	writeTestTemplate(t, dir, "broken-main.yaml", "Parameters: [")
+	_, err = RenderCatalog(dir, o)
+	assert.Error(t, err)
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	oldDir := t.TempDir()
+	newDir := t.TempDir()
+	o := RenderOptions{AccountID: "123456789012", BrokerID: "awsservicebroker", TemplateFilter: "-main.yaml"}
+	writeTestTemplate(t, oldDir, "localtest-main.yaml", testLocalTemplate)
+	writeTestTemplate(t, oldDir, "removed-main.yaml", strings.Replace(testLocalTemplate, "Name: localtest", "Name: removed", 1))
+	changed := strings.Replace(testLocalTemplate, "Default: test", "Default: changed", 1)
+	changed = strings.Replace(changed, "        Description: default plan\n", "        Description: default plan\n      extra:\n        Description: extra plan\n", 1)
+	writeTestTemplate(t, newDir, "localtest-main.yaml", changed)
+
+	oldCatalog, err := RenderCatalog(oldDir, o)
+	assert.NoError(t, err)
+	newCatalog, err := RenderCatalog(newDir, o)
+	assert.NoError(t, err)
+
+	oldVersion := templateVersion([]byte(testLocalTemplate))
+	newVersion := templateVersion([]byte(changed))
+	changes, err := DiffCatalogs(oldCatalog, newCatalog)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"+ service localtest plan extra",
+		fmt.Sprintf(`~ localtest.metadata.templateVersion: "%s" -> "%s"`, oldVersion, newVersion),
+		fmt.Sprintf(`~ localtest.plans.default.maintenance_info.version: "0.0.0+%s" -> "0.0.0+%s"`, oldVersion[:12], newVersion[:12]),
+		`~ localtest.plans.default.schemas.service_instance.create.parameters.properties.BucketName.default: "test" -> "changed"`,
+		"- service removed",
+	}, changes)
+
+	changes, err = DiffCatalogs(oldCatalog, oldCatalog)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
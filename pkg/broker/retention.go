@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// getRetentionPolicy returns the retention policy of an instance. The deletion_protection and final_snapshot
+// overrides for the instance's cluster, namespace or service take precedence over its plan's policy. The service and
+// plan are nil if they were removed from the catalog
+func (b *AwsBroker) getRetentionPolicy(instance *serviceinstance.ServiceInstance, service *osb.Service, plan *osb.Plan) (policy RetentionPolicy) {
+	if plan != nil {
+		if v, ok := plan.Metadata["retentionPolicy"]; ok {
+			b, err := json.Marshal(v)
+			if err == nil {
+				err = json.Unmarshal(b, &policy)
+			}
+			if err != nil {
+				glog.Errorf("Failed to parse the retention policy of plan %q: %v", plan.Name, err)
+			}
+		}
+	}
+	var serviceName string
+	if service != nil {
+		serviceName = service.Name
+	}
+	overrides := getOverrides(b.brokerid, []string{deletionProtectionOverride, finalSnapshotOverride}, getNamespace(instance.Context), serviceName, getCluster(instance.Context))
+	for k, v := range overrides {
+		value, err := strconv.ParseBool(v)
+		if err != nil {
+			glog.Errorf("Ignoring the %s override %q of service instance %s: %v", k, v, instance.ID, err)
+			continue
+		}
+		switch k {
+		case deletionProtectionOverride:
+			policy.DeletionProtection = value
+		case finalSnapshotOverride:
+			policy.FinalSnapshot = value
+		}
+	}
+	return policy
+}
+
+// getFinalSnapshotParameter returns the parameter the service's template takes a final snapshot with, if any
+func getFinalSnapshotParameter(service *osb.Service) string {
+	if service == nil {
+		return ""
+	}
+	p, _ := service.Metadata["finalSnapshotParameter"].(string)
+	return p
+}
+
+// isStackCreateFailed returns true if a stack failed to create, so it holds no data to protect
+func isStackCreateFailed(status string) bool {
+	return stringInSlice(status, []string{
+		cloudformation.StackStatusCreateFailed,
+		cloudformation.StackStatusRollbackInProgress,
+		cloudformation.StackStatusRollbackFailed,
+		cloudformation.StackStatusRollbackComplete,
+	})
+}
+
+// deleteInstanceStack starts deprovisioning an instance according to its retention policy and records the deprovision
+// operation, the caller is responsible for storing the instance. Instances protected from deletion are refused unless
+// their stack failed to create. If a final snapshot is taken, the stack is updated with the template's
+// FinalSnapshotParameter set to "true" first and deleted by continueDeprovision once the update completes
+func (b *AwsBroker) deleteInstanceStack(cfnSvc CfnClient, instance *serviceinstance.ServiceInstance, service *osb.Service, plan *osb.Plan, stackStatus string) (*serviceinstance.Operation, error) {
+	policy := b.getRetentionPolicy(instance, service, plan)
+	if policy.DeletionProtection && !isStackCreateFailed(stackStatus) {
+		desc := fmt.Sprintf("The service instance %s is protected from deletion, its plan or a %s override must disable deletion protection before it can be deprovisioned.", instance.ID, deletionProtectionOverride)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	if param := getFinalSnapshotParameter(service); policy.FinalSnapshot && param != "" && !isStackCreateFailed(stackStatus) && stackStatus != cloudformation.StackStatusDeleteFailed {
+		started, err := b.takeFinalSnapshot(cfnSvc, instance, service, plan, param)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to update the CloudFormation stack %s to take a final snapshot: %v", instance.StackID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		if started {
+			op := startOperation(instance, serviceinstance.OperationDeprovision, stackStatus, nil)
+			op.PendingDelete = true
+			op.RetainResources = policy.RetainResources
+			return op, nil
+		}
+	}
+
+	if err := deleteStack(cfnSvc, instance, stackStatus, policy.RetainResources); err != nil {
+		desc := fmt.Sprintf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	op := startOperation(instance, serviceinstance.OperationDeprovision, stackStatus, nil)
+	if stackStatus != cloudformation.StackStatusDeleteFailed {
+		op.RetainResources = policy.RetainResources
+	}
+	return op, nil
+}
+
+// takeFinalSnapshot updates an instance's stack with the final snapshot parameter set. It returns false if the
+// parameter was already set, so the stack can be deleted right away
+func (b *AwsBroker) takeFinalSnapshot(cfnSvc CfnClient, instance *serviceinstance.ServiceInstance, service *osb.Service, plan *osb.Plan, param string) (bool, error) {
+	params := make(map[string]string)
+	for k, v := range instance.Params {
+		params[k] = v
+	}
+	params[param] = "true"
+	input := &cloudformation.UpdateStackInput{
+		Capabilities:        aws.StringSlice(getCapabilities(service)),
+		Parameters:          toCFNParams(params),
+		RoleARN:             stackRoleARN(instance),
+		StackName:           aws.String(instance.StackID),
+		UsePreviousTemplate: aws.Bool(true),
+	}
+	var err error
+	if usesTransform(service) {
+		err = updateStackWithChangeSet(cfnSvc, input, nil)
+	} else {
+		_, err = cfnSvc.Client.UpdateStack(input)
+	}
+	if isNoUpdatesError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	glog.Infof("Taking a final snapshot of service instance %s before deleting CloudFormation stack %s", instance.ID, instance.StackID)
+	return true, nil
+}
+
+// deleteStack deletes an instance's stack. A stack that failed to delete keeps those of the resources to retain that
+// couldn't be deleted
+func deleteStack(cfnSvc CfnClient, instance *serviceinstance.ServiceInstance, stackStatus string, retain []string) error {
+	input := &cloudformation.DeleteStackInput{RoleARN: stackRoleARN(instance), StackName: aws.String(instance.StackID)}
+	if stackStatus == cloudformation.StackStatusDeleteFailed && len(retain) > 0 {
+		// CloudFormation only accepts resources that failed to delete
+		resp, err := cfnSvc.Client.DescribeStackResources(&cloudformation.DescribeStackResourcesInput{StackName: aws.String(instance.StackID)})
+		if err != nil {
+			return err
+		}
+		for _, r := range resp.StackResources {
+			id := aws.StringValue(r.LogicalResourceId)
+			if aws.StringValue(r.ResourceStatus) == cloudformation.ResourceStatusDeleteFailed && stringInSlice(id, retain) {
+				input.RetainResources = append(input.RetainResources, aws.String(id))
+			}
+		}
+		if len(input.RetainResources) > 0 {
+			glog.Infof("Retaining resources %v of CloudFormation stack %s", aws.StringValueSlice(input.RetainResources), instance.StackID)
+		}
+	}
+	return deleteStackInput(cfnSvc, input)
+}
+
+// deleteStackInput deletes a stack, disabling its termination protection if it's enabled. Termination protection
+// guards stacks against being deleted outside the broker, whether the broker deletes a stack is decided by the
+// instance's retention policy
+func deleteStackInput(cfnSvc CfnClient, input *cloudformation.DeleteStackInput) error {
+	_, err := cfnSvc.Client.DeleteStack(input)
+	if !isTerminationProtectedError(err) {
+		return err
+	}
+	glog.Infof("Disabling the termination protection of CloudFormation stack %s to delete it", aws.StringValue(input.StackName))
+	if _, err := cfnSvc.Client.UpdateTerminationProtection(&cloudformation.UpdateTerminationProtectionInput{
+		EnableTerminationProtection: aws.Bool(false),
+		StackName:                   input.StackName,
+	}); err != nil {
+		return err
+	}
+	_, err = cfnSvc.Client.DeleteStack(input)
+	return err
+}
+
+// isTerminationProtectedError returns true if CloudFormation refused to delete a stack because its termination
+// protection is enabled
+func isTerminationProtectedError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "TerminationProtection is enabled")
+	}
+	return false
+}
+
+// continueDeprovision starts the next step of a deprovision operation once its stack reaches status: the stack is
+// deleted once the final snapshot has been taken, and deleting it is retried keeping the resources to retain if it
+// failed. It returns a description of the step started, or an empty string if there's none
+func (b *AwsBroker) continueDeprovision(cfnSvc CfnClient, instance *serviceinstance.ServiceInstance, op *serviceinstance.Operation, status string) string {
+	if op == nil || op.Type != serviceinstance.OperationDeprovision {
+		return ""
+	}
+	var desc string
+	switch {
+	case op.PendingDelete && status == cloudformation.StackStatusUpdateComplete:
+		if err := deleteStack(cfnSvc, instance, status, nil); err != nil {
+			glog.Errorf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
+			return ""
+		}
+		op.PendingDelete = false
+		desc = "The final snapshot was taken, the stack is being deleted."
+	case !op.PendingDelete && status == cloudformation.StackStatusDeleteFailed && len(op.RetainResources) > 0:
+		// The delete is only retried once
+		retain := op.RetainResources
+		op.RetainResources = nil
+		if err := deleteStack(cfnSvc, instance, status, retain); err != nil {
+			glog.Errorf("Failed to delete the CloudFormation stack %s: %v", instance.StackID, err)
+			return ""
+		}
+		desc = "Deleting the stack failed, it is being deleted again keeping the resources to retain."
+	default:
+		return ""
+	}
+	if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+		glog.Errorf("Failed to record the deprovision operation for service instance %s: %v", instance.ID, err)
+	}
+	return desc
+}
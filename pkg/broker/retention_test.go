@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockCfnRetention records the stack updates and deletes made
+type mockCfnRetention struct {
+	mockCfn
+	resources []*cloudformation.StackResource
+	update    *cloudformation.UpdateStackInput
+	deletes   []*cloudformation.DeleteStackInput
+	// terminationProtected refuses to delete the stack until its termination protection is disabled
+	terminationProtected bool
+}
+
+func (m *mockCfnRetention) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
+	m.update = in
+	return m.mockCfn.UpdateStack(in)
+}
+
+func (m *mockCfnRetention) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	m.deletes = append(m.deletes, in)
+	if m.terminationProtected {
+		return nil, awserr.New("ValidationError", "Stack ["+aws.StringValue(in.StackName)+"] cannot be deleted while TerminationProtection is enabled", nil)
+	}
+	return m.mockCfn.DeleteStack(in)
+}
+
+func (m *mockCfnRetention) UpdateTerminationProtection(in *cloudformation.UpdateTerminationProtectionInput) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	m.terminationProtected = aws.BoolValue(in.EnableTerminationProtection)
+	return &cloudformation.UpdateTerminationProtectionOutput{}, nil
+}
+
+func (m *mockCfnRetention) DescribeStackResources(in *cloudformation.DescribeStackResourcesInput) (*cloudformation.DescribeStackResourcesOutput, error) {
+	return &cloudformation.DescribeStackResourcesOutput{StackResources: m.resources}, nil
+}
+
+func retentionPlan(policy RetentionPolicy) *osb.Plan {
+	return &osb.Plan{Name: "test-plan", Metadata: map[string]interface{}{"retentionPolicy": policy}}
+}
+
+func TestGetRetentionPolicy(t *testing.T) {
+	assert := assert.New(t)
+	b := &AwsBroker{brokerid: "awsservicebroker"}
+	instance := &serviceinstance.ServiceInstance{ID: "i1", Context: map[string]interface{}{"platform": "kubernetes", "namespace": "prod", "clusterid": "c1"}}
+	service := &osb.Service{Name: "retention-service"}
+
+	assert.Equal(RetentionPolicy{}, b.getRetentionPolicy(instance, nil, nil))
+	plan := retentionPlan(RetentionPolicy{DeletionProtection: true, RetainResources: []string{"Bucket"}})
+	assert.Equal(RetentionPolicy{DeletionProtection: true, RetainResources: []string{"Bucket"}}, b.getRetentionPolicy(instance, service, plan))
+
+	os.Setenv("PARAM_OVERRIDE_awsservicebroker_all_prod_retention-service_deletion_protection", "false")
+	os.Setenv("PARAM_OVERRIDE_awsservicebroker_all_all_retention-service_final_snapshot", "true")
+	defer os.Unsetenv("PARAM_OVERRIDE_awsservicebroker_all_prod_retention-service_deletion_protection")
+	defer os.Unsetenv("PARAM_OVERRIDE_awsservicebroker_all_all_retention-service_final_snapshot")
+	assert.Equal(RetentionPolicy{FinalSnapshot: true, RetainResources: []string{"Bucket"}}, b.getRetentionPolicy(instance, service, plan))
+
+	// invalid overrides are ignored
+	os.Setenv("PARAM_OVERRIDE_awsservicebroker_c1_prod_retention-service_final_snapshot", "not-a-bool")
+	defer os.Unsetenv("PARAM_OVERRIDE_awsservicebroker_c1_prod_retention-service_final_snapshot")
+	assert.Equal(RetentionPolicy{RetainResources: []string{"Bucket"}}, b.getRetentionPolicy(instance, service, plan))
+}
+
+func TestDeleteInstanceStack(t *testing.T) {
+	assert := assert.New(t)
+	b := &AwsBroker{brokerid: "awsservicebroker"}
+	service := &osb.Service{Name: "test-service", Metadata: map[string]interface{}{"finalSnapshotParameter": "TakeFinalSnapshot"}}
+	newInstance := func() *serviceinstance.ServiceInstance {
+		return &serviceinstance.ServiceInstance{ID: "i1", StackID: "stack-i1", Params: map[string]string{"req_param": "value"}}
+	}
+
+	// protected instances are refused unless their stack failed to create
+	cfn := &mockCfnRetention{terminationProtected: true}
+	plan := retentionPlan(RetentionPolicy{DeletionProtection: true})
+	_, err := b.deleteInstanceStack(CfnClient{cfn}, newInstance(), service, plan, cloudformation.StackStatusCreateComplete)
+	assert.Equal(newHTTPStatusCodeError(http.StatusBadRequest, "", "The service instance i1 is protected from deletion, its plan or a deletion_protection override must disable deletion protection before it can be deprovisioned."), err)
+	assert.Empty(cfn.deletes)
+	assert.True(cfn.terminationProtected)
+	op, err := b.deleteInstanceStack(CfnClient{cfn}, newInstance(), service, plan, cloudformation.StackStatusRollbackComplete)
+	assert.NoError(err)
+	assert.Equal(serviceinstance.OperationDeprovision, op.Type)
+	assert.Len(cfn.deletes, 2)
+	assert.False(cfn.terminationProtected)
+
+	// the termination protection of stacks the retention policy lets be deleted is disabled
+	cfn = &mockCfnRetention{terminationProtected: true}
+	plan = &osb.Plan{Name: "test-plan", Metadata: map[string]interface{}{"stackOptions": StackOptions{EnableTerminationProtection: true}}}
+	_, err = b.deleteInstanceStack(CfnClient{cfn}, newInstance(), service, plan, cloudformation.StackStatusUpdateComplete)
+	assert.NoError(err)
+	assert.Len(cfn.deletes, 2)
+	assert.False(cfn.terminationProtected)
+
+	// a final snapshot is taken before the stack is deleted
+	cfn = &mockCfnRetention{}
+	plan = retentionPlan(RetentionPolicy{FinalSnapshot: true, RetainResources: []string{"Bucket"}})
+	op, err = b.deleteInstanceStack(CfnClient{cfn}, newInstance(), service, plan, cloudformation.StackStatusUpdateComplete)
+	assert.NoError(err)
+	assert.True(op.PendingDelete)
+	assert.Equal([]string{"Bucket"}, op.RetainResources)
+	assert.Empty(cfn.deletes)
+	assert.ElementsMatch(toCFNParams(map[string]string{"req_param": "value", "TakeFinalSnapshot": "true"}), cfn.update.Parameters)
+
+	// unless it was already taken
+	instance := newInstance()
+	instance.StackID = "no-updates"
+	op, err = b.deleteInstanceStack(CfnClient{cfn}, instance, service, plan, cloudformation.StackStatusUpdateComplete)
+	assert.NoError(err)
+	assert.False(op.PendingDelete)
+	assert.Len(cfn.deletes, 1)
+
+	// or the template doesn't support one
+	cfn = &mockCfnRetention{}
+	op, err = b.deleteInstanceStack(CfnClient{cfn}, newInstance(), &osb.Service{Name: "test-service"}, plan, cloudformation.StackStatusUpdateComplete)
+	assert.NoError(err)
+	assert.False(op.PendingDelete)
+	assert.Nil(cfn.update)
+	assert.Len(cfn.deletes, 1)
+	assert.Empty(cfn.deletes[0].RetainResources)
+}
+
+func TestContinueDeprovision(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign()
+	b := &AwsBroker{brokerid: "awsservicebroker", db: Db{DataStorePort: db}}
+	cfn := &mockCfnRetention{resources: []*cloudformation.StackResource{
+		{LogicalResourceId: aws.String("Bucket"), ResourceStatus: aws.String(cloudformation.ResourceStatusDeleteFailed)},
+		{LogicalResourceId: aws.String("Table"), ResourceStatus: aws.String(cloudformation.ResourceStatusDeleteFailed)},
+		{LogicalResourceId: aws.String("Queue"), ResourceStatus: aws.String(cloudformation.ResourceStatusDeleteComplete)},
+	}}
+	instance := &serviceinstance.ServiceInstance{ID: "i1", StackID: "stack-i1"}
+	op := &serviceinstance.Operation{Type: serviceinstance.OperationDeprovision, PendingDelete: true, RetainResources: []string{"Bucket", "Queue"}}
+
+	assert.Equal("", b.continueDeprovision(CfnClient{cfn}, instance, op, cloudformation.StackStatusUpdateInProgress))
+	assert.Equal("", b.continueDeprovision(CfnClient{cfn}, instance, &serviceinstance.Operation{Type: serviceinstance.OperationUpdate}, cloudformation.StackStatusUpdateComplete))
+	assert.Empty(cfn.deletes)
+
+	// the stack is deleted once the final snapshot was taken
+	assert.Equal("The final snapshot was taken, the stack is being deleted.", b.continueDeprovision(CfnClient{cfn}, instance, op, cloudformation.StackStatusUpdateComplete))
+	assert.False(op.PendingDelete)
+	assert.Len(cfn.deletes, 1)
+	assert.Empty(cfn.deletes[0].RetainResources)
+	assert.Contains(db.instances, "i1")
+
+	// and deleted again once if it failed, keeping the resources to retain that couldn't be deleted
+	assert.Equal("Deleting the stack failed, it is being deleted again keeping the resources to retain.", b.continueDeprovision(CfnClient{cfn}, instance, op, cloudformation.StackStatusDeleteFailed))
+	assert.Len(cfn.deletes, 2)
+	assert.Equal([]string{"Bucket"}, aws.StringValueSlice(cfn.deletes[1].RetainResources))
+	assert.Equal("", b.continueDeprovision(CfnClient{cfn}, instance, op, cloudformation.StackStatusDeleteFailed))
+	assert.Len(cfn.deletes, 2)
+}
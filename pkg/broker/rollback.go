@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// reconcileUpdate restores the previous values of an instance whose latest update rolled back without the platform
+// polling for it, so the instance matches its stack before it's changed again
+func (b *AwsBroker) reconcileUpdate(instance *serviceinstance.ServiceInstance) {
+	op, _ := findOperation(instance, "")
+	if op == nil || op.Type != serviceinstance.OperationUpdate || op.State != "" || op.PreviousParams == nil {
+		return
+	}
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	status, err := getStackStatus(cfnSvc, instance.StackID)
+	if err != nil {
+		glog.Errorf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+		return
+	}
+	if status == cloudformation.StackStatusUpdateRollbackComplete {
+		desc := fmt.Sprintf("The CloudFormation stack %s finished with status %s.", instance.StackID, status)
+		b.restorePreviousValues(instance, op, desc)
+	}
+}
+
+// restorePreviousValues records that an update failed and rolled back, restoring the parameters, plan and template
+// version the instance had before it
+func (b *AwsBroker) restorePreviousValues(instance *serviceinstance.ServiceInstance, op *serviceinstance.Operation, description string) {
+	if op.PreviousParams != nil {
+		glog.Infof("Restoring the previous parameters of service instance %s, its update rolled back", instance.ID)
+		instance.Params = op.PreviousParams
+		instance.PlanID = op.PreviousPlanID
+		instance.TemplateVersion = op.PreviousTemplateVersion
+	}
+	op.State = string(osb.StateFailed)
+	op.Description = description
+	if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+		glog.Errorf("Failed to restore the previous parameters of service instance %s: %v", instance.ID, err)
+	}
+}
+
+// ContinueUpdateRollback continues rolling back the stack of an instance whose update failed to roll back, skipping
+// resources that can't be rolled back
+func (b *AwsBroker) ContinueUpdateRollback(id string, resourcesToSkip []string) error {
+	instance, err := b.db.DataStorePort.GetServiceInstance(id)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %q: %v", id, err)
+		return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %q was not found.", id)
+		return newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	status, err := getStackStatus(cfnSvc, instance.StackID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to describe the CloudFormation stack %q: %v", instance.StackID, err)
+		return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if status != cloudformation.StackStatusUpdateRollbackFailed {
+		desc := fmt.Sprintf("The CloudFormation stack %q has status %s, only a failed update rollback can be continued.", instance.StackID, status)
+		return newHTTPStatusCodeError(http.StatusConflict, "", desc)
+	}
+
+	op, _ := findOperation(instance, "")
+	if op != nil && op.Type != serviceinstance.OperationUpdate {
+		op = nil
+	}
+	if err := b.continueUpdateRollback(cfnSvc, instance, op, resourcesToSkip); err != nil {
+		desc := fmt.Sprintf("Failed to continue rolling back the CloudFormation stack %q: %v", instance.StackID, err)
+		return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	return nil
+}
+
+// continueUpdateRollback continues rolling back an instance's stack, recording it on the update operation if given
+func (b *AwsBroker) continueUpdateRollback(cfnSvc CfnClient, instance *serviceinstance.ServiceInstance, op *serviceinstance.Operation, resourcesToSkip []string) error {
+	glog.Infof("Continuing to roll back the CloudFormation stack %s of service instance %s, skipping %v", instance.StackID, instance.ID, resourcesToSkip)
+	input := &cloudformation.ContinueUpdateRollbackInput{
+		RoleARN:   stackRoleARN(instance),
+		StackName: aws.String(instance.StackID),
+	}
+	if len(resourcesToSkip) > 0 {
+		input.ResourcesToSkip = aws.StringSlice(resourcesToSkip)
+	}
+	if _, err := cfnSvc.Client.ContinueUpdateRollback(input); err != nil {
+		return err
+	}
+	if op != nil {
+		op.RollbackContinued = true
+		if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+			glog.Errorf("Failed to record continuing the rollback of service instance %s: %v", instance.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateRollback(t *testing.T) {
+	assert := assert.New(t)
+	db := newMockDataStoreCampaign(serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1", Params: map[string]string{"req_param": "old"}, TemplateVersion: "v1"})
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{"stack-i1": cloudformation.StackStatusCreateComplete}}
+	b := newCampaignTestBroker(db, cfn)
+	update := func(value string) (*broker.UpdateInstanceResponse, error) {
+		return b.Update(&osb.UpdateInstanceRequest{
+			InstanceID:        "i1",
+			ServiceID:         "test-service-id",
+			AcceptsIncomplete: true,
+			Parameters:        map[string]interface{}{"req_param": value},
+		}, &broker.RequestContext{})
+	}
+	lastOperation := func() *broker.LastOperationResponse {
+		resp, err := b.LastOperation(&osb.LastOperationRequest{InstanceID: "i1"}, &broker.RequestContext{Request: &http.Request{Header: http.Header{}}})
+		assert.NoError(err)
+		return resp
+	}
+
+	// the previous parameters are restored once the update has rolled back
+	_, err := update("new")
+	assert.NoError(err)
+	assert.Equal("new", db.instances["i1"].Params["req_param"])
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackInProgress)
+	assert.Equal(osb.StateInProgress, lastOperation().State)
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackComplete)
+	assert.Equal(osb.StateFailed, lastOperation().State)
+	assert.Equal("old", db.instances["i1"].Params["req_param"])
+	assert.Equal("v1", db.instances["i1"].TemplateVersion)
+	assert.Equal(osb.StateFailed, lastOperation().State)
+
+	// or before the instance is changed again if the platform didn't poll for the result
+	_, err = update("new")
+	assert.NoError(err)
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackComplete)
+	resp, err := update("old")
+	assert.NoError(err)
+	assert.False(resp.Async, "the instance should already have the requested parameters")
+	assert.Equal("old", db.instances["i1"].Params["req_param"])
+
+	// a failed rollback is continued once
+	_, err = update("new")
+	assert.NoError(err)
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackFailed)
+	assert.Equal(osb.StateInProgress, lastOperation().State)
+	assert.Equal(cloudformation.StackStatusUpdateRollbackInProgress, cfn.statuses["stack-i1"])
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackFailed)
+	assert.Equal(osb.StateFailed, lastOperation().State)
+	assert.Equal(cloudformation.StackStatusUpdateRollbackFailed, cfn.statuses["stack-i1"])
+	assert.Equal("new", db.instances["i1"].Params["req_param"])
+
+	// after which it's left to the admin API
+	handler := b.AdminHandler("secret")
+	serve := func(url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(http.StatusNotFound, serve("/admin/instances/i1/rollback", "").Code)
+	w := serve("/admin/instances/foo/continue-rollback", "")
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.JSONEq(`{"error": "ContinueRollbackFailed", "description": "The service instance \"foo\" was not found."}`, w.Body.String())
+	assert.Equal(http.StatusBadRequest, serve("/admin/instances/i1/continue-rollback", "[").Code)
+
+	w = serve("/admin/instances/i1/continue-rollback", `{"resources_to_skip": ["Bucket"]}`)
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.JSONEq(`{"status": "rolling-back"}`, w.Body.String())
+	w = serve("/admin/instances/i1/continue-rollback", "")
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.JSONEq(`{"error": "ContinueRollbackFailed", "description": "The CloudFormation stack \"stack-i1\" has status UPDATE_ROLLBACK_IN_PROGRESS, only a failed update rollback can be continued."}`, w.Body.String())
+
+	cfn.set("stack-i1", cloudformation.StackStatusUpdateRollbackComplete)
+	assert.Equal(osb.StateFailed, lastOperation().State)
+	assert.Equal("old", db.instances["i1"].Params["req_param"])
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+// validateParameters checks parameters against the properties of a plan's create or update schema, returning a
+// message for every problem found. Parameters without a property are not checked. Values are checked in the form they
+// are passed to CloudFormation, so numbers may be sent as strings and lists as comma delimited strings
+func validateParameters(schema interface{}, params map[string]interface{}) []string {
+	var errs []string
+	s, _ := schema.(map[string]interface{})
+	properties, _ := s["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(params) {
+		property, ok := properties[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		description, _ := property["constraint_description"].(string)
+		errs = append(errs, validateValue(name, property, description, params[name])...)
+	}
+	return errs
+}
+
+func validateValue(name string, property map[string]interface{}, description string, v interface{}) []string {
+	var errs []string
+	report := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf("The parameter %s %s.", name, fmt.Sprintf(format, a...)))
+	}
+	violated := func(format string, a ...interface{}) {
+		if description != "" {
+			format += " (" + strings.TrimSuffix(description, ".") + ")"
+		}
+		report(format, a...)
+	}
+
+	switch property["type"] {
+	case "array":
+		var items []interface{}
+		switch value := v.(type) {
+		case []interface{}:
+			items = value
+		case string:
+			for _, item := range splitListParam(value) {
+				items = append(items, item)
+			}
+		default:
+			report("must be a list")
+			return errs
+		}
+		itemProperty, _ := property["items"].(map[string]interface{})
+		for i, item := range items {
+			errs = append(errs, validateValue(fmt.Sprintf("%s[%d]", name, i), itemProperty, description, item)...)
+		}
+		return errs
+	case "integer":
+		n, err := strconv.ParseFloat(paramValue(v), 64)
+		if err != nil || n != math.Trunc(n) {
+			report("must be an integer")
+			return errs
+		}
+		if min, ok := schemaNumber(property["minimum"]); ok && n < min {
+			violated("must be at least %s", strconv.FormatFloat(min, 'f', -1, 64))
+		}
+		if max, ok := schemaNumber(property["maximum"]); ok && n > max {
+			violated("must be at most %s", strconv.FormatFloat(max, 'f', -1, 64))
+		}
+	default:
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			report("must be a string")
+			return errs
+		}
+		value := paramValue(v)
+		length := float64(utf8.RuneCountInString(value))
+		if min, ok := schemaNumber(property["minLength"]); ok && length < min {
+			violated("must be at least %v characters long", min)
+		}
+		if max, ok := schemaNumber(property["maxLength"]); ok && length > max {
+			violated("must be at most %v characters long", max)
+		}
+		if pattern, ok := property["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				// CloudFormation patterns are Java regular expressions, those Go can't compile are left to CloudFormation
+				glog.V(1).Infof("Not checking pattern %q for parameter %s: %v", pattern, name, err)
+			} else if !re.MatchString(value) {
+				violated("must match the pattern %s", pattern)
+			}
+		}
+	}
+	if allowed := toStringSlice(property["enum"]); allowed != nil && !stringInSlice(paramValue(v), allowed) {
+		violated("must be one of: %s", strings.Join(allowed, ", "))
+	}
+	return errs
+}
+
+// schemaNumber reads a number from a schema, which is an int when generated and a float64 once stored
+func schemaNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func newParametersError(errs []string) error {
+	return newHTTPStatusCodeError(http.StatusBadRequest, "", strings.Join(errs, " "))
+}
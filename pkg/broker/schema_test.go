@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateParameters(t *testing.T) {
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"Name": map[string]interface{}{
+				"type":                   "string",
+				"pattern":                "^(?:[a-z]+)$",
+				"minLength":              3,
+				"maxLength":              float64(5),
+				"constraint_description": "must be 3-5 lowercase letters.",
+			},
+			"Port":   map[string]interface{}{"type": "integer", "minimum": float64(1024), "maximum": 65535},
+			"Engine": map[string]interface{}{"type": "string", "enum": []interface{}{"mysql", "postgres"}},
+			"Sizes": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "integer", "enum": []string{"1", "2"}},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		params   map[string]interface{}
+		expected []string
+	}{
+		{
+			name:   "valid",
+			params: map[string]interface{}{"Name": "abc", "Port": float64(3306), "Engine": "mysql", "Sizes": []interface{}{float64(1), "2"}, "Other": true},
+		},
+		{
+			name:   "valid_strings",
+			params: map[string]interface{}{"Port": "3306", "Sizes": "1, 2"},
+		},
+		{
+			name:   "invalid_types",
+			params: map[string]interface{}{"Name": []interface{}{"abc"}, "Port": "http", "Sizes": map[string]interface{}{}},
+			expected: []string{
+				"The parameter Name must be a string.",
+				"The parameter Port must be an integer.",
+				"The parameter Sizes must be a list.",
+			},
+		},
+		{
+			name:   "constraints",
+			params: map[string]interface{}{"Name": "ABCDEF", "Port": 80.5, "Engine": "oracle", "Sizes": []interface{}{"3"}},
+			expected: []string{
+				"The parameter Engine must be one of: mysql, postgres.",
+				"The parameter Name must be at most 5 characters long (must be 3-5 lowercase letters).",
+				"The parameter Name must match the pattern ^(?:[a-z]+)$ (must be 3-5 lowercase letters).",
+				"The parameter Port must be an integer.",
+				"The parameter Sizes[0] must be one of: 1, 2.",
+			},
+		},
+		{
+			name:   "range",
+			params: map[string]interface{}{"Name": "a", "Port": float64(70000)},
+			expected: []string{
+				"The parameter Name must be at least 3 characters long (must be 3-5 lowercase letters).",
+				"The parameter Port must be at most 65535.",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, validateParameters(schema, tc.params))
+		})
+	}
+
+	assert.Empty(t, validateParameters(nil, map[string]interface{}{"Name": "A"}))
+
+	// patterns Go can't compile are left to CloudFormation
+	lookahead := map[string]interface{}{"properties": map[string]interface{}{
+		"Password": map[string]interface{}{"type": "string", "pattern": "^(?:(?=.*[0-9])[a-z0-9]+)$"},
+	}}
+	assert.Empty(t, validateParameters(lookahead, map[string]interface{}{"Password": "abc"}))
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// allowsSynchronous returns true if an operation on an instance of the plan can be completed synchronously, either
+// because it's enabled for all plans or because the plan allows it
+func (b *AwsBroker) allowsSynchronous(serviceID string, planID string) bool {
+	if b.synchronous {
+		return true
+	}
+	service, err := b.db.DataStorePort.GetServiceDefinition(serviceID)
+	if err != nil || service == nil {
+		return false
+	}
+	plan := getPlan(service, planID)
+	return plan != nil && isSynchronous(plan)
+}
+
+// waitForOperation waits for the stack of an instance to finish the operation, for platforms that don't accept
+// asynchronous operations. It returns an error describing why the stack failed, or if it didn't finish in time
+func (b *AwsBroker) waitForOperation(ctx context.Context, instance *serviceinstance.ServiceInstance, op *serviceinstance.Operation) error {
+	if op.State == string(osb.StateSucceeded) {
+		return nil
+	}
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	timeout := time.After(b.synchronousTimeout)
+	for {
+		status, err := getStackStatus(cfnSvc, instance.StackID)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+			return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		state := operationState(op.Type, status)
+		if state != osb.StateInProgress && b.continueDeprovision(cfnSvc, instance, op, status) != "" {
+			state = osb.StateInProgress
+		}
+		switch state {
+		case osb.StateSucceeded:
+			return nil
+		case osb.StateFailed:
+			glog.Errorf("CloudFormation stack %s failed with status %s", instance.StackID, status)
+			desc := *getCfnError(instance.StackID, cfnSvc)
+			if desc == "" {
+				desc = fmt.Sprintf("The CloudFormation stack %s finished with status %s.", instance.StackID, status)
+			}
+			if b.orphanMitigation && op.Type == serviceinstance.OperationProvision {
+				b.recordOrphan(instance, op, desc)
+			}
+			if status == cloudformation.StackStatusUpdateRollbackComplete && op.Type == serviceinstance.OperationUpdate {
+				b.restorePreviousValues(instance, op, desc)
+			}
+			return newHTTPStatusCodeError(http.StatusInternalServerError, "CloudFormationError", desc)
+		}
+
+		select {
+		case <-ctx.Done():
+			desc := fmt.Sprintf("The request was cancelled while the CloudFormation stack %s had status %s.", instance.StackID, status)
+			return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		case <-timeout:
+			desc := fmt.Sprintf("The CloudFormation stack %s did not finish within %v, its status is %s.", instance.StackID, b.synchronousTimeout, status)
+			return newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		case <-time.After(SynchronousPollInterval):
+		}
+	}
+}
+
+// requestContext returns the context of the HTTP request, which is cancelled if the platform disconnects
+func requestContext(c *broker.RequestContext) context.Context {
+	if c != nil && c.Request != nil {
+		return c.Request.Context()
+	}
+	return context.Background()
+}
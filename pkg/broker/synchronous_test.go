@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSynchronousOperations(t *testing.T) {
+	assert := assert.New(t)
+	defer func(interval time.Duration) { SynchronousPollInterval = interval }(SynchronousPollInterval)
+	SynchronousPollInterval = time.Millisecond
+
+	db := newMockDataStoreCampaign()
+	cfn := mockCfnStackStatus{mu: &sync.Mutex{}, statuses: map[string]string{}}
+	b := newCampaignTestBroker(db, cfn)
+	b.synchronousTimeout = time.Second
+	stack := getStackName("test-service-name", "i1")
+
+	// finish runs a synchronous operation, setting the stack status once the operation has started it
+	finish := func(operation func() error, started string, status string) error {
+		cfn.set(stack, "")
+		errs := make(chan error)
+		go func() { errs <- operation() }()
+		assert.Eventually(func() bool {
+			cfn.mu.Lock()
+			defer cfn.mu.Unlock()
+			return cfn.statuses[stack] == started
+		}, time.Second, time.Millisecond)
+		cfn.set(stack, status)
+		return <-errs
+	}
+	provision := func(planID string) (*broker.ProvisionResponse, error) {
+		return b.Provision(&osb.ProvisionRequest{
+			InstanceID: "i1",
+			ServiceID:  "test-service-id",
+			PlanID:     planID,
+			Parameters: map[string]interface{}{"req_param": "pval"},
+		}, &broker.RequestContext{})
+	}
+
+	// only plans that allow it complete synchronously unless it's enabled for all plans
+	_, err := provision("test-plan-id")
+	assert.Equal(newAsyncError(), err)
+	assert.False(b.allowsSynchronous("test-service-id", "test-plan-id"))
+	assert.True(b.allowsSynchronous("test-service-id", "production-plan-id"))
+	b.synchronous = true
+
+	var presp *broker.ProvisionResponse
+	err = finish(func() (err error) {
+		presp, err = provision("test-plan-id")
+		return err
+	}, cloudformation.StackStatusCreateInProgress, cloudformation.StackStatusCreateComplete)
+	assert.NoError(err)
+	assert.Equal(&broker.ProvisionResponse{}, presp)
+	presp, err = provision("test-plan-id")
+	assert.NoError(err)
+	assert.True(presp.Exists)
+
+	var uresp *broker.UpdateInstanceResponse
+	err = finish(func() (err error) {
+		uresp, err = b.Update(&osb.UpdateInstanceRequest{
+			InstanceID: "i1",
+			ServiceID:  "test-service-id",
+			Parameters: map[string]interface{}{"req_param": "newval"},
+		}, &broker.RequestContext{})
+		return err
+	}, cloudformation.StackStatusUpdateInProgress, cloudformation.StackStatusUpdateRollbackComplete)
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusInternalServerError, "CloudFormationError", "The CloudFormation stack "+stack+" finished with status UPDATE_ROLLBACK_COMPLETE.").Error())
+	assert.Nil(uresp)
+
+	// the request fails if the stack doesn't finish in time, leaving it to carry on
+	b.synchronousTimeout = 10 * time.Millisecond
+	_, err = b.Deprovision(&osb.DeprovisionRequest{InstanceID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id"}, &broker.RequestContext{})
+	assert.EqualError(err, newHTTPStatusCodeError(http.StatusInternalServerError, "", "The CloudFormation stack "+stack+" did not finish within 10ms, its status is DELETE_IN_PROGRESS.").Error())
+	assert.Contains(db.instances, "i1")
+
+	b.synchronousTimeout = time.Second
+	var dresp *broker.DeprovisionResponse
+	err = finish(func() (err error) {
+		dresp, err = b.Deprovision(&osb.DeprovisionRequest{InstanceID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id"}, &broker.RequestContext{})
+		return err
+	}, cloudformation.StackStatusDeleteInProgress, cloudformation.StackStatusDeleteComplete)
+	assert.NoError(err)
+	assert.Equal(&broker.DeprovisionResponse{}, dresp)
+	assert.NotContains(db.instances, "i1")
+}
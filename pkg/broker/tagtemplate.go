@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxTagValueLength is the maximum length of a CloudFormation tag value
+const maxTagValueLength = 256
+
+// TagTemplate renders the value of a stack tag from the PlatformContext of the instance, e.g.
+// "{{.OrganizationName}}/{{.SpaceName}}"
+type TagTemplate struct {
+	Key      string
+	Template *template.Template
+}
+
+// LoadTagTemplates reads a YAML or JSON file mapping tag keys to templates
+func LoadTagTemplates(path string) ([]TagTemplate, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates map[string]string
+	if err := yaml.Unmarshal(body, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse tag templates %s: %v", path, err)
+	}
+	return parseTagTemplates(templates)
+}
+
+func parseTagTemplates(templates map[string]string) ([]TagTemplate, error) {
+	var tagTemplates []TagTemplate
+	for _, key := range sortedKeys(templates) {
+		if strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, "aws-service-broker:") {
+			return nil, fmt.Errorf("tag template %q uses a reserved prefix", key)
+		}
+		// Missing annotations render as empty strings rather than "<no value>"
+		t, err := template.New(key).Option("missingkey=zero").Parse(templates[key])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tag template %q: %v", key, err)
+		}
+		tagTemplates = append(tagTemplates, TagTemplate{Key: key, Template: t})
+	}
+	return tagTemplates, nil
+}
+
+// renderTagTemplates returns the tags the templates render for a request's context. Tags whose value is empty are left
+// out, and values are truncated to the length CloudFormation allows
+func renderTagTemplates(templates []TagTemplate, context map[string]interface{}) []*cloudformation.Tag {
+	data := parsePlatformContext(context)
+	var tags []*cloudformation.Tag
+	for _, t := range templates {
+		var buf bytes.Buffer
+		if err := t.Template.Execute(&buf, data); err != nil {
+			glog.Errorf("Failed to render tag template %q: %v", t.Key, err)
+			continue
+		}
+		value := []rune(strings.TrimSpace(buf.String()))
+		if len(value) == 0 {
+			continue
+		}
+		if len(value) > maxTagValueLength {
+			value = value[:maxTagValueLength]
+		}
+		tags = append(tags, &cloudformation.Tag{Key: aws.String(t.Key), Value: aws.String(string(value))})
+	}
+	return tags
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTagTemplates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tags.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+owner: "{{.OrganizationName}}/{{.SpaceName}}"
+instance: "{{.InstanceName}}"
+`), 0644))
+
+	templates, err := LoadTagTemplates(path)
+	assert.NoError(t, err)
+	if assert.Len(t, templates, 2) {
+		assert.Equal(t, "instance", templates[0].Key)
+		assert.Equal(t, "owner", templates[1].Key)
+	}
+
+	_, err = LoadTagTemplates(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+	_, err = parseTagTemplates(map[string]string{"owner": "{{.OrganizationName"})
+	assert.Error(t, err)
+	_, err = parseTagTemplates(map[string]string{"aws-service-broker:owner": "{{.OrganizationName}}"})
+	assert.EqualError(t, err, `tag template "aws-service-broker:owner" uses a reserved prefix`)
+}
+
+func TestRenderTagTemplates(t *testing.T) {
+	templates, err := parseTagTemplates(map[string]string{
+		"owner":       "{{.InstanceAnnotations.owner}}",
+		"space":       "{{.OrganizationName}}/{{.SpaceName}}",
+		"description": `{{index .InstanceAnnotations "description"}}`,
+	})
+	assert.NoError(t, err)
+
+	context := map[string]interface{}{
+		"platform":             "cloudfoundry",
+		"organization_name":    "finance",
+		"space_name":           "reporting",
+		"instance_annotations": map[string]interface{}{"description": strings.Repeat("a", 300)},
+	}
+	assert.Equal(t, []*cloudformation.Tag{
+		{Key: aws.String("description"), Value: aws.String(strings.Repeat("a", 256))},
+		{Key: aws.String("space"), Value: aws.String("finance/reporting")},
+	}, renderTagTemplates(templates, context))
+
+	// user tags take precedence over the templates
+	tags, err := buildTags("broker", "instance", context, templates, map[string]string{"user_tags": `[{"Key": "space", "Value": "mine"}]`})
+	assert.NoError(t, err)
+	assert.Len(t, tags, 6)
+	assert.Equal(t, "mine", aws.StringValue(tags[5].Value))
+}
@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -23,6 +25,10 @@ import (
 // Options cli options
 type Options struct {
 	CatalogPath        string
+	CatalogURL         string
+	CatalogQueueURL    string
+	RefreshInterval    time.Duration
+	RefreshJitter      time.Duration
 	KeyID              string
 	SecretKey          string
 	Profile            string
@@ -35,13 +41,12 @@ type Options struct {
 	BrokerID           string
 	RoleArn            string
 	PrescribeOverrides bool
-}
-
-// BucketDetailsRequest describes the details required to fetch metadata and templates from s3
-type BucketDetailsRequest struct {
-	bucket string
-	prefix string
-	suffix string
+	CfnRoleArn         string
+	OrphanMitigation   bool
+	OrphanRetention    time.Duration
+	Synchronous        bool
+	SynchronousTimeout time.Duration
+	TagTemplates       string
 }
 
 // AwsBroker holds configuration, caches and aws service clients
@@ -58,6 +63,7 @@ type AwsBroker struct {
 	templatefilter     string
 	region             string
 	partition          string
+	catalog            CatalogSource
 	s3svc              S3Client
 	ssmsvc             ssm.SSM
 	catalogcache       cache.Cache
@@ -70,6 +76,17 @@ type AwsBroker struct {
 	prescribeOverrides bool
 	globalOverrides    map[string]string
 	metrics            *MetricsCollector
+	refresh            chan CatalogRefreshRequest
+	stop               context.CancelFunc
+	campaignLock       sync.Mutex
+	leaseOwner         string
+	cfnRoleArn         string
+	orphanMitigation   bool
+	orphanRetention    time.Duration
+	orphanLock         sync.Mutex
+	synchronous        bool
+	synchronousTimeout time.Duration
+	tagTemplates       []TagTemplate
 }
 
 // ServiceNeedsUpdate if Update == true the metadata should be refreshed from s3
@@ -95,11 +112,18 @@ type Db struct {
 // DataStore port, any backend datastore must provide at least these interfaces
 type DataStore interface {
 	PutServiceDefinition(sd osb.Service) error
+	// GetParam returns dynamodbadapter.ErrParamNotFound if the parameter doesn't exist
 	GetParam(paramname string) (value string, err error)
 	PutParam(paramname string, paramvalue string) error
+	// ListParams returns the parameters whose names start with prefix
+	ListParams(prefix string) (map[string]string, error)
+	// SwapParam sets a parameter only if its value is old, an empty old value meaning the parameter doesn't exist. It
+	// returns false if the parameter had another value
+	SwapParam(paramname string, old string, new string) (bool, error)
 	GetServiceDefinition(serviceuuid string) (*osb.Service, error)
 	GetServiceInstance(sid string) (*serviceinstance.ServiceInstance, error)
 	PutServiceInstance(si serviceinstance.ServiceInstance) error
+	ListServiceInstances(serviceid string) ([]serviceinstance.ServiceInstance, error)
 	DeleteServiceInstance(sid string) error
 	GetServiceBinding(id string) (*serviceinstance.ServiceBinding, error)
 	PutServiceBinding(sb serviceinstance.ServiceBinding) error
@@ -115,6 +139,7 @@ type GetDdbClient func(sess *session.Session) *dynamodb.DynamoDB
 type GetStsClient func(sess *session.Session) *sts.STS
 type GetIamClient func(sess *session.Session) iamiface.IAMAPI
 type GetLambdaClient func(sess *session.Session) lambdaiface.LambdaAPI
+type GetSqsClient func(sess *session.Session) sqsiface.SQSAPI
 
 type AwsClients struct {
 	NewCfn    GetCfnClient
@@ -124,6 +149,7 @@ type AwsClients struct {
 	NewSts    GetStsClient
 	NewIam    GetIamClient
 	NewLambda GetLambdaClient
+	NewSqs    GetSqsClient
 }
 
 type S3Client struct {
@@ -140,23 +166,36 @@ type AwsTags []struct {
 }
 
 type GetCallerIder func(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, error)
-type UpdateCataloger func(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error
-type PollUpdater func(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser)
-type ListTemplateser func(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error)
+type UpdateCataloger func(listingcache cache.Cache, catalogcache cache.Cache, source CatalogSource, db Db, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error
+type PollUpdater func(ctx context.Context, schedule RefreshSchedule, requests <-chan CatalogRefreshRequest, l cache.Cache, c cache.Cache, source CatalogSource, db Db, updateCatalog UpdateCataloger, metrics *MetricsCollector)
 type ListingUpdater func(l *[]ServiceLastUpdate, c cache.Cache) error
-type MetadataUpdater func(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error
+type MetadataUpdater func(l cache.Cache, c cache.Cache, source CatalogSource, db Db, metadataUpdate MetadataUpdater) error
 
 type CfnTemplate struct {
 	Description string `yaml:"Description,omitempty"`
 	Parameters  map[string]struct {
-		Description   string   `yaml:"Description,omitempty"`
-		Type          string   `yaml:"Type,omitempty"`
-		Default       *string  `yaml:"Default,omitempty"`
-		AllowedValues []string `yaml:"AllowedValues,omitempty"`
+		Description           string   `yaml:"Description,omitempty"`
+		Type                  string   `yaml:"Type,omitempty"`
+		Default               *string  `yaml:"Default,omitempty"`
+		AllowedValues         []string `yaml:"AllowedValues,omitempty"`
+		AllowedPattern        string   `yaml:"AllowedPattern,omitempty"`
+		MinLength             *string  `yaml:"MinLength,omitempty"`
+		MaxLength             *string  `yaml:"MaxLength,omitempty"`
+		MinValue              *string  `yaml:"MinValue,omitempty"`
+		MaxValue              *string  `yaml:"MaxValue,omitempty"`
+		ConstraintDescription string   `yaml:"ConstraintDescription,omitempty"`
+		NoEcho                string   `yaml:"NoEcho,omitempty"`
 	} `yaml:"Parameters,omitempty"`
 	Outputs map[string]struct {
 		Description string `yaml:"Description,omitempty"`
 	} `yaml:"Outputs,omitempty"`
+	Resources map[string]struct {
+		Type           string `yaml:"Type,omitempty"`
+		DeletionPolicy string `yaml:"DeletionPolicy,omitempty"`
+	} `yaml:"Resources,omitempty"`
+	// Transform is the transform or list of transforms (macros) the template uses, if any
+	Transform interface{} `yaml:"Transform,omitempty"`
+
 	Metadata struct {
 		Spec struct {
 			Version             string   `yaml:"Version,omitempty"`
@@ -178,9 +217,17 @@ type CfnTemplate struct {
 					} `yaml:"Policies,omitempty"`
 				} `yaml:"IAM,omitempty"`
 				CFNOutputs []string `yaml:"CFNOutputs,omitempty"`
+				// Scopes are the binding scopes the template provides a PolicyArn<Scope> output for
+				Scopes []string `yaml:"Scopes,omitempty"`
 			} `yaml:"Bindings,omitempty"`
 			ServicePlans        map[string]CfnServicePlan `yaml:"ServicePlans,omitempty"`
 			UpdatableParameters []string                  `yaml:"UpdatableParameters,omitempty"`
+			// Capabilities are the CloudFormation capabilities the template requires in addition to CAPABILITY_NAMED_IAM
+			Capabilities []string `yaml:"Capabilities,omitempty"`
+			// ProtectedResources are the logical IDs of resources that updates must not replace
+			ProtectedResources []string `yaml:"ProtectedResources,omitempty"`
+			// FinalSnapshotParameter is the parameter set to "true" to take a final snapshot before the stack is deleted
+			FinalSnapshotParameter string `yaml:"FinalSnapshotParameter,omitempty"`
 		} `yaml:"AWS::ServiceBroker::Specification,omitempty"`
 		Interface struct {
 			ParameterGroups []struct {
@@ -204,6 +251,43 @@ type CfnServicePlan struct {
 	Costs             []CfnCost         `yaml:"Costs,omitempty"`
 	ParameterValues   map[string]string `yaml:"ParameterValues,omitempty"`
 	ParameterDefaults map[string]string `yaml:"ParameterDefaults,omitempty"`
+	// UpdatablePlans are the names of the plans instances of this plan can be changed to
+	UpdatablePlans []string `yaml:"UpdatablePlans,omitempty"`
+	// Synchronous allows instances of this plan to be provisioned, updated and deprovisioned by platforms that don't
+	// accept asynchronous operations
+	Synchronous bool `yaml:"Synchronous,omitempty"`
+	// StackOptions are applied when instances of this plan are provisioned and updated
+	StackOptions `yaml:",inline"`
+	// RetentionPolicy is applied when instances of this plan are deprovisioned
+	RetentionPolicy `yaml:",inline"`
+}
+
+// StackOptions are the CloudFormation stack options a plan applies to the stacks of its instances
+type StackOptions struct {
+	// TimeoutInMinutes is how long the stack can take to create before it fails
+	TimeoutInMinutes int64 `yaml:"TimeoutInMinutes,omitempty" json:"timeoutInMinutes,omitempty"`
+	// OnFailure is what happens to the stack if it fails to create, one of ROLLBACK, DELETE or DO_NOTHING
+	OnFailure string `yaml:"OnFailure,omitempty" json:"onFailure,omitempty"`
+	// EnableTerminationProtection prevents the stack from being deleted until it's disabled
+	EnableTerminationProtection bool `yaml:"EnableTerminationProtection,omitempty" json:"enableTerminationProtection,omitempty"`
+	// StackPolicy is a JSON stack policy document protecting the stack's resources from updates
+	StackPolicy string `yaml:"StackPolicy,omitempty" json:"stackPolicy,omitempty"`
+	// RoleARN is the CloudFormation service role stacks are created, updated and deleted with instead of the broker's
+	// credentials
+	RoleARN string `yaml:"RoleARN,omitempty" json:"roleARN,omitempty"`
+	// NotificationARNs are the SNS topics stack events are published to
+	NotificationARNs []string `yaml:"NotificationARNs,omitempty" json:"notificationARNs,omitempty"`
+}
+
+// RetentionPolicy protects the data of a plan's instances when they are deprovisioned
+type RetentionPolicy struct {
+	// DeletionProtection refuses to deprovision the plan's instances
+	DeletionProtection bool `yaml:"DeletionProtection,omitempty" json:"deletionProtection,omitempty"`
+	// FinalSnapshot updates the stack with the template's FinalSnapshotParameter set to "true" before deleting it
+	FinalSnapshot bool `yaml:"FinalSnapshot,omitempty" json:"finalSnapshot,omitempty"`
+	// RetainResources are the logical IDs of resources that are kept when the stack is deleted. Their DeletionPolicy
+	// must be Retain, the broker only keeps them itself if deleting the stack fails to delete them
+	RetainResources []string `yaml:"RetainResources,omitempty" json:"retainResources,omitempty"`
 }
 
 type CfnCost struct {
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// UpgradeInstance updates a service instance's stack to the latest template for its service, keeping the instance's
+// parameters. It returns false if the instance already uses the latest template
+func (b *AwsBroker) UpgradeInstance(id string) (bool, error) {
+	key, err := b.upgradeInstance(id)
+	return key != nil, err
+}
+
+// upgradeInstance upgrades a service instance, returning the key of the update operation or nil if the instance
+// already uses the latest template
+func (b *AwsBroker) upgradeInstance(id string) (*osb.OperationKey, error) {
+	instance, err := b.db.DataStorePort.GetServiceInstance(id)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %q: %v", id, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %q was not found.", id)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+	b.reconcileUpdate(instance)
+
+	service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %q: %v", instance.ServiceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if service == nil {
+		desc := fmt.Sprintf("The service %q was not found.", instance.ServiceID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	plan := getPlan(service, instance.PlanID)
+	if plan == nil {
+		desc := fmt.Sprintf("The service plan %q was not found.", instance.PlanID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	if instance.TemplateVersion != "" && instance.TemplateVersion == getTemplateVersion(service) {
+		return nil, nil
+	}
+
+	// The latest template may prescribe different values or add parameters
+	params := changePlanParams(plan, plan, instance.Params)
+	if errs := checkRequiredParams(plan, params); len(errs) > 0 {
+		return nil, newParametersError(errs)
+	}
+
+	glog.Infof("Upgrading service instance %q from template %q to %q", instance.ID, instance.TemplateVersion, getTemplateVersion(service))
+	key, err := b.updateInstanceStack(instance, service, plan, params, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	b.metrics.Actions.With(
+		prom.Labels{
+			"action":  "upgrade",
+			"service": service.Name,
+			"plan":    plan.Name,
+		}).Inc()
+
+	return key, nil
+}
+
+// updateInstanceStack updates an instance's stack with params and stores the updated instance along with an update
+// operation recording the requested parameters. The stack keeps the template it was last deployed with unless upgrade
+// is set, in which case the service's latest template is used
+func (b *AwsBroker) updateInstanceStack(instance *serviceinstance.ServiceInstance, service *osb.Service, plan *osb.Plan, params map[string]string, requested map[string]interface{}, upgrade bool) (*osb.OperationKey, error) {
+	input, version, err := b.getUpdateStackInput(instance, service, plan, params, upgrade)
+	if err != nil {
+		return nil, err
+	}
+	options := getStackOptions(plan)
+
+	// Update the CFN stack
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
+	var stackStatus string
+	var stackUpdated time.Time
+	stack, err := describeStack(cfnSvc, instance.StackID)
+	if err != nil {
+		glog.Errorf("Failed to describe the CloudFormation stack %q: %v", instance.StackID, err)
+	} else {
+		stackStatus = aws.StringValue(stack.StackStatus)
+		stackUpdated = stackUpdatedTime(stack)
+	}
+	protected := getProtectedResources(service)
+	if usesTransform(service) || len(protected) > 0 {
+		err = updateStackWithChangeSet(cfnSvc, input, protected)
+	} else {
+		_, err = cfnSvc.Client.UpdateStack(input)
+	}
+	if e, ok := err.(protectedReplacementError); ok {
+		desc := fmt.Sprintf("The update would replace the protected resources %s of the CloudFormation stack %q, so it was not performed.", strings.Join(e.resources, ", "), instance.StackID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	} else if err != nil && !isNoUpdatesError(err) {
+		desc := fmt.Sprintf("Failed to update the CloudFormation stack %q: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	// Termination protection follows the plan once the update has been accepted, it's retried on the next update if
+	// it fails
+	if stack != nil && aws.BoolValue(stack.EnableTerminationProtection) != options.EnableTerminationProtection {
+		if _, err := cfnSvc.Client.UpdateTerminationProtection(&cloudformation.UpdateTerminationProtectionInput{
+			EnableTerminationProtection: aws.Bool(options.EnableTerminationProtection),
+			StackName:                   aws.String(instance.StackID),
+		}); err != nil {
+			glog.Errorf("Failed to update the termination protection of the CloudFormation stack %q: %v", instance.StackID, err)
+		}
+	}
+	op := startOperation(instance, serviceinstance.OperationUpdate, stackStatus, requested)
+	op.StackUpdated = stackUpdated
+	if err != nil {
+		// the stack isn't updated, so the operation is already complete
+		op.State = string(osb.StateSucceeded)
+	} else {
+		op.PreviousParams = instance.Params
+		op.PreviousPlanID = instance.PlanID
+		op.PreviousTemplateVersion = instance.TemplateVersion
+	}
+
+	// Update the params, plan, template version and operations in the DB
+	instance.Params = params
+	instance.PlanID = plan.ID
+	instance.TemplateVersion = version
+	err = b.db.DataStorePort.PutServiceInstance(*instance)
+	if err != nil {
+		// Try to cancel the update
+		if _, err := cfnSvc.Client.CancelUpdateStack(&cloudformation.CancelUpdateStackInput{StackName: aws.String(instance.StackID)}); err != nil {
+			glog.Errorf("Failed to cancel updating the CloudFormation stack %q: %v", instance.StackID, err)
+			glog.Errorf("Service instance %q and CloudFormation stack %q may be out of sync!", instance.ID, instance.StackID)
+		}
+
+		desc := fmt.Sprintf("Failed to update the service instance %q: %v", instance.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	return toOperationKey(op), nil
+}
+
+// isNoUpdatesError returns true if CloudFormation rejected an update because neither the template nor parameters
+// changed, e.g. when a new template version only changes the broker's metadata
+func isNoUpdatesError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "No updates are to be performed")
+	}
+	return false
+}
+
+// getUpdateStackInput returns the input updating an instance's stack with params, and the template version the stack
+// is updated to. The stack's tags are recomputed from the instance's context and params
+func (b *AwsBroker) getUpdateStackInput(instance *serviceinstance.ServiceInstance, service *osb.Service, plan *osb.Plan, params map[string]string, upgrade bool) (*cloudformation.UpdateStackInput, string, error) {
+	tags, err := getInstanceTags(b.brokerid, b.tagTemplates, instance, params)
+	if err != nil {
+		desc := fmt.Sprintf("failed to parse tags: %v", err)
+		return nil, "", newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	input := &cloudformation.UpdateStackInput{
+		Capabilities: aws.StringSlice(getCapabilities(service)),
+		Parameters:   toCFNParams(params),
+		RoleARN:      stackRoleARN(instance),
+		StackName:    aws.String(instance.StackID),
+		Tags:         tags,
+	}
+	version := instance.TemplateVersion
+	if upgrade {
+		urlP, bodyP, latest, err := b.getTemplateLocation(service.Name)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get the template for service %q: %v", service.Name, err)
+			return nil, "", newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		input.TemplateURL = urlP
+		input.TemplateBody = bodyP
+		version = latest
+	} else {
+		input.UsePreviousTemplate = aws.Bool(true)
+	}
+	setUpdateStackOptions(input, getStackOptions(plan))
+	return input, version, nil
+}
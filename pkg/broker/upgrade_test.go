@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgradeInstance(t *testing.T) {
+	tests := []struct {
+		name             string
+		instanceID       string
+		expectedUpgraded bool
+		expectedErr      error
+	}{
+		{
+			name:        "error_getting_instance",
+			instanceID:  "err",
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance \"err\": test failure"),
+		},
+		{
+			name:        "instance_not_found",
+			instanceID:  "foo",
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service instance \"foo\" was not found."),
+		},
+		{
+			name:       "latest_template",
+			instanceID: "exists-latest",
+		},
+		{
+			name:             "outdated_template",
+			instanceID:       "exists-outdated",
+			expectedUpgraded: true,
+		},
+		{
+			name:             "no_stack_changes",
+			instanceID:       "no-updates",
+			expectedUpgraded: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			upgraded, err := b.UpgradeInstance(tt.instanceID)
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedUpgraded, upgraded)
+			}
+		})
+	}
+}
+
+func TestIsNoUpdatesError(t *testing.T) {
+	assert.True(t, isNoUpdatesError(awserr.New("ValidationError", "No updates are to be performed.", nil)))
+	assert.False(t, isNoUpdatesError(awserr.New("ValidationError", "Stack does not exist", nil)))
+	assert.False(t, isNoUpdatesError(errors.New("No updates are to be performed.")))
+}
+
+// mockCfnStackOptions records the stack options applied by updates
+type mockCfnStackOptions struct {
+	mockCfn
+	protected  bool
+	update     *cloudformation.UpdateStackInput
+	updateErr  error
+	protection []bool
+}
+
+func (m *mockCfnStackOptions) DescribeStacks(in *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{{
+		StackName:                   in.StackName,
+		StackStatus:                 aws.String(cloudformation.StackStatusCreateComplete),
+		EnableTerminationProtection: aws.Bool(m.protected),
+	}}}, nil
+}
+
+func (m *mockCfnStackOptions) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
+	m.update = in
+	return &cloudformation.UpdateStackOutput{}, m.updateErr
+}
+
+func (m *mockCfnStackOptions) UpdateTerminationProtection(in *cloudformation.UpdateTerminationProtectionInput) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	m.protected = aws.BoolValue(in.EnableTerminationProtection)
+	m.protection = append(m.protection, m.protected)
+	return &cloudformation.UpdateTerminationProtectionOutput{}, nil
+}
+
+func TestUpdateInstanceStackOptions(t *testing.T) {
+	assert := assert.New(t)
+	instance := serviceinstance.ServiceInstance{ID: "i1", ServiceID: "test-service-id", PlanID: "test-plan-id", StackID: "stack-i1"}
+	cfn := &mockCfnStackOptions{}
+	b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate, NewMetricsCollector())
+	b.db.DataStorePort = newMockDataStoreCampaign(instance)
+	b.Clients.NewCfn = func(sess *session.Session) CfnClient { return CfnClient{cfn} }
+	service := &osb.Service{ID: "test-service-id", Name: "test-service-name"}
+	options := StackOptions{EnableTerminationProtection: true, StackPolicy: `{"Statement":[]}`}
+	plan := &osb.Plan{ID: "production-plan-id", Metadata: map[string]interface{}{"stackOptions": options}}
+
+	// termination protection isn't changed when the update is refused
+	cfn.updateErr = awserr.New("ValidationError", "Template format error", nil)
+	_, err := b.updateInstanceStack(&instance, service, plan, map[string]string{}, nil, false)
+	assert.Error(err)
+	assert.Empty(cfn.protection)
+	cfn.updateErr = nil
+
+	_, err = b.updateInstanceStack(&instance, service, plan, map[string]string{}, nil, false)
+	assert.NoError(err)
+	assert.Equal([]bool{true}, cfn.protection)
+	assert.Equal(`{"Statement":[]}`, aws.StringValue(cfn.update.StackPolicyBody))
+
+	// termination protection is only changed when it differs from the plan's
+	_, err = b.updateInstanceStack(&instance, service, plan, map[string]string{}, nil, false)
+	assert.NoError(err)
+	assert.Equal([]bool{true}, cfn.protection)
+
+	_, err = b.updateInstanceStack(&instance, service, &osb.Plan{ID: "test-plan-id"}, map[string]string{}, nil, false)
+	assert.NoError(err)
+	assert.Equal([]bool{true, false}, cfn.protection)
+	assert.Nil(cfn.update.StackPolicyBody)
+}
@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,7 +9,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/sts"
 	"net/http"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -21,6 +25,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
 	"github.com/golang/glog"
 	"github.com/koding/cache"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
@@ -38,7 +43,7 @@ func getGlobalOverrides(brokerID string) map[string]string {
 	return overrides
 }
 
-func prescribeOverrides(b AwsBroker, services []osb.Service) []osb.Service {
+func prescribeOverrides(b *AwsBroker, services []osb.Service) []osb.Service {
 	if !b.prescribeOverrides || len(b.globalOverrides) == 0 {
 		return services
 	}
@@ -70,7 +75,11 @@ func prescribeOverrides(b AwsBroker, services []osb.Service) []osb.Service {
 						params["required"] = deleteFromSlice(params["required"].([]string), k)
 					}
 				}
-				if len(params["properties"].(map[string]interface{})) == 0 {
+				properties := params["properties"].(map[string]interface{})
+				if _, ok := properties[dryRunParameter]; ok && len(properties) == 1 && plan.Metadata["updatablePlans"] == nil {
+					delete(properties, dryRunParameter)
+				}
+				if len(properties) == 0 {
 					// If there are no updatable properties left, remove the update schema
 					plan.Schemas.ServiceInstance.Update = nil
 				} else if params["required"] != nil && len(params["required"].([]string)) == 0 {
@@ -84,6 +93,33 @@ func prescribeOverrides(b AwsBroker, services []osb.Service) []osb.Service {
 	return services
 }
 
+// internalPlanMetadata are the plan metadata fields only the broker uses, which may hold details like role ARNs that
+// aren't served in the catalog
+var internalPlanMetadata = []string{"stackOptions", "retentionPolicy"}
+
+// withoutInternalMetadata returns copies of services whose plans leave out internalPlanMetadata. The broker reads
+// these fields from the service definitions in the DataStore
+func withoutInternalMetadata(services []osb.Service) []osb.Service {
+	var served []osb.Service
+	for _, service := range services {
+		service.Plans = append([]osb.Plan(nil), service.Plans...)
+		for j, plan := range service.Plans {
+			if plan.Metadata == nil {
+				continue
+			}
+			metadata := make(map[string]interface{})
+			for k, v := range plan.Metadata {
+				if !stringInSlice(k, internalPlanMetadata) {
+					metadata[k] = v
+				}
+			}
+			service.Plans[j].Metadata = metadata
+		}
+		served = append(served, service)
+	}
+	return served
+}
+
 func getOverridesFromEnv() map[string]string {
 	var Overrides = make(map[string]string)
 
@@ -215,6 +251,27 @@ func addTrailingSlash(s string) string {
 	return s
 }
 
+// sortedKeys returns the keys of a map with string keys (e.g. plans or parameters) in a stable order, so the generated
+// catalog, schemas and errors are deterministic
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Map {
+		return nil
+	}
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isDeprecated returns true if service or plan metadata marks it as retired from the catalog
+func isDeprecated(metadata map[string]interface{}) bool {
+	deprecated, ok := metadata["deprecated"].(bool)
+	return ok && deprecated
+}
+
 func generateRoleArn(params map[string]string, currentAccountID string, partition string) string {
 	targetRoleName := params["target_role_name"]
 
@@ -263,7 +320,9 @@ func toCFNParams(params map[string]string) []*cloudformation.Parameter {
 	return cfnParams
 }
 
-func buildTags(brokerId string, instanceId string, cluster string, namespace string, params map[string]string) ([]*cloudformation.Tag, error) {
+// buildTags returns the tags of an instance's stack: the broker's tags, the tags rendered by the tag templates and the
+// tags in the user_tags and admin_tags parameters, which take precedence over the templates
+func buildTags(brokerId string, instanceId string, context map[string]interface{}, templates []TagTemplate, params map[string]string) ([]*cloudformation.Tag, error) {
 	tags := []*cloudformation.Tag{
 		{
 			Key:   aws.String("aws-service-broker:broker-id"),
@@ -275,28 +334,50 @@ func buildTags(brokerId string, instanceId string, cluster string, namespace str
 		},
 		{
 			Key:   aws.String("aws-service-broker:cluster"),
-			Value: aws.String(cluster),
+			Value: aws.String(getCluster(context)),
 		},
 		{
 			Key:   aws.String("aws-service-broker:namespace"),
-			Value: aws.String(namespace),
+			Value: aws.String(getNamespace(context)),
 		},
 	}
-	for k, v := range params {
-		if stringInSlice(k, []string{"user_tags", "admin_tags"}) {
+	tags = append(tags, renderTagTemplates(templates, context)...)
+	for _, k := range tagParams {
+		if v, ok := params[k]; ok {
 			tagList := make(AwsTags, 0)
 			err := json.Unmarshal([]byte(v), &tagList)
 			if err != nil {
 				return nil, err
 			}
 			for _, t := range tagList {
-				tags = append(tags, &cloudformation.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)})
+				tags = setTag(tags, t.Key, t.Value)
 			}
 		}
 	}
 	return tags, nil
 }
 
+// setTag sets the value of the tag with key, adding the tag if there's none
+func setTag(tags []*cloudformation.Tag, key, value string) []*cloudformation.Tag {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			t.Value = aws.String(value)
+			return tags
+		}
+	}
+	return append(tags, &cloudformation.Tag{Key: aws.String(key), Value: aws.String(value)})
+}
+
+// getInstanceTags returns the tags of an instance's stack with params. It returns nil, so the stack keeps its tags,
+// if the instance's context isn't known, as is the case for instances provisioned by older versions of the broker
+// that haven't been updated since
+func getInstanceTags(brokerID string, templates []TagTemplate, instance *serviceinstance.ServiceInstance, params map[string]string) ([]*cloudformation.Tag, error) {
+	if instance.Context == nil {
+		return nil, nil
+	}
+	return buildTags(brokerID, instance.ID, instance.Context, templates, params)
+}
+
 func newAsyncError() osb.HTTPStatusCodeError {
 	return newHTTPStatusCodeError(http.StatusUnprocessableEntity, osb.AsyncErrorMessage, osb.AsyncErrorDescription)
 }
@@ -315,32 +396,38 @@ func newHTTPStatusCodeError(statusCode int, msg, desc string) osb.HTTPStatusCode
 	return err
 }
 
+// getCluster returns the ID of the Cloud Foundry organization or Kubernetes cluster of a request's context, or
+// "unknown"
 func getCluster(context map[string]interface{}) string {
-	switch context["platform"] {
+	c := parsePlatformContext(context)
+	var cluster string
+	switch c.Platform {
 	case osb.PlatformCloudFoundry:
-		return strings.Replace(context["organization_guid"].(string), "-", "", -1)
+		cluster = strings.Replace(c.OrganizationGUID, "-", "", -1)
 	case osb.PlatformKubernetes:
-		if context["clusterid"] == nil {
-			return "unknown"
-		}
-		return context["clusterid"].(string)
-	default:
+		cluster = c.ClusterID
+	}
+	if cluster == "" {
 		return "unknown"
 	}
+	return cluster
 }
 
+// getNamespace returns the ID of the Cloud Foundry space or the Kubernetes namespace of a request's context, or
+// "unknown"
 func getNamespace(context map[string]interface{}) string {
-	switch context["platform"] {
+	c := parsePlatformContext(context)
+	var namespace string
+	switch c.Platform {
 	case osb.PlatformCloudFoundry:
-		return strings.Replace(context["space_guid"].(string), "-", "", -1)
+		namespace = strings.Replace(c.SpaceGUID, "-", "", -1)
 	case osb.PlatformKubernetes:
-		if context["namespace"] == nil {
-			return "unknown"
-		}
-		return context["namespace"].(string)
-	default:
+		namespace = c.Namespace
+	}
+	if namespace == "" {
 		return "unknown"
 	}
+	return namespace
 }
 
 func getPlan(service *osb.Service, planID string) *osb.Plan {
@@ -362,6 +449,193 @@ func getPlanDefaults(plan *osb.Plan) map[string]string {
 	return defaults
 }
 
+// templateVersion identifies the content of a template, so instances can be pinned to the template they were
+// provisioned with
+func templateVersion(body []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(body))
+}
+
+// setTemplateVersion records the version of the template a service was generated from, and the maintenance info
+// platforms use to upgrade instances of its plans
+func setTemplateVersion(service *osb.Service, t CfnTemplate, body []byte) {
+	version := templateVersion(body)
+	service.Metadata["templateVersion"] = version
+	info := map[string]interface{}{"version": maintenanceVersion(t.Metadata.Spec.Version, version)}
+	if t.Metadata.Spec.Version != "" {
+		info["description"] = "Template version " + t.Metadata.Spec.Version
+	}
+	for i := range service.Plans {
+		if service.Plans[i].Metadata == nil {
+			service.Plans[i].Metadata = make(map[string]interface{})
+		}
+		service.Plans[i].Metadata["maintenanceInfo"] = info
+	}
+}
+
+// maintenanceVersion converts a template's Version into the semantic version maintenance info requires, e.g. 1.0 to
+// 1.0.0. The template's content version is added as build metadata to identify the template, but semantic versioning
+// ignores build metadata when comparing versions, so platforms only offer upgrades when the template's Version is
+// increased
+func maintenanceVersion(specVersion string, version string) string {
+	parts := strings.Split(strings.TrimSpace(specVersion), ".")
+	if len(parts) > 3 {
+		parts = []string{"0"}
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 64); err != nil {
+			parts = []string{"0"}
+			break
+		}
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+	return strings.Join(parts, ".") + "+" + version[:12]
+}
+
+// maintenanceVersionUnchanged returns true if a service's template changed without its Version being increased, so
+// platforms won't offer its instances an upgrade
+func maintenanceVersionUnchanged(previous *osb.Service, service *osb.Service) bool {
+	if previous == nil || len(previous.Plans) == 0 || len(service.Plans) == 0 {
+		return false
+	}
+	if getTemplateVersion(previous) == "" || getTemplateVersion(previous) == getTemplateVersion(service) {
+		return false
+	}
+	old, current := getMaintenanceInfo(&previous.Plans[0]), getMaintenanceInfo(&service.Plans[0])
+	return old != nil && current != nil && strings.Split(old.Version, "+")[0] == strings.Split(current.Version, "+")[0]
+}
+
+// checkMaintenanceInfo returns a MaintenanceInfoConflict error if a request's maintenance_info doesn't match the plan's
+func checkMaintenanceInfo(plan *osb.Plan, requested *MaintenanceInfo) error {
+	if requested == nil {
+		return nil
+	}
+	current := getMaintenanceInfo(plan)
+	if current == nil || current.Version != requested.Version {
+		desc := "The maintenance_info.version field provided in the request does not match the maintenance_info.version field provided in the Service Broker's Catalog."
+		return newHTTPStatusCodeError(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", desc)
+	}
+	return nil
+}
+
+func getTemplateVersion(service *osb.Service) string {
+	v, _ := service.Metadata["templateVersion"].(string)
+	return v
+}
+
+func getMaintenanceInfo(plan *osb.Plan) *MaintenanceInfo {
+	info, ok := plan.Metadata["maintenanceInfo"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	version, _ := info["version"].(string)
+	description, _ := info["description"].(string)
+	return &MaintenanceInfo{Version: version, Description: description}
+}
+
+func getBindingSchema(plan *osb.Plan) interface{} {
+	if plan == nil || plan.Schemas == nil || plan.Schemas.ServiceBinding == nil || plan.Schemas.ServiceBinding.Create == nil {
+		return nil
+	}
+	return plan.Schemas.ServiceBinding.Create.Parameters
+}
+
+func getUpdatablePlans(plan *osb.Plan) []string {
+	return toStringSlice(plan.Metadata["updatablePlans"])
+}
+
+func isSynchronous(plan *osb.Plan) bool {
+	return plan.Metadata["synchronous"] == true
+}
+
+// getStackRoleARN returns the CloudFormation service role for a new stack. An override for the cluster, namespace or
+// service takes precedence over the plan's role, which takes precedence over the broker's
+func (b *AwsBroker) getStackRoleARN(plan *osb.Plan, service string, namespace string, cluster string) string {
+	if arn, ok := getOverrides(b.brokerid, []string{cfnRoleArnOverride}, namespace, service, cluster)[cfnRoleArnOverride]; ok {
+		return arn
+	}
+	if arn := getStackOptions(plan).RoleARN; arn != "" {
+		return arn
+	}
+	return b.cfnRoleArn
+}
+
+// stackRoleARN returns the CloudFormation service role of an instance's stack, or nil for instances provisioned
+// without one so CloudFormation uses the role the stack was created with, if any
+func stackRoleARN(instance *serviceinstance.ServiceInstance) *string {
+	if instance.RoleARN == "" {
+		return nil
+	}
+	return aws.String(instance.RoleARN)
+}
+
+// setCreateStackOptions applies a plan's stack options to a new stack
+func setCreateStackOptions(input *cloudformation.CreateStackInput, options StackOptions) {
+	if options.TimeoutInMinutes > 0 {
+		input.TimeoutInMinutes = aws.Int64(options.TimeoutInMinutes)
+	}
+	if options.OnFailure != "" {
+		input.OnFailure = aws.String(options.OnFailure)
+	}
+	if options.EnableTerminationProtection {
+		input.EnableTerminationProtection = aws.Bool(true)
+	}
+	if options.StackPolicy != "" {
+		input.StackPolicyBody = aws.String(options.StackPolicy)
+	}
+	if len(options.NotificationARNs) > 0 {
+		input.NotificationARNs = aws.StringSlice(options.NotificationARNs)
+	}
+}
+
+// setUpdateStackOptions applies a plan's stack options to a stack update. The notification ARNs are always set so
+// they're removed when changing to a plan without them, a stack policy can only be replaced
+func setUpdateStackOptions(input *cloudformation.UpdateStackInput, options StackOptions) {
+	if options.StackPolicy != "" {
+		input.StackPolicyBody = aws.String(options.StackPolicy)
+	}
+	input.NotificationARNs = aws.StringSlice(options.NotificationARNs)
+}
+
+// getStackOptions returns the stack options of a plan, which are converted to a map when the catalog is stored
+func getStackOptions(plan *osb.Plan) (options StackOptions) {
+	if v, ok := plan.Metadata["stackOptions"]; ok {
+		b, err := json.Marshal(v)
+		if err == nil {
+			err = json.Unmarshal(b, &options)
+		}
+		if err != nil {
+			glog.Errorf("Failed to parse the stack options of plan %q: %v", plan.Name, err)
+		}
+	}
+	return options
+}
+
+// changePlanParams returns an instance's parameters for a new plan. The values prescribed by the current plan are
+// replaced with those of the new plan, and values left at the current plan's defaults move to the new plan's
+// defaults
+func changePlanParams(current, new *osb.Plan, params map[string]string) map[string]string {
+	prescribed := getPlanPrescribedParams(current.Schemas.ServiceInstance.Create.Parameters)
+	defaults := getPlanDefaults(current)
+	newParams := getPlanDefaults(new)
+	for k, v := range params {
+		if _, ok := prescribed[k]; ok {
+			continue
+		}
+		if d, ok := defaults[k]; ok && d == v {
+			if _, ok := newParams[k]; ok {
+				continue
+			}
+		}
+		newParams[k] = v
+	}
+	for k, v := range getPlanPrescribedParams(new.Schemas.ServiceInstance.Create.Parameters) {
+		newParams[k] = paramValue(v)
+	}
+	return newParams
+}
+
 func getAvailableParams(plan *osb.Plan) (params []string) {
 	properties := plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})["properties"]
 	if properties != nil {
@@ -394,13 +668,48 @@ func getRequiredParams(plan *osb.Plan) (params []string) {
 	return
 }
 
+func checkRequiredParams(plan *osb.Plan, params map[string]string) (errs []string) {
+	for _, p := range getRequiredParams(plan) {
+		if _, ok := params[p]; !ok {
+			errs = append(errs, fmt.Sprintf("The parameter %s is required.", p))
+		}
+	}
+	return
+}
+
 func paramValue(v interface{}) string {
-	if v == nil {
+	switch value := v.(type) {
+	case nil:
 		return ""
+	case []string:
+		return strings.Join(value, ",")
+	case []interface{}:
+		// list parameters are passed to CloudFormation as comma delimited strings
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = paramValue(item)
+		}
+		return strings.Join(items, ",")
 	}
 	return fmt.Sprintf("%v", v)
 }
 
+// toStringSlice reads a list of strings from a schema or metadata, which is a []string when generated and a
+// []interface{} once stored
+func toStringSlice(v interface{}) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		values := make([]string, len(list))
+		for i, item := range list {
+			values[i] = paramValue(item)
+		}
+		return values
+	}
+	return nil
+}
+
 func bindViaLambda(service *osb.Service) bool {
 	if service.Metadata["bindViaLambda"] == true {
 		return true
@@ -499,6 +808,15 @@ func templateToServiceDefinition(file []byte, db Db, c cache.Cache, item Service
 	}
 	osbdef := db.ServiceDefinitionToOsb(i)
 	if osbdef.Name != "" {
+		setTemplateVersion(&osbdef, i, file)
+		if previous, err := db.DataStorePort.GetServiceDefinition(osbdef.ID); err == nil && maintenanceVersionUnchanged(previous, &osbdef) {
+			glog.Warningf("The template of service %q changed but its Version didn't, increase the Version so platforms offer to upgrade its instances", osbdef.Name)
+		}
+		for _, name := range sortedKeys(i.Metadata.Spec.ServicePlans) {
+			if r := unretainedResources(&i, i.Metadata.Spec.ServicePlans[name]); len(r) > 0 {
+				glog.Warningf("Plan %q of service %q retains the resources %s, which have no DeletionPolicy: Retain and will be deleted with their stacks", name, osbdef.Name, strings.Join(r, ", "))
+			}
+		}
 		err := db.DataStorePort.PutServiceDefinition(osbdef)
 		if err == nil {
 			c.Set(item.Name, osbdef)
@@ -519,20 +837,63 @@ func cfnParamsToOsb(template CfnTemplate) map[string]interface{} {
 	for k, v := range template.Parameters {
 
 		p := map[string]interface{}{"description": v.Description}
-		switch v.Type {
-		case "Number":
+		// constraints on list parameters apply to each item
+		constrained := p
+		switch {
+		case v.Type == "Number":
 			p["type"] = "integer"
+		case v.Type == "CommaDelimitedList" || strings.HasPrefix(v.Type, "List<"):
+			p["type"] = "array"
+			constrained = map[string]interface{}{"type": "string"}
+			if v.Type == "List<Number>" {
+				constrained["type"] = "integer"
+			}
+			p["items"] = constrained
 		default:
 			p["type"] = "string"
 		}
 		if v.Default != nil {
 			p["required"] = false
-			p["default"] = *v.Default
+			if p["type"] == "array" {
+				p["default"] = splitListParam(*v.Default)
+			} else {
+				p["default"] = *v.Default
+			}
 		} else {
 			p["required"] = true
 		}
 		if v.AllowedValues != nil {
-			p["enum"] = v.AllowedValues
+			constrained["enum"] = v.AllowedValues
+		}
+		if v.AllowedPattern != "" {
+			// CloudFormation patterns must match the whole value, JSON Schema patterns match anywhere
+			constrained["pattern"] = "^(?:" + v.AllowedPattern + ")$"
+		}
+		for key, value := range map[string]*string{"minLength": v.MinLength, "maxLength": v.MaxLength} {
+			if value == nil {
+				continue
+			}
+			if n, err := strconv.Atoi(*value); err == nil {
+				constrained[key] = n
+			} else {
+				glog.Errorf("Ignoring invalid %s %q for parameter %q", key, *value, k)
+			}
+		}
+		for key, value := range map[string]*string{"minimum": v.MinValue, "maximum": v.MaxValue} {
+			if value == nil {
+				continue
+			}
+			if n, err := strconv.ParseFloat(*value, 64); err == nil {
+				constrained[key] = n
+			} else {
+				glog.Errorf("Ignoring invalid %s %q for parameter %q", key, *value, k)
+			}
+		}
+		if v.ConstraintDescription != "" {
+			p["constraint_description"] = v.ConstraintDescription
+		}
+		if strings.EqualFold(v.NoEcho, "true") {
+			p["format"] = "password"
 		}
 		if template.Metadata.Interface.ParameterLabels[k].Label != "" {
 			p["title"] = template.Metadata.Interface.ParameterLabels[k].Label
@@ -546,6 +907,18 @@ func cfnParamsToOsb(template CfnTemplate) map[string]interface{} {
 	return osbParams
 }
 
+// splitListParam splits a CommaDelimitedList value, CloudFormation ignores whitespace around each item
+func splitListParam(v string) []string {
+	items := make([]string, 0)
+	if v == "" {
+		return items
+	}
+	for _, item := range strings.Split(v, ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+	return items
+}
+
 func cfnGetParamGroup(param string, template CfnTemplate) string {
 	for _, v := range template.Metadata.Interface.ParameterGroups {
 		if stringInSlice(param, v.Parameters) {
@@ -678,3 +1051,35 @@ func invokeLambdaBindFunc(sess *session.Session, newLambda GetLambdaClient, cred
 	}
 	return output, nil
 }
+
+// provisionMatches returns true if a provision request, building instance from the requested parameters, is identical
+// to the request that provisioned existing. It's compared to the plan and parameters existing was provisioned with, so
+// later updates don't make a repeated request conflict. Both sets of parameters have the plan's defaults and overrides
+// applied, which may have changed since, so only the parameters either request set have to match
+func provisionMatches(existing *serviceinstance.ServiceInstance, instance *serviceinstance.ServiceInstance, requested map[string]interface{}) bool {
+	planID, params := existing.ProvisionPlanID, existing.ProvisionParams
+	if planID == "" {
+		// the instance was provisioned before its provision request was recorded
+		planID, params = existing.PlanID, existing.Params
+	}
+	if existing.ServiceID != instance.ServiceID || planID != instance.PlanID {
+		return false
+	}
+	keys := make(map[string]bool)
+	for k := range requested {
+		keys[k] = true
+	}
+	for _, op := range existing.Operations {
+		if op.Type == serviceinstance.OperationProvision {
+			for k := range op.Params {
+				keys[k] = true
+			}
+		}
+	}
+	for k := range keys {
+		if params[k] != instance.Params[k] {
+			return false
+		}
+	}
+	return true
+}
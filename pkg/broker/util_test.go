@@ -3,6 +3,7 @@ package broker
 import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"net/http"
 	"os"
 	"strings"
 	"testing"
@@ -16,8 +17,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func clearOverrides() {
@@ -52,7 +55,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	g := map[string]string{"override_param": "overridden"}
 
 	msg := "params should not be modified when prescribeOverrides is false"
-	psvcs := prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: false, globalOverrides: g}, services)
+	psvcs := prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: false, globalOverrides: g}, services)
 	expected := []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -71,7 +74,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "override_param should be removed when prescribeOverrides is true"
-	psvcs = prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
+	psvcs = prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
 	expected = []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -118,7 +121,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	}
 
 	msg = "override_param should be removed from Update params too when prescribeOverrides is true"
-	psvcs = prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
+	psvcs = prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
 	expected = []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -148,7 +151,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "required should be removed if all required params are overridden"
-	b := AwsBroker{
+	b := &AwsBroker{
 		brokerid:           "awsservicebroker",
 		prescribeOverrides: true,
 		globalOverrides:    map[string]string{"override_param": "overridden", "req_param": "overridden"},
@@ -179,7 +182,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "should succeed when there are no required params"
-	b = AwsBroker{
+	b = &AwsBroker{
 		brokerid:           "awsservicebroker",
 		prescribeOverrides: true,
 		globalOverrides:    map[string]string{"override_param": "overridden"},
@@ -210,9 +213,46 @@ func TestPrescribeOverrides(t *testing.T) {
 	}
 	assertor.Equal(expected, psvcs, msg)
 
+	msg = "the update schema should be removed if only dry_run is left"
+	psvcs = prescribeOverrides(b, []osb.Service{
+		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
+			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
+				ServiceInstance: &osb.ServiceInstanceSchema{
+					Create: &osb.InputParametersSchema{
+						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
+					},
+					Update: &osb.InputParametersSchema{
+						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+							"override_param": map[string]interface{}{"type": "string"},
+							"dry_run":        map[string]interface{}{"type": "boolean"},
+						}},
+					},
+				},
+			}},
+		}},
+	})
+	assertor.Nil(psvcs[0].Plans[0].Schemas.ServiceInstance.Update, msg)
+
 	clearOverrides()
 }
 
+func TestWithoutInternalMetadata(t *testing.T) {
+	assert := assert.New(t)
+	services := []osb.Service{{Name: "test", Plans: []osb.Plan{
+		{Name: "internal", Metadata: map[string]interface{}{
+			"displayName":     "Internal",
+			"stackOptions":    StackOptions{RoleARN: "arn:aws:iam::123456789012:role/plan"},
+			"retentionPolicy": RetentionPolicy{DeletionProtection: true},
+		}},
+		{Name: "none"},
+	}}}
+
+	served := withoutInternalMetadata(services)
+	assert.Equal(map[string]interface{}{"displayName": "Internal"}, served[0].Plans[0].Metadata)
+	assert.Nil(served[0].Plans[1].Metadata)
+	assert.Contains(services[0].Plans[0].Metadata, "retentionPolicy", "the services given should be left as they are")
+}
+
 func TestGetOverridesFromEnv(t *testing.T) {
 	assertor := assert.New(t)
 
@@ -245,6 +285,15 @@ func TestStringInSlice(t *testing.T) {
 	assertor.Equal(false, stringInSlice("notpresent", []string{"somestr", "present", "anotherstr"}), "should return false")
 }
 
+func TestSortedKeys(t *testing.T) {
+	assertor := assert.New(t)
+
+	assertor.Equal([]string{"a", "b"}, sortedKeys(map[string]CfnServicePlan{"b": {}, "a": {}}))
+	assertor.Equal([]string{"a", "b"}, sortedKeys(map[string]bool{"b": true, "a": true}))
+	assertor.Empty(sortedKeys(map[string]string(nil)))
+	assertor.Empty(sortedKeys(nil), "should return no keys for something that isn't a map")
+}
+
 func TestToScreamingSnakeCase(t *testing.T) {
 	assertor := assert.New(t)
 
@@ -280,6 +329,27 @@ func TestGetOverrides(t *testing.T) {
 
 }
 
+func TestGetStackRoleARN(t *testing.T) {
+	assert := assert.New(t)
+	clearOverrides()
+	defer clearOverrides()
+	b := &AwsBroker{brokerid: "awsservicebroker"}
+	plan := &osb.Plan{}
+	rolePlan := &osb.Plan{Metadata: map[string]interface{}{"stackOptions": StackOptions{RoleARN: "arn:aws:iam::123456789012:role/plan"}}}
+
+	assert.Equal("", b.getStackRoleARN(plan, "test-service", "default", "cluster"))
+	b.cfnRoleArn = "arn:aws:iam::123456789012:role/broker"
+	assert.Equal("arn:aws:iam::123456789012:role/broker", b.getStackRoleARN(plan, "test-service", "default", "cluster"))
+	assert.Equal("arn:aws:iam::123456789012:role/plan", b.getStackRoleARN(rolePlan, "test-service", "default", "cluster"))
+
+	os.Setenv("PARAM_OVERRIDE_awsservicebroker_all_default_test-service_cfn_role_arn", "arn:aws:iam::123456789012:role/namespace")
+	assert.Equal("arn:aws:iam::123456789012:role/namespace", b.getStackRoleARN(rolePlan, "test-service", "default", "cluster"))
+	assert.Equal("arn:aws:iam::123456789012:role/plan", b.getStackRoleARN(rolePlan, "test-service", "other", "cluster"))
+
+	assert.Nil(stackRoleARN(&serviceinstance.ServiceInstance{}))
+	assert.Equal(aws.String("arn:aws:iam::123456789012:role/plan"), stackRoleARN(&serviceinstance.ServiceInstance{RoleARN: "arn:aws:iam::123456789012:role/plan"}))
+}
+
 func TestAwsCredentialsGetter(t *testing.T) {
 	assertor := assert.New(t)
 
@@ -328,6 +398,195 @@ func TestToCFNParams(t *testing.T) {
 	assertor.Equal(expected, actual, "should return input marshalled into []*cloudformation.Parameter ")
 }
 
+func TestCfnParamsToOsb(t *testing.T) {
+	assertor := assert.New(t)
+
+	var template CfnTemplate
+	err := yaml.Unmarshal([]byte(`
+Parameters:
+  Name:
+    Type: String
+    Description: name
+    AllowedPattern: "[a-z]+"
+    MinLength: 3
+    MaxLength: "10"
+    ConstraintDescription: must be lowercase
+  Password:
+    Type: String
+    NoEcho: true
+    Default: secret
+  Port:
+    Type: Number
+    MinValue: 1024
+    MaxValue: 65535.5
+  Subnets:
+    Type: CommaDelimitedList
+    Default: "a, b"
+    AllowedValues: [a, b, c]
+  Sizes:
+    Type: List<Number>
+    MinValue: 1
+`), &template)
+	assertor.NoError(err)
+
+	expected := map[string]interface{}{
+		"Name": map[string]interface{}{
+			"description":            "name",
+			"type":                   "string",
+			"required":               true,
+			"pattern":                "^(?:[a-z]+)$",
+			"minLength":              3,
+			"maxLength":              10,
+			"constraint_description": "must be lowercase",
+		},
+		"Password": map[string]interface{}{
+			"description": "",
+			"type":        "string",
+			"required":    false,
+			"default":     "secret",
+			"format":      "password",
+		},
+		"Port": map[string]interface{}{
+			"description": "",
+			"type":        "integer",
+			"required":    true,
+			"minimum":     float64(1024),
+			"maximum":     65535.5,
+		},
+		"Subnets": map[string]interface{}{
+			"description": "",
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string", "enum": []string{"a", "b", "c"}},
+			"required":    false,
+			"default":     []string{"a", "b"},
+		},
+		"Sizes": map[string]interface{}{
+			"description": "",
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "integer", "minimum": float64(1)},
+			"required":    true,
+		},
+	}
+	assertor.Equal(expected, cfnParamsToOsb(template))
+}
+
+func TestChangePlanParams(t *testing.T) {
+	planSchema := func(props map[string]interface{}, prescribed map[string]interface{}) *osb.Schemas {
+		return &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{Create: &osb.InputParametersSchema{
+			Parameters: map[string]interface{}{"properties": props, "prescribed": prescribed},
+		}}}
+	}
+	current := &osb.Plan{Schemas: planSchema(map[string]interface{}{
+		"Name":    map[string]interface{}{"type": "string"},
+		"Backups": map[string]interface{}{"type": "string", "default": "1"},
+		"Size":    map[string]interface{}{"type": "string", "default": "small"},
+	}, map[string]interface{}{"MultiAZ": "false", "Storage": "20"})}
+	new := &osb.Plan{Schemas: planSchema(map[string]interface{}{
+		"Name":    map[string]interface{}{"type": "string"},
+		"Backups": map[string]interface{}{"type": "string", "default": "7"},
+		"Size":    map[string]interface{}{"type": "string", "default": "large"},
+		"Storage": map[string]interface{}{"type": "string", "default": "100"},
+	}, map[string]interface{}{"MultiAZ": "true"})}
+
+	params := map[string]string{"Name": "test", "Backups": "1", "Size": "medium", "MultiAZ": "false", "Storage": "20", "region": "us-east-1"}
+	assert.Equal(t, map[string]string{
+		"Name":    "test",
+		"Backups": "7",
+		"Size":    "medium",
+		"MultiAZ": "true",
+		"Storage": "100",
+		"region":  "us-east-1",
+	}, changePlanParams(current, new, params))
+}
+
+func TestMaintenanceVersion(t *testing.T) {
+	version := templateVersion([]byte("template"))
+	assert.Equal(t, "1.0.0+"+version[:12], maintenanceVersion("1.0", version))
+	assert.Equal(t, "2.1.3+"+version[:12], maintenanceVersion("2.1.3", version))
+	assert.Equal(t, "0.0.0+"+version[:12], maintenanceVersion("", version))
+	assert.Equal(t, "0.0.0+"+version[:12], maintenanceVersion("1.0,", version))
+	assert.Equal(t, "0.0.0+"+version[:12], maintenanceVersion("1.2.3.4", version))
+}
+
+func TestMaintenanceVersionUnchanged(t *testing.T) {
+	service := func(specVersion string, body string) *osb.Service {
+		s := &osb.Service{Name: "test", Metadata: map[string]interface{}{}, Plans: []osb.Plan{{ID: "plan"}}}
+		var tmpl CfnTemplate
+		tmpl.Metadata.Spec.Version = specVersion
+		setTemplateVersion(s, tmpl, []byte(body))
+		return s
+	}
+	assert.False(t, maintenanceVersionUnchanged(nil, service("1.0", "template")))
+	assert.False(t, maintenanceVersionUnchanged(service("1.0", "template"), service("1.0", "template")))
+	assert.True(t, maintenanceVersionUnchanged(service("1.0", "template"), service("1.0", "changed")))
+	assert.False(t, maintenanceVersionUnchanged(service("1.0", "template"), service("1.1", "changed")))
+}
+
+func TestCheckMaintenanceInfo(t *testing.T) {
+	plan := &osb.Plan{Metadata: map[string]interface{}{"maintenanceInfo": map[string]interface{}{"version": "1.0.0"}}}
+	conflict := newHTTPStatusCodeError(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", "The maintenance_info.version field provided in the request does not match the maintenance_info.version field provided in the Service Broker's Catalog.")
+
+	assert.NoError(t, checkMaintenanceInfo(plan, nil))
+	assert.NoError(t, checkMaintenanceInfo(plan, &MaintenanceInfo{Version: "1.0.0"}))
+	assert.Equal(t, conflict, checkMaintenanceInfo(plan, &MaintenanceInfo{Version: "0.9.0"}))
+	assert.Equal(t, conflict, checkMaintenanceInfo(&osb.Plan{}, &MaintenanceInfo{Version: "1.0.0"}))
+}
+
+func TestStackOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	// plans read from the DataStore hold the options as a map
+	plan := &osb.Plan{Metadata: map[string]interface{}{"stackOptions": map[string]interface{}{
+		"timeoutInMinutes":            float64(30),
+		"onFailure":                   "DO_NOTHING",
+		"enableTerminationProtection": true,
+		"stackPolicy":                 `{"Statement":[]}`,
+		"notificationARNs":            []interface{}{"arn:aws:sns:us-east-1:123456789012:topic"},
+	}}}
+	options := getStackOptions(plan)
+	assert.Equal(StackOptions{
+		TimeoutInMinutes:            30,
+		OnFailure:                   "DO_NOTHING",
+		EnableTerminationProtection: true,
+		StackPolicy:                 `{"Statement":[]}`,
+		NotificationARNs:            []string{"arn:aws:sns:us-east-1:123456789012:topic"},
+	}, options)
+	assert.Equal(StackOptions{}, getStackOptions(&osb.Plan{}))
+
+	create := &cloudformation.CreateStackInput{}
+	setCreateStackOptions(create, options)
+	assert.Equal(&cloudformation.CreateStackInput{
+		EnableTerminationProtection: aws.Bool(true),
+		NotificationARNs:            aws.StringSlice([]string{"arn:aws:sns:us-east-1:123456789012:topic"}),
+		OnFailure:                   aws.String("DO_NOTHING"),
+		StackPolicyBody:             aws.String(`{"Statement":[]}`),
+		TimeoutInMinutes:            aws.Int64(30),
+	}, create)
+	create = &cloudformation.CreateStackInput{}
+	setCreateStackOptions(create, StackOptions{})
+	assert.Equal(&cloudformation.CreateStackInput{}, create)
+
+	update := &cloudformation.UpdateStackInput{}
+	setUpdateStackOptions(update, options)
+	assert.Equal(&cloudformation.UpdateStackInput{
+		NotificationARNs: aws.StringSlice([]string{"arn:aws:sns:us-east-1:123456789012:topic"}),
+		StackPolicyBody:  aws.String(`{"Statement":[]}`),
+	}, update)
+	update = &cloudformation.UpdateStackInput{}
+	setUpdateStackOptions(update, StackOptions{})
+	assert.Equal(&cloudformation.UpdateStackInput{NotificationARNs: []*string{}}, update)
+}
+
+func TestParamValue(t *testing.T) {
+	assertor := assert.New(t)
+
+	assertor.Equal("", paramValue(nil))
+	assertor.Equal("test", paramValue("test"))
+	assertor.Equal("5", paramValue(float64(5)))
+	assertor.Equal("a,b", paramValue([]string{"a", "b"}))
+	assertor.Equal("a,1", paramValue([]interface{}{"a", float64(1)}))
+}
+
 func TestNewHTTPStatusCodeError(t *testing.T) {
 	assertor := assert.New(t)
 
@@ -357,6 +616,44 @@ func TestGetCluster(t *testing.T) {
 		"organization_guid": "testtest",
 	}
 	assertor.Equal("unknown", getCluster(context), "should return unknown")
+
+	context = map[string]interface{}{
+		"platform": osb.PlatformCloudFoundry,
+	}
+	assertor.Equal("unknown", getCluster(context), "should return unknown if the cf guid is missing")
+	assertor.Equal("unknown", getNamespace(context), "should return unknown if the cf guid is missing")
+}
+
+func TestGetInstanceTags(t *testing.T) {
+	assertor := assert.New(t)
+
+	instance := &serviceinstance.ServiceInstance{ID: "test-instance"}
+	tags, err := getInstanceTags("test-broker", nil, instance, nil)
+	assertor.NoError(err)
+	assertor.Nil(tags, "should keep the stack's tags if the context isn't known")
+
+	instance.Context = map[string]interface{}{
+		"platform":  osb.PlatformKubernetes,
+		"clusterid": "test-cluster",
+		"namespace": "test-namespace",
+	}
+	params := map[string]string{
+		"admin_tags": `[{"Key": "cost-center", "Value": "42"}]`,
+		"user_tags":  `[{"Key": "team", "Value": "data"}]`,
+	}
+	tags, err = getInstanceTags("test-broker", nil, instance, params)
+	assertor.NoError(err)
+	assertor.Equal([]*cloudformation.Tag{
+		{Key: aws.String("aws-service-broker:broker-id"), Value: aws.String("test-broker")},
+		{Key: aws.String("aws-service-broker:instance-id"), Value: aws.String("test-instance")},
+		{Key: aws.String("aws-service-broker:cluster"), Value: aws.String("test-cluster")},
+		{Key: aws.String("aws-service-broker:namespace"), Value: aws.String("test-namespace")},
+		{Key: aws.String("team"), Value: aws.String("data")},
+		{Key: aws.String("cost-center"), Value: aws.String("42")},
+	}, tags)
+
+	_, err = getInstanceTags("test-broker", nil, instance, map[string]string{"user_tags": "["})
+	assertor.Error(err)
 }
 
 type mockSsmGetParameters struct {
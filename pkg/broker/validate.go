@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var currencyCodeRegex = regexp.MustCompile(`^[A-Za-z]{3}$`)
+
+// ValidationError describes a problem found in a template's service broker specification
+type ValidationError struct {
+	File    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.File, e.Message)
+}
+
+// ValidateTemplate parses a template and checks its AWS::ServiceBroker::Specification for errors that would
+// otherwise only be logged when the catalog is loaded. Parse failures return a nil template
+func ValidateTemplate(file string, body []byte) (*CfnTemplate, []ValidationError) {
+	var errs []ValidationError
+	report := func(format string, a ...interface{}) {
+		errs = append(errs, ValidationError{File: file, Message: fmt.Sprintf(format, a...)})
+	}
+
+	var t CfnTemplate
+	if err := yaml.Unmarshal(body, &t); err != nil {
+		report("failed to parse template: %v", err)
+		return nil, errs
+	}
+	spec := t.Metadata.Spec
+	if spec.Name == "" {
+		report("AWS::ServiceBroker::Specification has no Name")
+	}
+	if len(spec.ServicePlans) == 0 {
+		report("AWS::ServiceBroker::Specification has no ServicePlans")
+	}
+	params := make([]string, 0, len(t.Parameters))
+	for name := range t.Parameters {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		param := t.Parameters[name]
+		// AllowedPattern isn't checked, CloudFormation uses Java regular expressions which Go can't always compile
+		if param.MinLength != nil {
+			if _, err := strconv.Atoi(*param.MinLength); err != nil {
+				report("parameter %q MinLength %q is not an integer", name, *param.MinLength)
+			}
+		}
+		if param.MaxLength != nil {
+			if _, err := strconv.Atoi(*param.MaxLength); err != nil {
+				report("parameter %q MaxLength %q is not an integer", name, *param.MaxLength)
+			}
+		}
+		if param.MinValue != nil {
+			if _, err := strconv.ParseFloat(*param.MinValue, 64); err != nil {
+				report("parameter %q MinValue %q is not a number", name, *param.MinValue)
+			}
+		}
+		if param.MaxValue != nil {
+			if _, err := strconv.ParseFloat(*param.MaxValue, 64); err != nil {
+				report("parameter %q MaxValue %q is not a number", name, *param.MaxValue)
+			}
+		}
+	}
+	for _, scope := range spec.Bindings.Scopes {
+		if _, ok := t.Outputs[cfnOutputPolicyArnPrefix+scope]; !ok {
+			report("binding scope %q has no %s%s output", scope, cfnOutputPolicyArnPrefix, scope)
+		}
+	}
+	for _, c := range spec.Capabilities {
+		if !stringInSlice(c, cloudformation.Capability_Values()) {
+			report("Capabilities has invalid capability %q", c)
+		}
+	}
+	for _, r := range spec.ProtectedResources {
+		if _, ok := t.Resources[r]; !ok {
+			report("ProtectedResources references unknown resource %q", r)
+		}
+	}
+	if spec.FinalSnapshotParameter != "" {
+		if _, ok := t.Parameters[spec.FinalSnapshotParameter]; !ok {
+			report("FinalSnapshotParameter references unknown parameter %q", spec.FinalSnapshotParameter)
+		}
+	}
+	for _, p := range spec.UpdatableParameters {
+		if _, ok := t.Parameters[p]; !ok {
+			report("UpdatableParameters references unknown parameter %q", p)
+		}
+	}
+	for _, name := range sortedKeys(spec.ServicePlans) {
+		plan := spec.ServicePlans[name]
+		for _, p := range sortedKeys(plan.ParameterValues) {
+			if _, ok := t.Parameters[p]; !ok {
+				report("plan %q ParameterValues references unknown parameter %q", name, p)
+			}
+		}
+		for _, p := range sortedKeys(plan.ParameterDefaults) {
+			if _, ok := t.Parameters[p]; !ok {
+				report("plan %q ParameterDefaults references unknown parameter %q", name, p)
+			}
+			if _, ok := plan.ParameterValues[p]; ok {
+				report("plan %q sets parameter %q in both ParameterValues and ParameterDefaults", name, p)
+			}
+		}
+		for _, p := range plan.UpdatablePlans {
+			if _, ok := spec.ServicePlans[p]; !ok {
+				report("plan %q UpdatablePlans references unknown plan %q", name, p)
+			}
+		}
+		if plan.TimeoutInMinutes < 0 {
+			report("plan %q has negative TimeoutInMinutes %d", name, plan.TimeoutInMinutes)
+		}
+		if plan.OnFailure != "" && !stringInSlice(plan.OnFailure, cloudformation.OnFailure_Values()) {
+			report("plan %q has invalid OnFailure %q", name, plan.OnFailure)
+		}
+		if plan.StackPolicy != "" && !json.Valid([]byte(plan.StackPolicy)) {
+			report("plan %q StackPolicy is not a JSON document", name)
+		}
+		if plan.RoleARN != "" && !arn.IsARN(plan.RoleARN) {
+			report("plan %q RoleARN %q is not an ARN", name, plan.RoleARN)
+		}
+		if plan.FinalSnapshot && spec.FinalSnapshotParameter == "" {
+			report("plan %q sets FinalSnapshot but the specification has no FinalSnapshotParameter", name)
+		}
+		for _, r := range plan.RetainResources {
+			if _, ok := t.Resources[r]; !ok {
+				report("plan %q RetainResources references unknown resource %q", name, r)
+			}
+		}
+		for _, r := range unretainedResources(&t, plan) {
+			report("plan %q RetainResources resource %q has no DeletionPolicy: Retain, it would be deleted with the stack", name, r)
+		}
+		for i, cost := range plan.Costs {
+			if cost.Unit == "" {
+				report("plan %q Costs[%d] has no Unit", name, i)
+			}
+			if len(cost.Amount) == 0 {
+				report("plan %q Costs[%d] has no Amount", name, i)
+			}
+			currencies := make([]string, 0, len(cost.Amount))
+			for currency := range cost.Amount {
+				currencies = append(currencies, currency)
+			}
+			sort.Strings(currencies)
+			for _, currency := range currencies {
+				amount := cost.Amount[currency]
+				if !currencyCodeRegex.MatchString(currency) {
+					report("plan %q Costs[%d] has invalid currency code %q", name, i, currency)
+				}
+				if amount < 0 {
+					report("plan %q Costs[%d] has negative amount %v", name, i, amount)
+				}
+			}
+		}
+	}
+	return &t, errs
+}
+
+// unretainedResources returns the resources a plan retains whose DeletionPolicy doesn't keep them when the stack is
+// deleted. CloudFormation only lets the broker retain resources that failed to delete, so resources that are deleted
+// successfully are only kept by their DeletionPolicy
+func unretainedResources(t *CfnTemplate, plan CfnServicePlan) []string {
+	var unretained []string
+	for _, r := range plan.RetainResources {
+		if resource, ok := t.Resources[r]; ok && resource.DeletionPolicy != "Retain" && resource.DeletionPolicy != "RetainExceptOnCreate" {
+			unretained = append(unretained, r)
+		}
+	}
+	return unretained
+}
+
+// ValidateTemplates validates every template in dir (including subdirectories) ending with suffix, and checks that
+// service names are unique across templates
+func ValidateTemplates(dir, suffix string) ([]ValidationError, error) {
+	var errs []ValidationError
+	names := make(map[string]string)
+	err := walkTemplates(dir, suffix, func(path string, body []byte) error {
+		t, templateErrs := ValidateTemplate(path, body)
+		errs = append(errs, templateErrs...)
+		if t == nil || t.Metadata.Spec.Name == "" {
+			return nil
+		}
+		if other, ok := names[t.Metadata.Spec.Name]; ok {
+			errs = append(errs, ValidationError{
+				File:    path,
+				Message: fmt.Sprintf("service name %q is already used by %s", t.Metadata.Spec.Name, other),
+			})
+		} else {
+			names[t.Metadata.Spec.Name] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// walkTemplates calls fn with the body of every template in dir and its subdirectories ending with suffix, it is an
+// error for there to be no templates
+func walkTemplates(dir, suffix string, fn func(path string, body []byte) error) error {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), suffix) || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		count++
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return fn(path, body)
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no templates ending with %q found in %s", suffix, dir)
+	}
+	return nil
+}
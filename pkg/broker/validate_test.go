@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testInvalidTemplate = `
+Parameters:
+  BucketName:
+    Type: String
+    AllowedPattern: "(?=.*[0-9])[a-z0-9]+"
+    MinLength: three
+    MaxValue: ten
+Resources:
+  Table:
+    Type: AWS::DynamoDB::Table
+Outputs:
+  PolicyArnReadOnly:
+    Value: arn
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Bindings:
+      Scopes: [ReadOnly, ReadWrite]
+    Capabilities: [CAPABILITY_AUTO_EXPAND, CAPABILITY_EVERYTHING]
+    ProtectedResources: [Missing]
+    FinalSnapshotParameter: Snapshot
+    UpdatableParameters:
+      - BucketName
+      - Missing
+    ServicePlans:
+      default:
+        ParameterValues:
+          Unknown: value
+        ParameterDefaults:
+          BucketName: test
+          AlsoUnknown: value
+        UpdatablePlans:
+          - production
+        TimeoutInMinutes: -1
+        OnFailure: SOMETIMES
+        StackPolicy: "{"
+        RoleARN: cfn-role
+        FinalSnapshot: true
+        RetainResources: [Bucket, Table]
+        Costs:
+          - Amount:
+              usd: -1
+              dollars: 1
+          - Unit: MONTHLY
+`
+
+func TestValidateTemplate(t *testing.T) {
+	tmpl, errs := ValidateTemplate("localtest-main.yaml", []byte(testLocalTemplate))
+	assert.NotNil(t, tmpl)
+	assert.Empty(t, errs)
+
+	_, errs = ValidateTemplate("invalid-main.yaml", []byte(testInvalidTemplate))
+	var messages []string
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+	assert.Equal(t, []string{
+		"invalid-main.yaml: AWS::ServiceBroker::Specification has no Name",
+		`invalid-main.yaml: parameter "BucketName" MinLength "three" is not an integer`,
+		`invalid-main.yaml: parameter "BucketName" MaxValue "ten" is not a number`,
+		`invalid-main.yaml: binding scope "ReadWrite" has no PolicyArnReadWrite output`,
+		`invalid-main.yaml: Capabilities has invalid capability "CAPABILITY_EVERYTHING"`,
+		`invalid-main.yaml: ProtectedResources references unknown resource "Missing"`,
+		`invalid-main.yaml: FinalSnapshotParameter references unknown parameter "Snapshot"`,
+		`invalid-main.yaml: UpdatableParameters references unknown parameter "Missing"`,
+		`invalid-main.yaml: plan "default" ParameterValues references unknown parameter "Unknown"`,
+		`invalid-main.yaml: plan "default" ParameterDefaults references unknown parameter "AlsoUnknown"`,
+		`invalid-main.yaml: plan "default" UpdatablePlans references unknown plan "production"`,
+		`invalid-main.yaml: plan "default" has negative TimeoutInMinutes -1`,
+		`invalid-main.yaml: plan "default" has invalid OnFailure "SOMETIMES"`,
+		`invalid-main.yaml: plan "default" StackPolicy is not a JSON document`,
+		`invalid-main.yaml: plan "default" RoleARN "cfn-role" is not an ARN`,
+		`invalid-main.yaml: plan "default" RetainResources references unknown resource "Bucket"`,
+		`invalid-main.yaml: plan "default" RetainResources resource "Table" has no DeletionPolicy: Retain, it would be deleted with the stack`,
+		`invalid-main.yaml: plan "default" Costs[0] has no Unit`,
+		`invalid-main.yaml: plan "default" Costs[0] has invalid currency code "dollars"`,
+		`invalid-main.yaml: plan "default" Costs[0] has negative amount -1`,
+		`invalid-main.yaml: plan "default" Costs[1] has no Amount`,
+	}, messages)
+
+	tmpl, errs = ValidateTemplate("broken-main.yaml", []byte("Parameters: ["))
+	assert.Nil(t, tmpl)
+	assert.Len(t, errs, 1)
+}
+
+func TestValidateTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTemplate(t, dir, "localtest-main.yaml", testLocalTemplate)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0755))
+	writeTestTemplate(t, filepath.Join(dir, "nested"), "copy-main.yaml", testLocalTemplate)
+	writeTestTemplate(t, dir, "README.md", "not a template")
+
+	errs, err := ValidateTemplates(dir, "-main.yaml")
+	assert.NoError(t, err)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Message, `service name "localtest" is already used by`)
+
+	_, err = ValidateTemplates(dir, "-other.yaml")
+	assert.Error(t, err)
+
+	_, err = ValidateTemplates(filepath.Join(dir, "missing"), "-main.yaml")
+	assert.Error(t, err)
+}
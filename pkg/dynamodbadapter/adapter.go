@@ -1,6 +1,7 @@
 package dynamodbadapter
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -22,6 +23,9 @@ const (
 	itemTypeServiceInstance = "serviceinstance"
 )
 
+// ErrParamNotFound is returned by GetParam when the parameter doesn't exist
+var ErrParamNotFound = errors.New("parameter does not exist")
+
 // DdbDataStore is a DynamoDB implementation of DataStore.
 type DdbDataStore struct {
 	Accountid   string
@@ -82,7 +86,7 @@ func (db DdbDataStore) GetParam(paramname string) (value string, err error) {
 		return "", err
 	}
 	if len(result.Item) == 0 {
-		return "", fmt.Errorf("parameter does not exist")
+		return "", ErrParamNotFound
 	}
 
 	item := Param{}
@@ -100,15 +104,9 @@ func (db DdbDataStore) GetParam(paramname string) (value string, err error) {
 
 // PutParam puts parameters into Dynamo
 func (db DdbDataStore) PutParam(paramname string, paramvalue string) error {
-	paramuuid := uuid.NewV5(db.Accountuuid, paramname).String()
 	putInput := dynamodb.PutItemInput{
 		TableName: aws.String(db.Tablename),
-		Item: map[string]*dynamodb.AttributeValue{
-			"id":     {S: aws.String(paramuuid)},
-			"userid": {S: aws.String(db.Accountuuid.String())},
-			"value":  {S: aws.String(paramvalue)},
-			"type":   {S: aws.String(itemTypeParameter)},
-		},
+		Item:      db.paramItem(paramname, paramvalue),
 	}
 	_, err := db.Ddb.PutItem(&putInput)
 	if err != nil {
@@ -117,6 +115,77 @@ func (db DdbDataStore) PutParam(paramname string, paramvalue string) error {
 	return nil
 }
 
+// ListParams returns the parameters whose names start with prefix
+func (db DdbDataStore) ListParams(prefix string) (map[string]string, error) {
+	filter := expression.Name("userid").Equal(expression.Value(db.Accountuuid.String())).
+		And(expression.Name("type").Equal(expression.Value(itemTypeParameter))).
+		And(expression.Name("name").BeginsWith(prefix))
+	expr, err := expression.NewBuilder().
+		WithFilter(filter).
+		WithProjection(expression.NamesList(expression.Name("name"), expression.Name("value"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]string)
+	err = db.Ddb.ScanPages(&dynamodb.ScanInput{
+		ConsistentRead:            aws.Bool(true),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(db.Tablename),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if item["name"] != nil && item["value"] != nil {
+				params[aws.StringValue(item["name"].S)] = aws.StringValue(item["value"].S)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// SwapParam sets a parameter only if its value is old, an empty old value meaning the parameter doesn't exist
+func (db DdbDataStore) SwapParam(paramname string, old string, new string) (bool, error) {
+	condition := expression.AttributeNotExists(expression.Name("id"))
+	if old != "" {
+		condition = expression.Name("value").Equal(expression.Value(old))
+	}
+	expr, err := expression.NewBuilder().WithCondition(condition).Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = db.Ddb.PutItem(&dynamodb.PutItemInput{
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Item:                      db.paramItem(paramname, new),
+		TableName:                 aws.String(db.Tablename),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// paramItem is the item storing a parameter, the name is kept so parameters can be listed by prefix
+func (db DdbDataStore) paramItem(paramname string, paramvalue string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":     {S: aws.String(uuid.NewV5(db.Accountuuid, paramname).String())},
+		"userid": {S: aws.String(db.Accountuuid.String())},
+		"name":   {S: aws.String(paramname)},
+		"value":  {S: aws.String(paramvalue)},
+		"type":   {S: aws.String(itemTypeParameter)},
+	}
+}
+
 // ServiceItem used to unmarshal catalog entries from DynamoDb
 type ServiceItem struct {
 	ID          string      `json:"id"`
@@ -190,6 +259,46 @@ func (db DdbDataStore) PutServiceInstance(si serviceinstance.ServiceInstance) er
 	return nil
 }
 
+// ListServiceInstances returns the service instances of the given service.
+func (db DdbDataStore) ListServiceInstances(serviceid string) ([]serviceinstance.ServiceInstance, error) {
+	filter := expression.Name("userid").Equal(expression.Value(db.Accountuuid.String())).
+		And(expression.Name("type").Equal(expression.Value(itemTypeServiceInstance))).
+		And(expression.Name("serviceinstance.ServiceID").Equal(expression.Value(serviceid)))
+	expr, err := expression.NewBuilder().
+		WithFilter(filter).
+		WithProjection(expression.NamesList(expression.Name("serviceinstance"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []serviceinstance.ServiceInstance
+	var unmarshalErr error
+	err = db.Ddb.ScanPages(&dynamodb.ScanInput{
+		ConsistentRead:            aws.Bool(true),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(db.Tablename),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var si serviceinstance.ServiceInstance
+			if unmarshalErr = dynamodbattribute.Unmarshal(item["serviceinstance"], &si); unmarshalErr != nil {
+				return false
+			}
+			instances = append(instances, si)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	} else if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return instances, nil
+}
+
 // DeleteServiceInstance deletes the service instance.
 func (db DdbDataStore) DeleteServiceInstance(sid string) error {
 	return db.deleteItem(sid, itemTypeServiceInstance)
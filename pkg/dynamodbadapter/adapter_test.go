@@ -0,0 +1,64 @@
+package dynamodbadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDataStore returns a DdbDataStore whose DynamoDB requests are answered with body
+func newTestDataStore(t *testing.T, body string) DdbDataStore {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		DisableSSL:  aws.Bool(true),
+		Endpoint:    aws.String(server.URL),
+		MaxRetries:  aws.Int(0),
+		Region:      aws.String("us-east-1"),
+	}))
+	return DdbDataStore{Accountuuid: uuid.NewV4(), Ddb: *dynamodb.New(sess), Tablename: "test"}
+}
+
+func TestListServiceInstances(t *testing.T) {
+	db := newTestDataStore(t, `{"Count": 2, "Items": [
+		{"serviceinstance": {"M": {"ID": {"S": "i1"}, "ServiceID": {"S": "s1"}}}},
+		{"serviceinstance": {"M": {"ID": {"S": "i2"}, "ServiceID": {"S": "s1"}}}}
+	]}`)
+	instances, err := db.ListServiceInstances("s1")
+	assert.NoError(t, err)
+	if assert.Len(t, instances, 2) {
+		assert.Equal(t, "i1", instances[0].ID)
+		assert.Equal(t, "i2", instances[1].ID)
+	}
+
+	// an instance that can't be read fails the listing rather than being left out
+	db = newTestDataStore(t, `{"Count": 2, "Items": [
+		{"serviceinstance": {"M": {"ID": {"S": "i1"}, "ServiceID": {"S": "s1"}}}},
+		{"serviceinstance": {"M": {"ID": {"S": "i2"}, "Params": {"S": "not a map"}}}}
+	]}`)
+	instances, err = db.ListServiceInstances("s1")
+	assert.Error(t, err)
+	assert.Nil(t, instances)
+}
+
+func TestGetParam(t *testing.T) {
+	db := newTestDataStore(t, `{"Item": {"value": {"S": "a-value"}}}`)
+	value, err := db.GetParam("a-param")
+	assert.NoError(t, err)
+	assert.Equal(t, "a-value", value)
+
+	db = newTestDataStore(t, `{}`)
+	_, err = db.GetParam("a-param")
+	assert.Equal(t, ErrParamNotFound, err)
+}
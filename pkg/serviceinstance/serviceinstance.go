@@ -1,6 +1,13 @@
 package serviceinstance
 
-import "reflect"
+import "time"
+
+// Operation types
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+)
 
 // ServiceInstance provides details of a service instance
 type ServiceInstance struct {
@@ -9,10 +16,49 @@ type ServiceInstance struct {
 	PlanID    string
 	Params    map[string]string
 	StackID   string
+	// RoleARN is the CloudFormation service role the stack was created with, and is updated and deleted with
+	RoleARN string
+	// Context is the platform context the instance was last provisioned or updated in, the stack's tags are computed
+	// from it
+	Context map[string]interface{}
+	// ProvisionPlanID and ProvisionParams are the plan and parameters the instance was provisioned with, a repeated
+	// provision request is compared to them
+	ProvisionPlanID string
+	ProvisionParams map[string]string
+	// TemplateVersion identifies the template the stack was last created or updated with
+	TemplateVersion string
+	// Operations are the latest asynchronous operations on the instance, oldest first
+	Operations []Operation
 }
 
-func (i *ServiceInstance) Match(other *ServiceInstance) bool {
-	return reflect.DeepEqual(i, other)
+// Operation records an asynchronous operation on a service instance
+type Operation struct {
+	ID      string
+	Type    string
+	Started time.Time
+	// StackStatus is the status of the instance's stack when the operation started
+	StackStatus string
+	// StackUpdated is when the instance's stack was last created or updated before the operation started
+	StackUpdated time.Time
+	// Params are the parameters given in the request
+	Params map[string]string
+	// State is set once the result of the operation is known without checking the stack
+	State string
+	// Description explains the State, e.g. why the operation failed
+	Description string
+	// PreviousParams, PreviousPlanID and PreviousTemplateVersion are the instance's values before an update, which are
+	// restored if the update rolls back
+	PreviousParams          map[string]string
+	PreviousPlanID          string
+	PreviousTemplateVersion string
+	// RollbackContinued is set once the rollback of a failed update has been continued after failing itself
+	RollbackContinued bool
+	// PendingDelete is set while a deprovision updates the stack to take a final snapshot, the stack is deleted once
+	// the update completes
+	PendingDelete bool
+	// RetainResources are the resources a deprovision retains when retrying the delete of a stack that failed to
+	// delete them, they are cleared once the delete has been retried
+	RetainResources []string
 }
 
 // ServiceBinding represents a service binding.